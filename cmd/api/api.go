@@ -1,22 +1,33 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/ruhancs/go-stripe/internal/cards"
 	driverDB "github.com/ruhancs/go-stripe/internal/driver"
+	"github.com/ruhancs/go-stripe/internal/encryption"
 	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/totp"
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
 )
 
 //gerar arquivo de migracao: soda generate fizz CreateTokensTable
 
 const version = "1.0.0"
 
+//chave dos dados criptografados em desenvolvimento quando ENCRYPTION_KEYS nao foi definida
+const devEncryptionKey = "go-stripe-dev-encryption-key-000"
+
 type config struct {
 	port int
 	env string
@@ -26,6 +37,9 @@ type config struct {
 	stripe struct {
 		secret string
 		key string
+		gateway string
+		gatewayState string //arquivo do estado do gateway fake, o mesmo na api e no web
+		webhookSecret string //segredo para verificar a assinatura dos webhooks
 	}
 	smtp struct {
 		host string
@@ -33,8 +47,18 @@ type config struct {
 		username string
 		password string
 	}
-	secretKey string //chave para assinar as urls de reset de senha
+	idempotencyTTL time.Duration //tempo que as respostas com Idempotency-Key ficam salvas
+	reservationTTL time.Duration //tempo que o estoque fica reservado aguardando o pagamento
+	maxReservations int //reservas em aberto por ip
+	secretKey string //chave do formato antigo AES-CFB, usada apenas na rotacao das chaves
 	frontend string // url de reset de senha
+	invoiceURL string //url do microservico de invoice
+	invoicePublicURL string //url do microservico vista pelo navegador, usada nos links de download
+	invoiceSecret string //segredo que assina as requisicoes ao microservico de invoice
+	fixedTime string //hora fixa dos codigos do 2FA, apenas fora de producao
+	encryptionKeys string //key ring no formato id:base64,id2:base64, a primeira chave é a primaria
+	signingKeys string //chaves dos links assinados no formato id:base64,id2:base64, a primeira assina
+	rotateKeys bool //criptografa de novo os dados salvos com a chave primaria e sai
 }
 
 type application struct {
@@ -43,9 +67,14 @@ type application struct {
 	errorLog *log.Logger
 	version string
 	DB models.DbModel
+	Gateway cards.PaymentGateway
+	clock totp.Clock //hora usada na validacao dos codigos do 2FA
+	keys *encryption.KeyRing //chaves dos dados criptografados no banco
+	signer *urlsigner.URLSigner //links assinados enviados por email
 }
 
-func (app *application) server() error {
+//server atende ate ctx ser cancelado, as requests em andamento terminam antes de sair
+func (app *application) server(ctx context.Context) error {
 	srv := &http.Server{
 		Addr: fmt.Sprintf(":%d", app.config.port),
 		Handler: app.routes(),//routes configurado em route.go
@@ -57,7 +86,21 @@ func (app *application) server() error {
 
 	app.infolog.Println( fmt.Printf("Starting Back end server on port %d", app.config.port))
 
-	return srv.ListenAndServe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	app.infolog.Println("Shutting down back end server")
+	shutdownCtx,cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
 }
 
 //main do backend
@@ -74,10 +117,19 @@ func main() {
 	//flag para usar na linha de comando
 	flag.IntVar(&cfg.port, "port", 4001, "Server Port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application enviroment {development | production}")
+	flag.StringVar(&cfg.stripe.gateway, "gateway", "stripe", "Payment gateway {stripe | fake}")
+	flag.StringVar(&cfg.stripe.gatewayState, "gatewaystate", filepath.Join(os.TempDir(), "go-stripe-fake-gateway.json"), "file shared by the api and web fake gateways")
 	flag.StringVar(&cfg.db.dataSourceName, "dataSourceName", fmt.Sprintf(`%s:%s@tcp(localhost:3306)/widgets?parseTime=true&tls=false`,dbUser,dbPassword), "DSN")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "frontend url")
+	flag.StringVar(&cfg.invoiceURL, "invoiceurl", "http://localhost:5001", "internal invoice service url, used to issue invoices and credit notes")
+	flag.StringVar(&cfg.invoicePublicURL, "invoicepublicurl", "http://localhost:5000", "invoice service url used in the download links")
+	flag.DurationVar(&cfg.idempotencyTTL, "idempotencyttl", 24 * time.Hour, "how long Idempotency-Key responses are kept")
+	flag.DurationVar(&cfg.reservationTTL, "reservationttl", 30 * time.Minute, "how long stock is held for an unpaid payment intent")
+	flag.IntVar(&cfg.maxReservations, "maxreservations", 3, "unpaid stock reservations allowed per client ip")
 	flag.StringVar(&cfg.smtp.host, "smthost", "smtp.mailtrap.io", "smtp host")
 	flag.IntVar(&cfg.smtp.port, "smtport", 587, "smtp port")
+	flag.StringVar(&cfg.fixedTime, "fixedtime", "", "fixed RFC3339 time for two-factor codes, ignored in production")
+	flag.BoolVar(&cfg.rotateKeys, "rotatekeys", false, "re-encrypt stored values with the primary encryption key and exit")
 	//flag.StringVar(&cfg.smtp.username, "smtusername", "username", "smtp port")
 	//flag.StringVar(&cfg.smtp.password, "password", "password", "smtp port")
 
@@ -87,29 +139,122 @@ func main() {
 	cfg.smtp.username = os.Getenv("SMTP_USERNAME")
 	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
 	cfg.secretKey = os.Getenv("SECRET_RESET_PASSWORD")
+	cfg.encryptionKeys = os.Getenv("ENCRYPTION_KEYS")
+	cfg.signingKeys = os.Getenv("URL_SIGNING_KEYS")
+	cfg.invoiceSecret = os.Getenv("INVOICE_SERVICE_SECRET")
 
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
 
 	//logs da app
 	infolog := log.New(os.Stdout, " INFO\t", log.Ldate| log.Ltime)
 	errorLog := log.New(os.Stdout, " ERROR\t", log.Ldate| log.Ltime| log.Lshortfile)
 
+	//o microservico recusa as requisicoes sem assinatura, os jobs de invoice nunca seriam entregues
+	if cfg.invoiceSecret == "" {
+		errorLog.Fatal("INVOICE_SERVICE_SECRET must be set")
+	}
+
 	conn,err := driverDB.OpenDb(cfg.db.dataSourceName)
 	if err != nil {
 		errorLog.Fatal(err)
 	}
 	defer conn.Close()
 
+	//gateway fake nao chama o stripe, usado em desenvolvimento e testes
+	var gateway cards.PaymentGateway = cards.New(cfg.stripe.secret, cfg.stripe.key)
+	if cfg.stripe.gateway == "fake" {
+		//em producao o pagamento precisa passar pelo stripe
+		if cfg.env == "production" {
+			errorLog.Fatal("the fake gateway can not be used in production")
+		}
+		gateway, err = cards.NewFakeGatewayFile(cfg.stripe.gatewayState)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	//relogio fixo para testar o login com 2FA com um codigo conhecido
+	var clock totp.Clock = totp.SystemClock{}
+	if cfg.fixedTime != "" && cfg.env != "production" {
+		fixed, err := time.Parse(time.RFC3339, cfg.fixedTime)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		clock = totp.FixedClock{Time: fixed}
+	}
+
+	//fora de desenvolvimento cada uso tem a sua chave, nenhuma vem do SECRET_RESET_PASSWORD
+	if cfg.env != "development" && cfg.encryptionKeys == "" {
+		errorLog.Fatal("ENCRYPTION_KEYS must be set outside development")
+	}
+	if cfg.env != "development" && cfg.signingKeys == "" {
+		errorLog.Fatal("URL_SIGNING_KEYS must be set outside development")
+	}
+
+	//em desenvolvimento sem ENCRYPTION_KEYS a chave é fixa
+	var keys *encryption.KeyRing
+	if cfg.encryptionKeys != "" {
+		keys, err = encryption.ParseKeyRing(cfg.encryptionKeys)
+	} else {
+		keys, err = encryption.NewKeyRing("dev", map[string][]byte{"dev": []byte(devEncryptionKey)})
+	}
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	//os dados do formato antigo foram criptografados com o SECRET_RESET_PASSWORD, so a rotacao abre eles
+	if cfg.rotateKeys && cfg.secretKey != "" {
+		keys.SetLegacyKey([]byte(cfg.secretKey))
+	}
+
+	signingKeys := []urlsigner.Key{urlsigner.DevelopmentKey}
+	if cfg.signingKeys != "" {
+		signingKeys, err = urlsigner.ParseKeys(cfg.signingKeys)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+	signer, err := urlsigner.New(signingKeys...)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	app := &application{
 		config: cfg,
 		infolog: infolog,
 		errorLog: errorLog,
 		version: version,
 		DB: models.DbModel{DB: conn},
+		Gateway: gateway,
+		clock: clock,
+		keys: keys,
+		signer: signer,
 	}
 
-	err = app.server()
+	if cfg.rotateKeys {
+		n, err := app.DB.RotateEncryptedValues(keys.Rotate)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infolog.Printf("%d values re-encrypted with key %s", n, keys.Primary())
+		return
+	}
+
+	//SIGINT e SIGTERM param o servidor e o dispatcher de invoices
+	ctx,stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	//entrega em background as invoices que estao na fila
+	dispatcherDone := make(chan struct{})
+	go func() {
+		app.dispatchInvoices(ctx)
+		close(dispatcherDone)
+	}()
+
+	err = app.server(ctx)
+	stop()
+	<-dispatcherDone
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,18 +1,19 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/ruhancs/go-stripe/internal/cards"
-	"github.com/ruhancs/go-stripe/internal/encryption"
 	"github.com/ruhancs/go-stripe/internal/models"
 	"github.com/ruhancs/go-stripe/internal/urlsigner"
 	"github.com/ruhancs/go-stripe/internal/validator"
@@ -20,19 +21,20 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+//as tags validate sao conferidas por validator.Struct, os campos obrigatorios dependem do handler
 type stripePayload struct {
-	Currency string `json:"currency"`
-	Amount string `json:"amount"`
-	PaymentMethod string `json:"payment_method"`
-	Email string `json:"email"`
-	CardBrand string `json:"card_brand"`
-	ExpiryMonth int `json:"exp_month"`
+	Currency string `json:"currency" validate:"currency"`
+	Amount string `json:"amount" validate:"positive"`
+	PaymentMethod string `json:"payment_method" validate:"max=255"`
+	Email string `json:"email" validate:"email,max=255"`
+	CardBrand string `json:"card_brand" validate:"max=50"`
+	ExpiryMonth int `json:"exp_month" validate:"expiry=exp_year"`
 	ExpiryYear int `json:"exp_year"`
-	LastFour string `json:"last_four"`
-	Plan string `json:"plan"`
-	ProductID string `json:"product_id"`
-	FirstName string `json:"first_name"`
-	LastName string `json:"last_name"`
+	LastFour string `json:"last_four" validate:"regex=^[0-9]{4}$"`
+	Plan string `json:"plan" validate:"max=255"`
+	ProductID string `json:"product_id" validate:"positive"`
+	FirstName string `json:"first_name" validate:"min=2,max=255"`
+	LastName string `json:"last_name" validate:"max=255"`
 }
 
 type jsonresponse struct {
@@ -52,6 +54,13 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	
+	v := validator.New()
+	v.Struct(&payload, "amount", "currency")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
 	//converter o payload.amount que sera recebido como string em numero
 	amount, err := strconv.Atoi(payload.Amount)
 	if err != nil {
@@ -59,17 +68,52 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key: app.config.stripe.key,
-		Currency: payload.Currency,
-	}
-	
 	okay := true
-	
-	paymentIntent, msg, err := card.Charge(payload.Currency,amount)
-	if err != nil {
-		okay = false
+	msg := ""
+
+	//widget_id e o idioma do comprador vao no metadata para o webhook conseguir criar a order
+	metadata := map[string]string{
+		"locale": models.LocaleFromHeader(r.Header.Get("Accept-Language")),
+	}
+	reservation := ""
+	if payload.ProductID != "" {
+		metadata["widget_id"] = payload.ProductID
+
+		//reservar o estoque antes de cobrar, sem estoque a compra é recusada
+		widgetID,_ := strconv.Atoi(payload.ProductID)
+		reservation, err = app.DB.ReserveInventory([]models.OrderItem{{WidgetID: widgetID, Quantity: 1}},
+			clientIP(r), app.config.maxReservations, app.config.reservationTTL)
+		var outOfStock *models.OutOfStockError
+		if errors.As(err, &outOfStock) {
+			okay = false
+			msg = outOfStock.Error()
+		} else if errors.Is(err, models.ErrTooManyReservations) {
+			okay = false
+			msg = "Too many pending checkouts, please finish one of them or try again later"
+		} else if err != nil {
+			app.errorLog.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var paymentIntent *stripe.PaymentIntent
+	if okay {
+		paymentIntent, msg, err = app.Gateway.CreatePaymentIntent(payload.Currency,amount,metadata,idempotencyKey(r, ""))
+		if err != nil {
+			okay = false
+			if reservation != "" {
+				err = app.DB.ReleaseReservation(reservation)
+				if err != nil {
+					app.errorLog.Println(err)
+				}
+			}
+		} else if reservation != "" {
+			err = app.DB.AttachReservation(reservation, paymentIntent.ID)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
 	}
 
 	//se a paymentIntent ocorrer tudo certo convert o paymentIntent para json com identacao
@@ -119,20 +163,8 @@ func (app *application) GetWidgetById(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
-type Invoice struct {
-	ID int `json:"id"`
-	Quantity int `json:"quantity"`
-	Amount int `json:"amount"`
-	Product string `json:"product"`
-	FirstName string `json:"first_name"`
-	LastName string `json:"last_name"`
-	Email string `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
-	//Items []Products
-}
-
 func (app *application) CreateCustomerAndSubscribe(w http.ResponseWriter, r *http.Request) {
-	//dados recebidos de do formulario de bronze-plan.page
+	//dados recebidos de do formulario de plan.page
 	var data stripePayload
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
@@ -141,27 +173,28 @@ func (app *application) CreateCustomerAndSubscribe(w http.ResponseWriter, r *htt
 	}
 
 	//validate data
+	//os erros usam os nomes json, que sao os names dos inputs do formulario de plan.page
 	v := validator.New()
-	//validacao do first_name tamanho de no minimo 2 caracteres
-	//first_name deve ser exatamente o campo de id do componente na template
-	v.Check(len(data.FirstName) > 1, "first_name", "must be at least 2 character")
+	v.Struct(&data, "first_name", "last_name", "email", "payment_method", "product_id", "exp_month", "exp_year", "last_four")
 
 	if !v.Valid() {
 		app.failedValidation(w, r, v.Errors)
 		return
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key: app.config.stripe.key,
-		Currency: data.Currency,
+	//o plano e o valor vem do catalogo, nao do navegador
+	productID, _ := strconv.Atoi(data.ProductID)
+	plan, err := app.DB.GetWidget(productID)
+	if err != nil || !plan.IsRecurring {
+		app.badRequest(w, r, errors.New("plan not found"))
+		return
 	}
 
 	okay := true
 	var subscription *stripe.Subscription
 	transactionMsg := "Transaction successfull"
 
-	stripeCustomer,msg,err := card.CreateCustomer(data.PaymentMethod,data.Email)
+	stripeCustomer,msg,err := app.stripeCustomerFor(r, data.PaymentMethod, data.Email)
 	if err != nil {
 		app.errorLog.Println(err)
 		okay = false
@@ -169,30 +202,24 @@ func (app *application) CreateCustomerAndSubscribe(w http.ResponseWriter, r *htt
 	}
 	
 	if okay {
-		subscription,err = card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email,data.LastFour, "")
+		gatewayPlan := cards.Plan{ID: plan.PlanID, Interval: plan.Interval, TrialDays: plan.TrialDays}
+		subscription,err = app.Gateway.SubscribeToPlan(stripeCustomer, gatewayPlan, data.Email,data.LastFour, "", idempotencyKey(r, "subscription"))
 		if err != nil {
 			app.errorLog.Println(err)
 			okay = false
 			transactionMsg = "Error subscribing customer"
+		} else {
+			app.infolog.Println("subscription ID is: ", subscription.ID)
 		}
-	
-		app.infolog.Println("subscription ID is: ", subscription.ID)
 	}
 	
 	if okay {
 		//criar customer e transaction
-		productID, _ := strconv.Atoi(data.ProductID)
-		customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
-		
-		amount, _ := strconv.Atoi(data.Amount)
+		amount := plan.Price
 		
 		transaction := models.Transaction{
 			Amount: amount,
-			Currency: "R$",
+			Currency: "brl",
 			LastFour: data.LastFour,
 			ExpiryMonth: data.ExpiryMonth,
 			ExpiryYear: data.ExpiryYear,
@@ -201,44 +228,29 @@ func (app *application) CreateCustomerAndSubscribe(w http.ResponseWriter, r *htt
 			PaymentMethod: data.PaymentMethod,
 		}
 
-		transactionID,err := app.SaveTransaction(transaction)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
-
 		order := models.Order{
 			WidgetID: productID,
-			TransactionID: transactionID,
-			CustomerID: customerID,
 			StatusID: 1,
 			Quantity: 1,
 			Amount: amount,
+			Locale: models.LocaleFromHeader(r.Header.Get("Accept-Language")),
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
 		}
 
-		orderID,err := app.SaveOrder(order)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
-
-		//criar invoice
-		invoice := Invoice {
-			ID: orderID,
-			Amount: order.Amount,
-			Product: order.Widget.Description,
-			Quantity: order.Quantity,
+		orderID,err := app.SaveSubscriptionSale(models.Customer{
 			FirstName: data.FirstName,
 			LastName: data.LastName,
 			Email: data.Email,
-			CreatedAt: time.Now(),
+			StripeCustomerID: stripeCustomer.ID,
+		}, transaction, order, newSubscription(plan.ID, subscription))
+		if err != nil {
+			app.errorLog.Println(err)
+			return
 		}
 
-		//chamar micro de invoice
-		app.CallInvoiceMicro(invoice)
-
+		//a invoice foi para a fila junto com a order
+		app.infolog.Printf("order %d saved, invoice queued", orderID)
 	}
 
 	resp := jsonresponse{
@@ -256,43 +268,26 @@ func (app *application) CreateCustomerAndSubscribe(w http.ResponseWriter, r *htt
 	w.Write(out)
 }
 
-func(app *application) CallInvoiceMicro(invoice Invoice) error {
-	url := "http://localhost:5000/invoice/create-and-send"
-	out, err := json.MarshalIndent(invoice, "", "\t")
-	if err != nil {
-		return err
+//stripeCustomerFor reutiliza o customer do stripe ja salvo para o email, com o novo cartao
+//como padrao. Sem customer salvo, ou se ele foi apagado no stripe, cria um novo
+func (app *application) stripeCustomerFor(r *http.Request, paymentMethod, email string) (*stripe.Customer, string, error) {
+	customer, err := app.DB.GetCustomerByEmail(email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, "Error subscribing customer", err
 	}
 
-	req,err := http.NewRequest("POST", url, bytes.NewBuffer(out))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	app.infolog.Println(resp.Body)
-	return nil
-}
-
-func (app *application) SaveCustomer(firstName string, lastName string, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName: lastName,
-		Email: email,
+	if err == nil && customer.StripeCustomerID != "" {
+		msg, err := app.Gateway.AttachPaymentMethod(customer.StripeCustomerID, paymentMethod, idempotencyKey(r, "attach"))
+		if err == nil {
+			return &stripe.Customer{ID: customer.StripeCustomerID, Email: email}, "", nil
+		}
+		if !cards.IsNotFound(err) {
+			return nil, msg, err
+		}
+		app.infolog.Printf("stripe customer %s not found, creating a new one", customer.StripeCustomerID)
 	}
 
-	id,err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		app.errorLog.Println(err)
-		return 0, err
-	}
-	return id, nil
+	return app.Gateway.CreateCustomer(paymentMethod, email, idempotencyKey(r, "customer"))
 }
 
 func (app *application) SaveTransaction(t models.Transaction) (int, error) {
@@ -304,13 +299,46 @@ func (app *application) SaveTransaction(t models.Transaction) (int, error) {
 	return id, nil
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id,err := app.DB.InsertOrder(order)
+//SaveSale grava customer, transaction e order na mesma transacao do banco,
+//se uma das gravacoes falhar nenhuma fica salva
+func (app *application) SaveSale(customer models.Customer, transaction models.Transaction, order models.Order) (int, error) {
+	return app.saveSale(customer, transaction, order, nil)
+}
+
+//SaveSubscriptionSale grava a venda de um plano junto com a subscription na mesma transacao
+func (app *application) SaveSubscriptionSale(customer models.Customer, transaction models.Transaction, order models.Order, subscription models.Subscription) (int, error) {
+	return app.saveSale(customer, transaction, order, &subscription)
+}
+
+func (app *application) saveSale(customer models.Customer, transaction models.Transaction, order models.Order, subscription *models.Subscription) (int, error) {
+	var orderID int
+	err := app.DB.WithTx(context.Background(), func(tx *models.DbModel) error {
+		customerID, err := tx.SaveCustomer(customer)
+		if err != nil {
+			return err
+		}
+
+		transactionID, err := tx.InsertTransaction(transaction)
+		if err != nil {
+			return err
+		}
+
+		order.CustomerID = customerID
+		order.TransactionID = transactionID
+		orderID, err = tx.InsertOrder(order)
+		if err != nil || subscription == nil {
+			return err
+		}
+
+		subscription.OrderID = orderID
+		subscription.CustomerID = customerID
+		_, err = tx.InsertSubscription(*subscription)
+		return err
+	})
 	if err != nil {
-		app.errorLog.Println(err)
 		return 0, err
 	}
-	return id, nil
+	return orderID, nil
 }
 
 func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request) {
@@ -325,31 +353,54 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	//email ou ip esperando depois de muitas falhas
+	if !app.checkLoginAllowed(w, r, models.AuthFailure{Email: userInput.Email}) {
+		return
+	}
+
 	//checar email se existe cadastro
 	user,err := app.DB.GetUserByEmail(userInput.Email)
 	if err != nil {
-		app.invalidCredencials(w)
+		app.loginFailed(w, r, models.AuthFailure{Email: userInput.Email, Reason: models.AuthFailureUnknownEmail})
 		return
 	}
 
 	//checar se a senha esta certa
 	validPassword,err := app.passwordMatch(user.Password, userInput.Password)
-	if err != nil {
-		app.invalidCredencials(w)
+	if err != nil || !validPassword {
+		app.loginFailed(w, r, models.AuthFailure{UserID: user.ID, Email: user.Email, Reason: models.AuthFailurePassword})
 		return
 	}
 
-	if !validPassword {
-		app.invalidCredencials(w)
+	//com o 2FA ativo a senha da apenas o token do segundo passo do login
+	if user.TwoFactorEnabled {
+		app.sendTwoFactorStep(w, r, user, models.ScopeTwoFactor, "two-factor code required")
+		return
+	}
+
+	//o papel exige 2FA e o usuario ainda nao cadastrou, o token permite apenas o cadastro
+	required, err := app.DB.RoleRequiresTwoFactor(user.Role)
+	if err != nil {
+		app.badRequest(w,r,err)
 		return
 	}
+	if required {
+		app.sendTwoFactorStep(w, r, user, models.ScopeTwoFactorSetup, "two-factor authentication must be set up")
+		return
+	}
+
+	app.sendLoginToken(w, r, user, nil)
+}
 
-	//gerar token
+//sendLoginToken gera o token de login, usado no login sem 2FA e no fim do segundo passo
+func (app *application) sendLoginToken(w http.ResponseWriter, r *http.Request, user models.User, recoveryCodes []string) {
+	//gerar token, cada login tem o seu token e os outros continuam logados
 	token,err := models.GenerateToken(user.ID, 24 * time.Hour, models.ScopeAuthentication)
 	if err != nil {
 		app.badRequest(w,r,err)
 		return
 	}
+	token.Name = loginTokenName(r)
 	
 	//salvar o token no db
 	err = app.DB.InsertToken(token,user)
@@ -358,47 +409,69 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	//login completo, as falhas anteriores do email sao esquecidas
+	err = app.DB.ResetThrottle(models.AccountThrottleKey(user.Email))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	var payload struct {
 		Error bool `json:"error"`
 		Message string `json:"message"`
 		Token *models.Token `json:"authentication_token"`
+		RecoveryCodes []string `json:"recovery_codes,omitempty"` //apenas quando o 2FA foi cadastrado no login
 	}
 	payload.Error = false
-	payload.Message = fmt.Sprintf("token for %s created", userInput.Email)
+	payload.Message = fmt.Sprintf("token for %s created", user.Email)
 	payload.Token = token
+	payload.RecoveryCodes = recoveryCodes
 
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
 
-func (app *application) AuthenticateToken(r *http.Request) (*models.User, error) {
-	//pegar o token de Authorization
+//bearerToken retorna o token do header Authorization
+func bearerToken(r *http.Request) (string, error) {
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header received")
+		return "", errors.New("no authorization header received")
 	}
 	
 	headerParts := strings.Split(authorizationHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("no authorization header received")
+		return "", errors.New("no authorization header received")
 	}
 	
 	token := headerParts[1]
 	if len(token) != 26 {
-		return nil, errors.New("invalid token")
+		return "", errors.New("invalid token")
 	}
+	return token, nil
+}
 
-	//pegar o usuario da tabela de tokens
-	user,err := app.DB.GetUserForToken(token)
+//AuthenticateToken retorna o usuario do token e o scope do token, aceitando apenas os scopes informados
+func (app *application) AuthenticateToken(r *http.Request, scopes ...string) (*models.User, string, error) {
+	token, err := bearerToken(r)
 	if err != nil {
-		return nil, errors.New("no user with this token")
+		return nil, "", err
+	}
+
+	//pegar o usuario da tabela de tokens, o scope limita o que o token pode fazer
+	for _, scope := range scopes {
+		user,err := app.DB.GetUserForToken(token, scope)
+		if err == nil {
+			return user, scope, nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println("token:", err)
+			return nil, "", err
+		}
 	}
 
-	return  user, nil
+	return nil, "", errors.New("no user with this token")
 }
 
 func (app *application) CheckAthentication(w http.ResponseWriter, r *http.Request) {
 	//validar token e pegar o usuario do token
-	user,err := app.AuthenticateToken(r)
+	user,_,err := app.AuthenticateToken(r, models.Scopes...)
 	if err != nil {
 		app.invalidCredencials(w)
 		return
@@ -436,18 +509,13 @@ func (app *application) VirtualTerminalPaymentSucceded(w http.ResponseWriter, r
 		return
 	}
 	
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key: app.config.stripe.key,
-	}
-	
-	pi, err := card.GetPaymentIntent(txnData.PaymentIntent)
+	pi, err := app.Gateway.GetPaymentIntent(txnData.PaymentIntent)
 	if err != nil {
 		app.badRequest(w,r, err)
 		return
 	}
 
-	pm,err := card.GetPaymentMethod(txnData.PaymentMethod)
+	pm,err := app.Gateway.GetPaymentMethod(txnData.PaymentMethod)
 	if err != nil {
 		app.badRequest(w,r, err)
 		return
@@ -457,6 +525,13 @@ func (app *application) VirtualTerminalPaymentSucceded(w http.ResponseWriter, r
 	txnData.ExpiryMonth = int(pm.Card.ExpMonth)
 	txnData.ExpiryYear = int(pm.Card.ExpYear)
 
+	//o webhook do stripe pode ter salvo a transaction antes
+	existing, err := app.DB.GetTransactionByPaymentIntent(txnData.PaymentIntent)
+	if err == nil {
+		app.writeJSON(w, http.StatusOK, existing)
+		return
+	}
+
 	txn := models.Transaction {
 		Amount: txnData.PaymentAmount,
 		Currency: txnData.PaymentCurrency,
@@ -470,6 +545,13 @@ func (app *application) VirtualTerminalPaymentSucceded(w http.ResponseWriter, r
 	}
 
 	_, err = app.SaveTransaction(txn)
+	if errors.Is(err, models.ErrDuplicateTransaction) {
+		existing, err = app.DB.GetTransactionByPaymentIntent(txnData.PaymentIntent)
+		if err == nil {
+			app.writeJSON(w, http.StatusOK, existing)
+			return
+		}
+	}
 	if err != nil {
 		app.badRequest(w,r, err)
 		return
@@ -478,6 +560,8 @@ func (app *application) VirtualTerminalPaymentSucceded(w http.ResponseWriter, r
 	app.writeJSON(w, http.StatusOK, txn)
 }
 
+//SendPasswordResetEmail envia o link de reset de senha. A resposta é sempre a mesma e o email
+//é enviado em segundo plano, a resposta nem o tempo dela mostram se o email esta cadastrado
 func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email string `json:"email"`
@@ -489,55 +573,102 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "If this email is registered, a password reset link was sent to it"
+
 	//verificar se o email esta cadastrado
-	_, err = app.DB.GetUserByEmail(payload.Email)
+	user, err := app.DB.GetUserByEmail(payload.Email)
 	if err != nil {
-		var resp struct {
-			Error bool `json:"error"`
-			Message string `json:"message"`
-		}
-		resp.Error = true
-		resp.Message = "Email does not registered"
 		app.writeJSON(w, http.StatusAccepted, resp)
 		return
 	}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, payload.Email)
-
-	//utilzado para gerar o token de reset password
-	sign := urlsigner.Signer{
-		Secret: []byte(app.config.secretKey),
+	//token de uso unico, um novo pedido invalida os links enviados antes
+	token, err := app.DB.CreatePasswordReset(user.ID, 60 * time.Minute)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusAccepted, resp)
+		return
 	}
 
-	//url com token para resetar senha
-	signedLin := sign.GenerateTokenFromString(link)
-
 	var data struct {
 		Link string
 	}
 
-	data.Link = signedLin
+	data.Link = fmt.Sprintf("%s/reset-password?token=%s", app.config.frontend, url.QueryEscape(token))
+
+	go func() {
+		err := app.SendEmail("info@widgets.com", user.Email, "Password Reset Request", "password-reset", data)
+		if err != nil {
+			app.errorLog.Println("Error sending the password reset email:", err)
+		}
+	}()
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+//SendCustomerLoginLink envia ao customer um link assinado para entrar no portal. A busca do
+//customer e o envio rodam em background, a resposta e o tempo sao os mesmos se o email tiver ou nao compras
+func (app *application) SendCustomerLoginLink(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
 
-	err = app.SendEmail("info@widgets.com", payload.Email, "Password Reset Request", "password-reset", data)
+	err := app.readJSON(w, r, &payload)
 	if err != nil {
-		app.errorLog.Println("Error senemail")
 		app.badRequest(w, r, err)
 		return
 	}
 
+	go app.sendCustomerLoginLink(payload.Email)
+
 	var resp struct {
 		Error bool `json:"error"`
 		Message string `json:"message"`
 	}
-
 	resp.Error = false
+	resp.Message = "If we have orders for this email, a login link was sent to it"
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
 
-	app.writeJSON(w, http.StatusCreated, resp)
+//sendCustomerLoginLink manda o link se o email tiver compras, os erros ficam so no log
+func (app *application) sendCustomerLoginLink(email string) {
+	customer, err := app.DB.GetCustomerByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	link, err := app.signer.Sign(app.config.frontend + "/account/verify", urlsigner.PurposeCustomerLogin, 15 * time.Minute, map[string]string{
+		"email": customer.Email,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link = link
+
+	err = app.SendEmail("info@widgets.com", customer.Email, "Your account login link", "customer-login", data)
+	if err != nil {
+		app.errorLog.Println("Error sending the customer login link:", err)
+	}
 }
 
+//ResetPassword troca a senha pelo token do link de reset. O token é usado uma vez e
+//todas as sessoes, tokens e chaves de api do usuario sao revogados
 func (app *application) ResetPassword(w http.ResponseWriter, r * http.Request) {
 	var payload struct {
-		Email string `json:"email"`
+		Token string `json:"token"`
 		Password string `json:"password"`
 	}
 
@@ -547,18 +678,11 @@ func (app *application) ResetPassword(w http.ResponseWriter, r * http.Request) {
 		return
 	}
 
-	encripter := encryption.Encryption{
-		Key: []byte(app.config.secretKey),
-	}
-	decriptedEmail,err := encripter.Decrypt(payload.Email)
-	if err != nil {
-		app.badRequest(w, r, err)
-		return
-	}
-	
-	user,err := app.DB.GetUserByEmail(decriptedEmail)
-	if err != nil {
-		app.badRequest(w, r, err)
+	v := validator.New()
+	v.Check(payload.Token != "", "token", "must be provided")
+	v.Check(payload.Password != "", "password", "must be provided")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
 		return
 	}
 
@@ -569,10 +693,21 @@ func (app *application) ResetPassword(w http.ResponseWriter, r * http.Request) {
 		return
 	}
 
-	err = app.DB.UpdatePasswordForUser(user, string(newHash))
-	if err != nil {
+	user, err := app.DB.ResetPassword(payload.Token, string(newHash))
+	if errors.Is(err, models.ErrInvalidResetToken) {
+		app.recordAuthFailure(r, models.AuthFailureToken)
 		app.badRequest(w, r, err)
 		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("could not reset the password"))
+		return
+	}
+
+	//quem recebeu o link é dono do email, o bloqueio por falhas de login é desfeito
+	err = app.DB.UnlockAccount(user.Email)
+	if err != nil {
+		app.errorLog.Println(err)
 	}
 
 	var resp struct {
@@ -663,15 +798,21 @@ func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = app.signDownloadLinks(&order)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	app.writeJSON(w, http.StatusOK, order)
 }
 
+//RefundCharge devolve parte ou todo o valor de uma order. O valor é conferido com o que
+//ainda pode ser devolvido da transaction, e cada refund fica registrado com o admin que fez
 func(app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	var chargeToRefund struct {
-		ID int `json:"id"`
-		PaymentIntent string `json:"pi"`
-		Amount int `json:"amount"`
-		Currency string `json:"currency"`
+		ID int `json:"id" validate:"required,positive"`
+		Amount int `json:"amount" validate:"required,positive"`
+		Reason string `json:"reason" validate:"max=255"`
 	}
 
 	err := app.readJSON(w,r,&chargeToRefund)
@@ -680,36 +821,72 @@ func(app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//validar amount da order se confere com o de refund
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key: app.config.stripe.key,
-		Currency: chargeToRefund.Currency,
+	v := validator.New()
+	v.Struct(&chargeToRefund)
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
 	}
-	
-	err = card.Refunds(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
+
+	order, err := app.DB.GetOrderByID(chargeToRefund.ID)
+	if err != nil {
+		app.badRequest(w,r,errors.New("order not found"))
+		return
+	}
+
+	refundable, err := app.DB.RefundableAmount(order.TransactionID)
+	if err != nil {
+		app.badRequest(w,r,err)
+		return
+	}
+
+	v.Check(order.Subscription == nil, "amount", "subscriptions are cancelled, not refunded")
+	v.Check(chargeToRefund.Amount <= refundable, "amount", fmt.Sprintf("must be at most %d, the amount left to refund", refundable))
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	refund, err := app.Gateway.Refunds(order.Transaction.PaymentIntent, chargeToRefund.Amount, idempotencyKey(r, ""))
 	if err != nil {
 		app.badRequest(w,r,err)
 		return
 	}
 
-	//atualizar order para status de refund 2
-	err = app.DB.UpdateOrderStatus(chargeToRefund.ID, 2)
+	userID := 0
+	if user := app.authUser(r); user != nil {
+		userID = user.ID
+	}
+
+	summary, err := app.DB.RecordRefund(models.Refund{
+		TransactionID: order.TransactionID,
+		Amount: chargeToRefund.Amount,
+		Reason: chargeToRefund.Reason,
+		UserID: userID,
+		GatewayRefundID: refund.ID,
+	})
 	if err != nil{
-		app.badRequest(w,r,errors.New("charge refund but database not be updated"))
+		app.errorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, errors.New("charge refund but database not be updated"))
 		return
 	}
 
 	var res struct {
 		Error bool `json:"error"`
 		Message string `json:"message"`
+		Refund models.RefundSummary `json:"refund"`
 	}
 	res.Error = false
 	res.Message = "Charge refunded"
+	if !summary.FullyRefunded {
+		res.Message = "Charge partially refunded"
+	}
+	res.Refund = summary
 
 	app.writeJSON(w, http.StatusOK,res)
 }
 
+//CancelSubscription agenda o cancelamento no fim do periodo, id é o id da order
 func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 	var subToCancel struct {
 		ID int `json:"id"`
@@ -722,33 +899,20 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		app.badRequest(w,r,err)
 		return
 	}
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key: app.config.stripe.key,
-		Currency: subToCancel.Currency,
-	}
-
-	err = card.CancelSubscription(subToCancel.PaymentIntent)
-	if err != nil{
-		app.badRequest(w,r,err)
-		return
-	}
 
-	//atualizar order para status de refund 2
-	err = app.DB.UpdateOrderStatus(subToCancel.ID, 3)//status 3 é inscricao cancelada
-	if err != nil{
-		app.badRequest(w,r,errors.New("subscription was cancelled but database not be updated"))
+	sub, err := app.DB.GetSubscriptionByOrderID(subToCancel.ID)
+	if err != nil {
+		app.badRequest(w,r,errors.New("subscription not found"))
 		return
 	}
 
-	var res struct {
-		Error bool `json:"error"`
-		Message string `json:"message"`
-	}
-	res.Error = false
-	res.Message = "Subscription Cancelled"
-
-	app.writeJSON(w, http.StatusOK,res)
+	app.changeSubscription(w, r, sub.ID,
+		func(s *models.Subscription) error { return s.Cancel() },
+		func(stripeID string) (*stripe.Subscription, error) {
+			return nil, app.Gateway.CancelSubscription(stripeID, idempotencyKey(r, ""))
+		},
+		"Subscription Cancelled",
+	)
 }
 
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
@@ -784,6 +948,35 @@ func(app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		app.badRequest(w,r,err)
 		return
 	}
+	user.ID = userID
+
+	//na edicao o papel omitido mantem o atual, o usuario novo precisa informar o papel
+	if userID > 0 && user.Role == "" {
+		saved, err := app.DB.GetUser(userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, http.StatusNotFound, errors.New("user not found"))
+			return
+		} else if err != nil {
+			app.badRequest(w,r,err)
+			return
+		}
+		user.Role = saved.Role
+	}
+	v := validator.New()
+	//o usuario novo precisa de senha, na edicao a senha vazia mantem a atual
+	if userID > 0 {
+		v.Struct(&user)
+	} else {
+		v.Struct(&user, "password", "role")
+	}
+	//o admin nao tira o proprio acesso
+	if current := app.authUser(r); current != nil && current.ID == userID {
+		v.Check(user.Role == current.Role, "role", "you cannot change your own role")
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
 	
 	if userID > 0 {
 		err := app.DB.EditUser(user)
@@ -828,6 +1021,12 @@ func(app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 func(app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	userId,_ := strconv.Atoi(id)
+
+	if current := app.authUser(r); current != nil && current.ID == userId {
+		app.badRequest(w,r,errors.New("you cannot delete your own user"))
+		return
+	}
+
 	err := app.DB.DeleteUser(userId)
 	if err != nil {
 		app.badRequest(w,r,err)
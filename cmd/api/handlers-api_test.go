@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ruhancs/go-stripe/internal/cards"
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestGetPaymentIntentWithFakeGateway(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		decline stripe.ErrorCode
+		ok bool
+		message string
+	}{
+		{"charge", `{"currency":"usd","amount":"1000"}`, "", true, ""},
+		{"declined", `{"currency":"usd","amount":"1000"}`, stripe.ErrorCodeCardDeclined, false, "Your Card was declined"},
+		{"expired card", `{"currency":"usd","amount":"1000"}`, stripe.ErrorCodeExpiredCard, false, "Your Card is expired"},
+		{"amount too small", `{"currency":"usd","amount":"10"}`, "", false, "Amount too smal to charge to your card"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := cards.NewFakeGateway()
+			if tt.decline != "" {
+				gateway.Decline(tt.decline)
+			}
+			app := newWebhookTestApp()
+			app.Gateway = gateway
+
+			req := httptest.NewRequest(http.MethodPost, "/api/payment-intent", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			app.GetPaymentIntent(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+			}
+
+			if tt.ok {
+				var pi stripe.PaymentIntent
+				if err := json.Unmarshal(rr.Body.Bytes(), &pi); err != nil {
+					t.Fatal(err)
+				}
+				if pi.ID == "" || pi.Amount != 1000 || pi.ClientSecret == "" {
+					t.Errorf("payment intent %+v", pi)
+				}
+				return
+			}
+
+			var res jsonresponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Ok || res.Message != tt.message {
+				t.Errorf("response = %+v, want message %q", res, tt.message)
+			}
+			if len(gateway.PaymentIntents) != 0 {
+				t.Error("a failed charge created a payment intent")
+			}
+		})
+	}
+}
+
+func TestGetPaymentIntentValidation(t *testing.T) {
+	app := newWebhookTestApp()
+	app.Gateway = cards.NewFakeGateway()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payment-intent", strings.NewReader(`{"currency":"usd"}`))
+	rr := httptest.NewRecorder()
+	app.GetPaymentIntent(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
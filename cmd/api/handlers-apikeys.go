@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/validator"
+)
+
+//ListAPIKeys lista as api keys, apenas o prefix é mostrado
+func (app *application) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.DB.GetAPIKeys()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, keys)
+}
+
+//CreateAPIKey cria uma api key, a chave completa é mostrada apenas nesta resposta
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	var payload struct {
+		Name string `json:"name"`
+		Scopes []string `json:"scopes"`
+		AllowedIPs []string `json:"allowed_ips"`
+		ExpiresInDays int `json:"expires_in_days"` //0 nao expira
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.Name != "" && len(payload.Name) <= 255, "name", "must be provided and at most 255 characters")
+	v.Check(len(payload.Scopes) > 0, "scopes", "must have at least one scope")
+	for _, scope := range payload.Scopes {
+		v.Check(models.ValidAPIKeyScope(scope), "scopes", fmt.Sprintf("%s is not a valid scope", scope))
+		//a chave nao recebe uma permissao que o criador nao tem
+		v.Check(user.Can(scope), "scopes", fmt.Sprintf("you do not have the %s permission", scope))
+	}
+	allowedIPs := []string{}
+	for _, ip := range payload.AllowedIPs {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			v.Check(models.ValidAllowedIP(ip), "allowed_ips", fmt.Sprintf("%s is not an ip address or CIDR", ip))
+			allowedIPs = append(allowedIPs, ip)
+		}
+	}
+	v.Check(payload.ExpiresInDays >= 0 && payload.ExpiresInDays <= 3650, "expires_in_days", "must be between 0 and 3650 days")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var expiresAt time.Time
+	if payload.ExpiresInDays > 0 {
+		expiresAt = time.Now().AddDate(0, 0, payload.ExpiresInDays)
+	}
+
+	key, err := models.GenerateAPIKey(user.ID, payload.Name, payload.Scopes, allowedIPs, expiresAt)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.InsertAPIKey(key)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	key.UserName = user.FirstName + " " + user.LastName
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+		APIKey *models.APIKey `json:"api_key"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("api key %s created", key.Name)
+	resp.APIKey = key
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.DB.DeleteAPIKey(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, http.StatusNotFound, errors.New("api key not found"))
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "API key revoked"
+	app.writeJSON(w, http.StatusOK, resp)
+}
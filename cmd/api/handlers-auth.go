@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
+	"github.com/ruhancs/go-stripe/internal/validator"
+)
+
+//checkLoginAllowed responde 429 enquanto o email ou o ip esperam depois das falhas.
+//A tentativa bloqueada vai para a auditoria mas nao aumenta a espera
+func (app *application) checkLoginAllowed(w http.ResponseWriter, r *http.Request, f models.AuthFailure) bool {
+	err := app.DB.CheckLogin(f.Email, clientIP(r))
+	var blocked *models.LoginBlockedError
+	if errors.As(err, &blocked) {
+		f.IP = clientIP(r)
+		f.Reason = models.AuthFailureBlocked
+		if err := app.DB.InsertAuthFailure(f); err != nil {
+			app.errorLog.Println(err)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(blocked.RetryAfter()))
+		app.errorJSON(w, http.StatusTooManyRequests, blocked)
+		return false
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("could not check the login"))
+		return false
+	}
+	return true
+}
+
+//loginFailed grava a falha, aumenta a espera do email e do ip e responde credenciais invalidas.
+//Quando a falha bloqueia um usuario cadastrado ele recebe o link de desbloqueio
+func (app *application) loginFailed(w http.ResponseWriter, r *http.Request, f models.AuthFailure) {
+	f.IP = clientIP(r)
+	locked, err := app.DB.RecordLoginFailure(f)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	if locked && f.UserID > 0 {
+		go app.sendUnlockEmail(f.Email)
+	}
+	app.invalidCredencials(w)
+}
+
+//recordAuthFailure grava na auditoria as falhas que nao sao de login, como tokens invalidos
+func (app *application) recordAuthFailure(r *http.Request, reason string) {
+	err := app.DB.InsertAuthFailure(models.AuthFailure{
+		IP: clientIP(r),
+		Reason: reason,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) sendUnlockEmail(email string) {
+	link, err := app.signer.Sign(app.config.frontend + "/unlock-account", urlsigner.PurposeUnlockAccount, time.Hour, map[string]string{
+		"email": email,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	var data struct {
+		Link string
+	}
+	data.Link = link
+
+	err = app.SendEmail("info@widgets.com", email, "Your account was locked", "unlock-account", data)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//AuthFailures lista a auditoria das falhas de autenticacao
+func (app *application) AuthFailures(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PageSize int `json:"page_size"`
+		CurrentPage int `json:"page"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.PageSize > 0 && payload.PageSize <= 100, "page_size", "must be between 1 and 100")
+	v.Check(payload.CurrentPage > 0, "page", "must be greater than zero")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	failures, lastPage, totalRecords, err := app.DB.GetAuthFailuresPaginated(payload.PageSize, payload.CurrentPage)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		CurrentPage int `json:"current_page"`
+		PageSize int `json:"page_size"`
+		LastPage int `json:"last_page"`
+		TotalRecords int `json:"total_records"`
+		Failures []*models.AuthFailure `json:"failures"`
+	}
+	resp.CurrentPage = payload.CurrentPage
+	resp.PageSize = payload.PageSize
+	resp.LastPage = lastPage
+	resp.TotalRecords = totalRecords
+	resp.Failures = failures
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//BlockedAccounts lista os emails esperando ou bloqueados pelas falhas de login
+func (app *application) BlockedAccounts(w http.ResponseWriter, r *http.Request) {
+	accounts, err := app.DB.GetBlockedAccounts()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, accounts)
+}
+
+//UnlockAccount desfaz o bloqueio de um email pelo admin
+func (app *application) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.UnlockAccount(payload.Email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("%s unlocked", payload.Email)
+	app.writeJSON(w, http.StatusOK, resp)
+}
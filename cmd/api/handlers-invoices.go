@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/validator"
+)
+
+//InvoiceJobs lista a fila de invoices, filtrada pelo status
+func (app *application) InvoiceJobs(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Status string `json:"status" validate:"oneof=pending delivered dead"`
+		PageSize int `json:"page_size" validate:"required,min=1,max=100"`
+		CurrentPage int `json:"page" validate:"required,positive"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Struct(&payload)
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	jobs, lastPage, totalRecords, err := app.DB.GetInvoiceJobsPaginated(payload.Status, payload.PageSize, payload.CurrentPage)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		CurrentPage int `json:"current_page"`
+		PageSize int `json:"page_size"`
+		LastPage int `json:"last_page"`
+		TotalRecords int `json:"total_records"`
+		Jobs []*models.InvoiceJob `json:"jobs"`
+	}
+	resp.CurrentPage = payload.CurrentPage
+	resp.PageSize = payload.PageSize
+	resp.LastPage = lastPage
+	resp.TotalRecords = totalRecords
+	resp.Jobs = jobs
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//RedriveInvoiceJob volta para a fila um job que esgotou as tentativas
+func (app *application) RedriveInvoiceJob(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.DB.RedriveInvoiceJob(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.badRequest(w, r, errors.New("the job was not found or is not dead"))
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("job %d queued again", id)
+	app.writeJSON(w, http.StatusOK, resp)
+}
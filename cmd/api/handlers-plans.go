@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/validator"
+)
+
+var slugRX = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+func (app *application) AllPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.DB.GetPlans()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, plans)
+}
+
+func (app *application) OnePlan(w http.ResponseWriter, r *http.Request) {
+	planID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	plan, err := app.DB.GetWidget(planID)
+	if err != nil || !plan.IsRecurring {
+		app.badRequest(w, r, errors.New("plan not found"))
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, plan)
+}
+
+//EditPlan cria (id 0) ou atualiza um plano. O plan_id precisa existir no gateway
+//como preco recorrente com o mesmo intervalo e valor do plano
+func (app *application) EditPlan(w http.ResponseWriter, r *http.Request) {
+	planID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	var plan models.Widget
+	err := app.readJSON(w, r, &plan)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	plan.ID = planID
+
+	v := validator.New()
+	v.Check(plan.Name != "", "name", "must be provided")
+	v.Check(slugRX.MatchString(plan.Slug), "slug", "must contain only lowercase letters, numbers and dashes")
+	v.Check(plan.Price > 0, "price", "must be greater than zero")
+	v.Check(plan.TrialDays >= 0, "trial_days", "must not be negative")
+	validInterval := false
+	for _, i := range models.PlanIntervals {
+		if plan.Interval == i {
+			validInterval = true
+		}
+	}
+	v.Check(validInterval, "interval", "must be day, week, month or year")
+	v.Check(plan.PlanID != "", "plan_id", "must be provided")
+
+	if v.Valid() {
+		app.checkPlanWithGateway(v, plan)
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.DB.SavePlan(plan)
+	if errors.Is(err, models.ErrDuplicateSlug) {
+		v.AddError("slug", err.Error())
+		app.failedValidation(w, r, v.Errors)
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Plan saved"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//confere o plano com o preco cadastrado no gateway, erros vao para o campo plan_id
+func (app *application) checkPlanWithGateway(v *validator.Validator, plan models.Widget) {
+	price, err := app.Gateway.GetPrice(plan.PlanID)
+	if err != nil {
+		app.errorLog.Println(err)
+		v.AddError("plan_id", "was not found in the payment gateway")
+		return
+	}
+
+	if !price.Active {
+		v.AddError("plan_id", "is not active in the payment gateway")
+		return
+	}
+	if price.Recurring == nil {
+		v.AddError("plan_id", "is not a recurring price in the payment gateway")
+		return
+	}
+	if price.Recurring.Interval != "" && string(price.Recurring.Interval) != plan.Interval {
+		v.AddError("plan_id", fmt.Sprintf("is billed every %s in the payment gateway", price.Recurring.Interval))
+		return
+	}
+	if price.UnitAmount != 0 && price.UnitAmount != int64(plan.Price) {
+		v.AddError("plan_id", fmt.Sprintf("costs %d in the payment gateway", price.UnitAmount))
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/cards"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/stripe/stripe-go/v72"
+)
+
+//gatewayStatus converte o status da subscription do stripe para a maquina de estados
+func gatewayStatus(sub *stripe.Subscription) string {
+	var status string
+	switch sub.Status {
+	case stripe.SubscriptionStatusTrialing:
+		status = models.SubscriptionTrialing
+	case stripe.SubscriptionStatusActive:
+		status = models.SubscriptionActive
+	case stripe.SubscriptionStatusCanceled, stripe.SubscriptionStatusIncompleteExpired:
+		return models.SubscriptionEnded
+	default:
+		//past_due, unpaid e incomplete aguardam pagamento
+		status = models.SubscriptionPastDue
+	}
+
+	if sub.CancelAtPeriodEnd {
+		return models.SubscriptionCanceled
+	}
+	return status
+}
+
+//copia o periodo e a pausa da subscription do gateway, o status passa pela maquina de estados
+func syncSubscriptionPeriod(s *models.Subscription, sub *stripe.Subscription) {
+	if sub == nil {
+		return
+	}
+	if sub.CurrentPeriodStart > 0 {
+		s.CurrentPeriodStart = time.Unix(sub.CurrentPeriodStart, 0)
+	}
+	if sub.CurrentPeriodEnd > 0 {
+		s.CurrentPeriodEnd = time.Unix(sub.CurrentPeriodEnd, 0)
+	}
+	if sub.TrialEnd > 0 {
+		s.TrialEnd = time.Unix(sub.TrialEnd, 0)
+	}
+	s.Paused = sub.PauseCollection.Behavior != ""
+}
+
+//newSubscription monta a subscription local a partir da criada no gateway
+func newSubscription(planID int, sub *stripe.Subscription) models.Subscription {
+	s := models.Subscription{
+		WidgetID: planID,
+		StripeSubscriptionID: sub.ID,
+		Status: gatewayStatus(sub),
+		CurrentPeriodStart: time.Now(),
+		CurrentPeriodEnd: time.Now(),
+	}
+	syncSubscriptionPeriod(&s, sub)
+	return s
+}
+
+//changeSubscription confere a operacao no estado atual, executa no gateway e grava o novo estado.
+//A operacao é aplicada de novo com a subscription travada, duas chamadas ao mesmo tempo nao passam as duas
+func (app *application) changeSubscription(w http.ResponseWriter, r *http.Request, id int, op func(s *models.Subscription) error, call func(stripeID string) (*stripe.Subscription, error), msg string) {
+	sub, err := app.DB.GetSubscription(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, http.StatusNotFound, errors.New("subscription not found"))
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	check := sub
+	err = op(&check)
+	if err != nil {
+		app.errorJSON(w, http.StatusConflict, err)
+		return
+	}
+
+	gatewaySub, err := call(sub.StripeSubscriptionID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.errorJSON(w, http.StatusBadGateway, errors.New("the payment gateway could not update the subscription"))
+		return
+	}
+
+	updated, err := app.DB.UpdateSubscription(id, func(s *models.Subscription) error {
+		err := op(s)
+		if err != nil {
+			return err
+		}
+		syncSubscriptionPeriod(s, gatewaySub)
+		return nil
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+		//erro 5xx libera a Idempotency-Key, a nova tentativa repete a chamada idempotente no gateway e grava no banco
+		app.errorJSON(w, http.StatusInternalServerError, errors.New("subscription was updated in the payment gateway but database not be updated"))
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+		Subscription models.Subscription `json:"subscription"`
+	}
+	resp.Error = false
+	resp.Message = msg
+	resp.Subscription = updated
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) GetSubscription(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	sub, err := app.DB.GetSubscription(id)
+	if err != nil {
+		app.badRequest(w, r, errors.New("subscription not found"))
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, sub)
+}
+
+//ChangeSubscriptionPlan troca o plano, o stripe cobra ou credita a diferenca do periodo na proxima fatura
+func (app *application) ChangeSubscriptionPlan(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	var payload struct {
+		PlanID int `json:"plan_id"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	plan, err := app.DB.GetWidget(payload.PlanID)
+	if err != nil || !plan.IsRecurring {
+		app.badRequest(w, r, errors.New("plan not found"))
+		return
+	}
+
+	app.changeSubscription(w, r, id,
+		func(s *models.Subscription) error { return s.ChangePlan(plan) },
+		func(stripeID string) (*stripe.Subscription, error) {
+			gatewayPlan := cards.Plan{ID: plan.PlanID, Interval: plan.Interval}
+			return app.Gateway.ChangeSubscriptionPlan(stripeID, gatewayPlan, idempotencyKey(r, ""))
+		},
+		"Subscription changed to "+plan.Name,
+	)
+}
+
+func (app *application) PauseSubscription(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	app.changeSubscription(w, r, id,
+		func(s *models.Subscription) error { return s.Pause() },
+		func(stripeID string) (*stripe.Subscription, error) {
+			return app.Gateway.PauseSubscription(stripeID, idempotencyKey(r, ""))
+		},
+		"Subscription paused",
+	)
+}
+
+func (app *application) ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	app.changeSubscription(w, r, id,
+		func(s *models.Subscription) error { return s.Resume() },
+		func(stripeID string) (*stripe.Subscription, error) {
+			return app.Gateway.ResumeSubscription(stripeID, idempotencyKey(r, ""))
+		},
+		"Subscription resumed",
+	)
+}
+
+//ReactivateSubscription desfaz o cancelamento agendado, apenas antes do fim do periodo
+func (app *application) ReactivateSubscription(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	app.changeSubscription(w, r, id,
+		func(s *models.Subscription) error { return s.Reactivate(time.Now()) },
+		func(stripeID string) (*stripe.Subscription, error) {
+			return app.Gateway.ReactivateSubscription(stripeID, idempotencyKey(r, ""))
+		},
+		"Subscription reactivated",
+	)
+}
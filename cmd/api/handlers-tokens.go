@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/validator"
+)
+
+//nome do token de login, o navegador ajuda a reconhecer a sessao na lista de tokens
+func loginTokenName(r *http.Request) string {
+	name := "Login"
+	if ua := r.UserAgent(); ua != "" {
+		name = "Login from " + ua
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return name
+}
+
+//ListTokens lista os tokens validos do usuario logado, marcando o token do request
+func (app *application) ListTokens(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	tokens, err := app.DB.GetTokensForUser(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	current, _ := bearerToken(r)
+	currentHash := sha256.Sum256([]byte(current))
+	for _, t := range tokens {
+		t.Current = bytes.Equal(t.Hash, currentHash[:])
+	}
+
+	app.writeJSON(w, http.StatusOK, tokens)
+}
+
+//CreateToken cria um token com nome, scope e validade, o texto do token é mostrado apenas nesta resposta
+func (app *application) CreateToken(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	var payload struct {
+		Name string `json:"name"`
+		Scope string `json:"scope"`
+		TTLHours int `json:"ttl_hours"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	//um token read-only nao cria tokens com mais acesso
+	v.Check(app.tokenScope(r) == models.ScopeAuthentication, "scope", "a read-only token cannot create tokens")
+	v.Check(payload.Name != "" && len(payload.Name) <= 255, "name", "must be provided and at most 255 characters")
+	v.Check(models.ValidScope(payload.Scope), "scope", "must be authentication or read-only")
+	v.Check(payload.TTLHours > 0 && payload.TTLHours <= 24 * 365, "ttl_hours", "must be between 1 and 8760 hours")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	token, err := models.GenerateToken(user.ID, time.Duration(payload.TTLHours) * time.Hour, payload.Scope)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	token.Name = payload.Name
+
+	err = app.DB.InsertToken(token, *user)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+		Token *models.Token `json:"token"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("token %s created", token.Name)
+	resp.Token = token
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//RevokeToken revoga um dos tokens do usuario logado
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+	tokenID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.DB.DeleteTokenForUser(tokenID, user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, http.StatusNotFound, errors.New("token not found"))
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Token revoked"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//Logout revoga o token usado no request
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	token, _ := bearerToken(r)
+
+	err := app.DB.DeleteToken(token)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Logged out"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//LogoutEverywhere revoga todos os tokens do usuario, inclusive o do request, e as sessoes do site
+func (app *application) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	err := app.DB.DeleteTokensForUser(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Logged out from every device"
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/totp"
+	"github.com/ruhancs/go-stripe/internal/validator"
+)
+
+//nome mostrado no app autenticador
+const totpIssuer = "Widgets"
+
+var (
+	errInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	errTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	errTwoFactorRequired = errors.New("two-factor authentication is required for your role")
+)
+
+//sendTwoFactorStep responde o login por senha com o token do segundo passo, sem o token de login
+func (app *application) sendTwoFactorStep(w http.ResponseWriter, r *http.Request, user models.User, scope, msg string) {
+	ttl := 5 * time.Minute
+	if scope == models.ScopeTwoFactorSetup {
+		ttl = 15 * time.Minute
+	}
+
+	token, err := models.GenerateToken(user.ID, ttl, scope)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	token.Name = "Two-factor login"
+
+	err = app.DB.InsertToken(token, user)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var payload struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+		TwoFactorRequired bool `json:"two_factor_required"`
+		TwoFactorSetupRequired bool `json:"two_factor_setup_required"`
+		Token *models.Token `json:"two_factor_token"`
+	}
+	payload.Error = false
+	payload.Message = msg
+	payload.TwoFactorRequired = scope == models.ScopeTwoFactor
+	payload.TwoFactorSetupRequired = scope == models.ScopeTwoFactorSetup
+	payload.Token = token
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+//twoFactorStore é onde ficam o segredo e os codigos usados, o app.DB ou um fake nos testes
+type twoFactorStore interface {
+	GetTOTP(userID int) (models.TOTP, error)
+	UseTOTPCounter(userID int, counter int64) error
+	UseRecoveryCode(userID int, code string) error
+}
+
+//checkTOTPCode confere o codigo do app autenticador na hora do app.clock, cada codigo vale uma vez
+func (app *application) checkTOTPCode(store twoFactorStore, userID int, code string, requireEnabled bool) (int64, error) {
+	t, err := store.GetTOTP(userID)
+	if err != nil {
+		return 0, err
+	}
+	if t.Secret == "" || (requireEnabled && !t.Enabled) {
+		return 0, errTwoFactorNotEnabled
+	}
+
+	//o segredo do 2FA fica criptografado no banco com o key ring
+	secret, err := app.keys.Decrypt(t.Secret)
+	if err != nil {
+		return 0, err
+	}
+
+	counter, ok := totp.Validate(secret, code, app.clock.Now(), t.LastCounter)
+	if !ok {
+		return 0, errInvalidTwoFactorCode
+	}
+	return counter, nil
+}
+
+//verifyTwoFactor aceita o codigo do app autenticador ou um codigo de recuperacao
+func (app *application) verifyTwoFactor(store twoFactorStore, userID int, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return store.UseRecoveryCode(userID, recoveryCode)
+	}
+
+	counter, err := app.checkTOTPCode(store, userID, code, true)
+	if err != nil {
+		return err
+	}
+	return store.UseTOTPCounter(userID, counter)
+}
+
+//AuthenticateTwoFactor é o segundo passo do login, troca o token do 2FA e o codigo pelo token de login
+func (app *application) AuthenticateTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"two_factor_token"`
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.DB.GetUserForToken(payload.Token, models.ScopeTwoFactor)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println("two-factor token:", err)
+		}
+		app.recordAuthFailure(r, models.AuthFailureToken)
+		app.invalidCredencials(w)
+		return
+	}
+
+	//os codigos errados contam nas mesmas falhas da senha
+	if !app.checkLoginAllowed(w, r, models.AuthFailure{UserID: user.ID, Email: user.Email}) {
+		return
+	}
+
+	err = app.verifyTwoFactor(&app.DB, user.ID, payload.Code, payload.RecoveryCode)
+	if err != nil {
+		app.errorLog.Println("two-factor login:", user.Email, err)
+		app.loginFailed(w, r, models.AuthFailure{UserID: user.ID, Email: user.Email, Reason: models.AuthFailureTwoFactor})
+		return
+	}
+
+	//o token do segundo passo vale apenas uma vez
+	err = app.DB.DeleteToken(payload.Token)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.sendLoginToken(w, r, *user, nil)
+}
+
+//TwoFactorStatus informa se o usuario logado tem 2FA e se o papel exige
+func (app *application) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	t, err := app.DB.GetTOTP(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	required, err := app.DB.RoleRequiresTwoFactor(user.Role)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	left, err := app.DB.RecoveryCodesLeft(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Enabled bool `json:"enabled"`
+		Required bool `json:"required"`
+		RecoveryCodesLeft int `json:"recovery_codes_left"`
+	}
+	resp.Enabled = t.Enabled
+	resp.Required = required
+	resp.RecoveryCodesLeft = left
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//SetupTwoFactor cria o segredo e devolve a uri otpauth:// para o QR code. O 2FA fica ativo
+//apenas depois de ConfirmTwoFactor, chamar de novo troca o segredo ainda nao confirmado
+func (app *application) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	encrypted, err := app.keys.Encrypt(secret)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.SaveTOTPSecret(user.ID, encrypted)
+	if errors.Is(err, models.ErrTwoFactorEnabled) {
+		app.errorJSON(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Secret string `json:"secret"`
+		URI string `json:"uri"`
+	}
+	resp.Error = false
+	resp.Secret = secret
+	resp.URI = totp.ProvisioningURI(totpIssuer, user.Email, secret)
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//ConfirmTwoFactor ativa o 2FA com o primeiro codigo do app e devolve os codigos de recuperacao.
+//No cadastro exigido no login o token de cadastro é trocado pelo token de login
+func (app *application) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	counter, err := app.checkTOTPCode(&app.DB, user.ID, payload.Code, false)
+	if err != nil {
+		app.failedValidation(w, r, map[string]string{"code": err.Error()})
+		return
+	}
+
+	codes, err := models.GenerateRecoveryCodes()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.ConfirmTwoFactor(user.ID, counter, codes)
+	if errors.Is(err, models.ErrTwoFactorEnabled) {
+		app.errorJSON(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if app.tokenScope(r) == models.ScopeTwoFactorSetup {
+		token, _ := bearerToken(r)
+		err = app.DB.DeleteToken(token)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		app.sendLoginToken(w, r, *user, codes)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	resp.Error = false
+	resp.Message = "Two-factor authentication enabled"
+	resp.RecoveryCodes = codes
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//RegenerateRecoveryCodes troca os codigos de recuperacao, pede um codigo do app autenticador
+func (app *application) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.verifyTwoFactor(&app.DB, user.ID, payload.Code, "")
+	if err != nil {
+		app.failedValidation(w, r, map[string]string{"code": err.Error()})
+		return
+	}
+
+	codes, err := models.GenerateRecoveryCodes()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	err = app.DB.ReplaceRecoveryCodes(user.ID, codes)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	resp.Error = false
+	resp.Message = "New recovery codes created"
+	resp.RecoveryCodes = codes
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//DisableTwoFactor desliga o 2FA, nao é permitido quando o papel exige
+func (app *application) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.authUser(r)
+
+	var payload struct {
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	required, err := app.DB.RoleRequiresTwoFactor(user.Role)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if required {
+		app.errorJSON(w, http.StatusConflict, errTwoFactorRequired)
+		return
+	}
+
+	err = app.verifyTwoFactor(&app.DB, user.ID, payload.Code, payload.RecoveryCode)
+	if err != nil {
+		app.failedValidation(w, r, map[string]string{"code": err.Error()})
+		return
+	}
+
+	err = app.DB.DisableTwoFactor(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Two-factor authentication disabled"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+//TwoFactorRoles lista quais papeis exigem 2FA
+func (app *application) TwoFactorRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.GetTwoFactorRoles()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, roles)
+}
+
+//EditTwoFactorRole liga ou desliga a exigencia de 2FA no papel. Ao ligar, os usuarios do papel
+//sem 2FA perdem os tokens e as sessoes e cadastram o 2FA no proximo login
+func (app *application) EditTwoFactorRole(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Role string `json:"role"`
+		Required bool `json:"required"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(models.ValidRole(payload.Role), "role", "must be a valid role")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	revoked, err := app.DB.SetRoleRequiresTwoFactor(payload.Role, payload.Required)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	if payload.Required {
+		resp.Message = fmt.Sprintf("Two-factor authentication is now required for %s, %d users without it were signed out", payload.Role, revoked)
+	} else {
+		resp.Message = fmt.Sprintf("Two-factor authentication is now optional for %s", payload.Role)
+	}
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/encryption"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/totp"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+//fakeTwoFactorStore guarda o 2FA de um usuario como as colunas de users e recovery_codes
+type fakeTwoFactorStore struct {
+	totp models.TOTP
+	recoveryCodes map[string]bool
+}
+
+func (f *fakeTwoFactorStore) GetTOTP(userID int) (models.TOTP, error) {
+	return f.totp, nil
+}
+
+func (f *fakeTwoFactorStore) UseTOTPCounter(userID int, counter int64) error {
+	if counter <= f.totp.LastCounter {
+		return models.ErrTOTPCodeUsed
+	}
+	f.totp.LastCounter = counter
+	return nil
+}
+
+func (f *fakeTwoFactorStore) UseRecoveryCode(userID int, code string) error {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if !f.recoveryCodes[code] {
+		return models.ErrInvalidRecoveryCode
+	}
+	delete(f.recoveryCodes, code)
+	return nil
+}
+
+func newTwoFactorTestApp(t *testing.T, now time.Time, enabled bool) (*application, *fakeTwoFactorStore) {
+	keys, err := encryption.NewKeyRing("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := keys.Encrypt(testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := newWebhookTestApp()
+	app.keys = keys
+	app.clock = totp.FixedClock{Time: now}
+	store := &fakeTwoFactorStore{
+		totp: models.TOTP{Secret: secret, Enabled: enabled},
+		recoveryCodes: map[string]bool{"abcde12345": true},
+	}
+	return app, store
+}
+
+//o segundo passo do login com o relogio fixo, como o -fixedtime da api
+func TestVerifyTwoFactorWithFixedClock(t *testing.T) {
+	now := time.Date(2023, 9, 15, 12, 0, 0, 0, time.UTC)
+	codeAt := func(at time.Time) string {
+		code, _ := totp.CodeAt(testTOTPSecret, totp.Counter(at))
+		return code
+	}
+
+	app, store := newTwoFactorTestApp(t, now, true)
+
+	if err := app.verifyTwoFactor(store, 1, codeAt(now), ""); err != nil {
+		t.Fatalf("the current code was rejected: %v", err)
+	}
+	if store.totp.LastCounter != totp.Counter(now) {
+		t.Errorf("last counter = %d, want %d", store.totp.LastCounter, totp.Counter(now))
+	}
+
+	//o mesmo codigo nao vale duas vezes, nem o do intervalo anterior
+	if err := app.verifyTwoFactor(store, 1, codeAt(now), ""); !errors.Is(err, errInvalidTwoFactorCode) {
+		t.Errorf("replayed code: error = %v", err)
+	}
+	if err := app.verifyTwoFactor(store, 1, codeAt(now.Add(-30*time.Second)), ""); !errors.Is(err, errInvalidTwoFactorCode) {
+		t.Errorf("older code after a newer one: error = %v", err)
+	}
+	if err := app.verifyTwoFactor(store, 1, codeAt(now.Add(-2*time.Minute)), ""); !errors.Is(err, errInvalidTwoFactorCode) {
+		t.Errorf("expired code: error = %v", err)
+	}
+	if err := app.verifyTwoFactor(store, 1, codeAt(now.Add(30*time.Second)), ""); err != nil {
+		t.Errorf("the code of the next period was rejected: %v", err)
+	}
+
+	//o codigo de recuperacao vale uma vez, com ou sem traco
+	if err := app.verifyTwoFactor(store, 1, "", "ABCDE-12345"); err != nil {
+		t.Errorf("recovery code: %v", err)
+	}
+	if err := app.verifyTwoFactor(store, 1, "", "abcde12345"); !errors.Is(err, models.ErrInvalidRecoveryCode) {
+		t.Errorf("reused recovery code: error = %v", err)
+	}
+}
+
+func TestCheckTOTPCodeNotEnabled(t *testing.T) {
+	now := time.Date(2023, 9, 15, 12, 0, 0, 0, time.UTC)
+	code, _ := totp.CodeAt(testTOTPSecret, totp.Counter(now))
+
+	app, store := newTwoFactorTestApp(t, now, false)
+
+	//o login exige o 2FA ativo, a confirmacao do cadastro aceita o segredo ainda nao ativo
+	if _, err := app.checkTOTPCode(store, 1, code, true); !errors.Is(err, errTwoFactorNotEnabled) {
+		t.Errorf("login with two-factor not enabled: error = %v", err)
+	}
+	counter, err := app.checkTOTPCode(store, 1, code, false)
+	if err != nil || counter != totp.Counter(now) {
+		t.Errorf("setup confirmation = %d, %v", counter, err)
+	}
+
+	store.totp.Secret = ""
+	if _, err := app.checkTOTPCode(store, 1, code, false); !errors.Is(err, errTwoFactorNotEnabled) {
+		t.Errorf("without a secret: error = %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+//funcao que trata um tipo de evento do stripe
+type webhookHandler func(event stripe.Event) error
+
+//eventos do stripe que a api trata, os demais sao apenas registrados. Os handlers gravam em store
+func (app *application) webhookHandlers(store webhookStore) map[string]webhookHandler {
+	with := func(handler func(store webhookStore, event stripe.Event) error) webhookHandler {
+		return func(event stripe.Event) error {
+			return handler(store, event)
+		}
+	}
+
+	return map[string]webhookHandler{
+		"payment_intent.succeeded": with(app.handlePaymentIntentSucceeded),
+		"payment_intent.payment_failed": with(app.handlePaymentIntentEnded),
+		"payment_intent.canceled": with(app.handlePaymentIntentEnded),
+		"charge.refunded": with(app.handleChargeRefunded),
+		"customer.subscription.updated": with(app.handleSubscriptionUpdated),
+		"customer.subscription.deleted": with(app.handleSubscriptionDeleted),
+		"invoice.payment_failed": with(app.handleInvoicePaymentFailed),
+	}
+}
+
+//eventos do webhook gravados no banco, implementado pelo DbModel
+type webhookEventStore interface {
+	ClaimStripeEvent(e models.StripeEvent, lease time.Duration) error
+	ReleaseStripeEvent(eventID string) error
+	MarkStripeEventProcessed(eventID string) error
+}
+
+//webhookStore é onde os handlers dos eventos leem e gravam, o app.DB ou um fake nos testes
+type webhookStore interface {
+	GetTransactionByPaymentIntent(pi string) (models.Transaction, error)
+	UpdateTransactionStatus(id, statusID int) error
+	InsertTransaction(transaction models.Transaction) (int, error)
+	InsertSale(customer models.Customer, transaction models.Transaction, order models.Order) (int, error)
+	GetWidget(id int) (models.Widget, error)
+	ReleaseReservationsForPaymentIntent(paymentIntent string) error
+	RecordRefund(refund models.Refund) (models.RefundSummary, error)
+	RefundOrdersByTransactionID(transactionID int) error
+	GetSubscriptionByStripeID(stripeID string) (models.Subscription, error)
+	UpdateSubscription(id int, fn func(s *models.Subscription) error) (models.Subscription, error)
+}
+
+//tempo que uma entrega fica com o evento, se ela cair outra entrega pode processar depois
+const webhookEventLease = 2 * time.Minute
+
+//o evento depende de outro que ainda nao chegou, o erro faz o stripe reenviar mais tarde
+var errEventOutOfOrder = errors.New("the event arrived before the event it depends on")
+
+//StripeWebhook recebe os eventos do stripe, verifica a assinatura e envia para o handler do evento
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	app.receiveStripeEvent(w, r, &app.DB, app.webhookHandlers(&app.DB))
+}
+
+func (app *application) receiveStripeEvent(w http.ResponseWriter, r *http.Request, store webhookEventStore, handlers map[string]webhookHandler) {
+	maxBytes := 65536
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), app.config.stripe.webhookSecret)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("invalid stripe signature"))
+		return
+	}
+
+	err = store.ClaimStripeEvent(models.StripeEvent{
+		EventID: event.ID,
+		Type: event.Type,
+		Payload: string(payload),
+	}, webhookEventLease)
+	switch {
+	case errors.Is(err, models.ErrStripeEventProcessed):
+		//evento reenviado pelo stripe que ja foi processado
+		w.WriteHeader(http.StatusOK)
+		return
+	case errors.Is(err, models.ErrStripeEventClaimed):
+		//outra entrega do mesmo evento esta processando, o stripe tenta de novo depois
+		w.WriteHeader(http.StatusConflict)
+		return
+	case err != nil:
+		app.errorLog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if handler, ok := handlers[event.Type]; ok {
+		err = handler(event)
+		if err != nil {
+			//status diferente de 2xx faz o stripe reenviar o evento
+			app.errorLog.Printf("webhook %s (%s): %s", event.Type, event.ID, err)
+			if err := store.ReleaseStripeEvent(event.ID); err != nil {
+				app.errorLog.Println(err)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = store.MarkStripeEventProcessed(event.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+//pagamento confirmado pelo stripe, cria transaction e order se o navegador nao criou
+func (app *application) handlePaymentIntentSucceeded(store webhookStore, event stripe.Event) error {
+	var pi stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &pi)
+	if err != nil {
+		return err
+	}
+
+	txn, err := store.GetTransactionByPaymentIntent(pi.ID)
+	if err == nil {
+		//transaction ja salva pelo PaymentSucceeded, apenas garantir o status cleared
+		if txn.TarnsactionStatusID != 2 {
+			return store.UpdateTransactionStatus(txn.ID, 2)
+		}
+		return nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	transaction := models.Transaction{
+		Amount: int(pi.Amount),
+		Currency: string(pi.Currency),
+		PaymentIntent: pi.ID,
+		TarnsactionStatusID: 2,
+	}
+	if pi.PaymentMethod != nil {
+		transaction.PaymentMethod = pi.PaymentMethod.ID
+	}
+
+	var charge *stripe.Charge
+	if pi.Charges != nil && len(pi.Charges.Data) > 0 {
+		charge = pi.Charges.Data[0]
+		transaction.BankReturnCode = charge.ID
+		if charge.PaymentMethodDetails != nil && charge.PaymentMethodDetails.Card != nil {
+			transaction.LastFour = charge.PaymentMethodDetails.Card.Last4
+			transaction.ExpiryMonth = int(charge.PaymentMethodDetails.Card.ExpMonth)
+			transaction.ExpiryYear = int(charge.PaymentMethodDetails.Card.ExpYear)
+		}
+	}
+
+	//itens do carrinho ou o widget da pagina buy-once
+	items, err := models.ParseItemsMetadata(pi.Metadata["items"])
+	if err != nil {
+		return err
+	}
+	if widgetID, _ := strconv.Atoi(pi.Metadata["widget_id"]); widgetID != 0 && len(items) == 0 {
+		items = []models.OrderItem{{WidgetID: widgetID, Quantity: 1}}
+	}
+
+	//sem widget no metadata é uma cobranca do virtual terminal, nao tem order
+	if len(items) == 0 {
+		_, err = store.InsertTransaction(transaction)
+		if errors.Is(err, models.ErrDuplicateTransaction) {
+			return nil
+		}
+		return err
+	}
+
+	//preco unitario do widget, o total fica com o valor realmente cobrado
+	quantity := 0
+	for i := range items {
+		widget, err := store.GetWidget(items[i].WidgetID)
+		if err != nil {
+			return err
+		}
+		items[i].UnitPrice = widget.Price
+		items[i].Amount = widget.Price * items[i].Quantity
+		quantity += items[i].Quantity
+	}
+	if len(items) == 1 {
+		items[0].Amount = int(pi.Amount)
+	}
+
+	firstName, lastName, email := customerFromCharge(charge, pi.ReceiptEmail)
+
+	//transaction, customer e order sao gravados juntos, um erro faz o stripe reenviar o evento
+	_, err = store.InsertSale(models.Customer{
+		FirstName: firstName,
+		LastName: lastName,
+		Email: email,
+	}, transaction, models.Order{
+		WidgetID: items[0].WidgetID,
+		StatusID: 1,
+		Quantity: quantity,
+		Amount: int(pi.Amount),
+		Items: items,
+		Locale: pi.Metadata["locale"],
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	})
+	if errors.Is(err, models.ErrDuplicateTransaction) {
+		//o navegador gravou a venda enquanto o evento era processado
+		return nil
+	}
+	return err
+}
+
+//pagamento recusado ou cancelado, o estoque reservado volta a ficar livre
+func (app *application) handlePaymentIntentEnded(store webhookStore, event stripe.Event) error {
+	var pi stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &pi)
+	if err != nil {
+		return err
+	}
+
+	return store.ReleaseReservationsForPaymentIntent(pi.ID)
+}
+
+//refund feito no dashboard do stripe ou pela api
+func (app *application) handleChargeRefunded(store webhookStore, event stripe.Event) error {
+	var charge stripe.Charge
+	err := json.Unmarshal(event.Data.Raw, &charge)
+	if err != nil {
+		return err
+	}
+
+	if charge.PaymentIntent == nil {
+		return nil
+	}
+
+	txn, err := store.GetTransactionByPaymentIntent(charge.PaymentIntent.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		//cobranca da invoice de uma subscription, a transaction fica com o id da subscription
+		if charge.Invoice != nil {
+			return nil
+		}
+		//o refund chegou antes do payment_intent.succeeded
+		return errEventOutOfOrder
+	} else if err != nil {
+		return err
+	}
+
+	//refunds feitos no dashboard entram no ledger, os feitos pela api ja estao gravados
+	if charge.Refunds != nil && len(charge.Refunds.Data) > 0 {
+		for _, refund := range charge.Refunds.Data {
+			if refund.Status == stripe.RefundStatusFailed || refund.Status == stripe.RefundStatusCanceled {
+				continue
+			}
+			_, err = store.RecordRefund(models.Refund{
+				TransactionID: txn.ID,
+				Amount: int(refund.Amount),
+				Reason: string(refund.Reason),
+				GatewayRefundID: refund.ID,
+			})
+			var tooLarge *models.RefundTooLargeError
+			if errors.As(err, &tooLarge) {
+				//reenviar o evento nao corrige o ledger
+				app.errorLog.Printf("refund %s: %s", refund.ID, err)
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	//transaction status 4 refunded, 5 partially refunded
+	if charge.AmountRefunded < charge.Amount {
+		return store.UpdateTransactionStatus(txn.ID, 5)
+	}
+
+	err = store.UpdateTransactionStatus(txn.ID, 4)
+	if err != nil {
+		return err
+	}
+
+	//order status 2 refunded, os itens voltam ao estoque
+	return store.RefundOrdersByTransactionID(txn.ID)
+}
+
+//subscription alterada no stripe: renovacao, pagamento atrasado, pausa ou cancelamento agendado
+func (app *application) handleSubscriptionUpdated(store webhookStore, event stripe.Event) error {
+	var sub stripe.Subscription
+	err := json.Unmarshal(event.Data.Raw, &sub)
+	if err != nil {
+		return err
+	}
+
+	return app.syncSubscription(store, &sub)
+}
+
+//subscription encerrada no stripe
+func (app *application) handleSubscriptionDeleted(store webhookStore, event stripe.Event) error {
+	var sub stripe.Subscription
+	err := json.Unmarshal(event.Data.Raw, &sub)
+	if err != nil {
+		return err
+	}
+	sub.Status = stripe.SubscriptionStatusCanceled
+
+	return app.syncSubscription(store, &sub)
+}
+
+//syncSubscription aplica o estado do stripe na subscription local. Uma transicao fora da
+//maquina de estados é registrada e ignorada, reenviar o evento nao mudaria o resultado
+func (app *application) syncSubscription(store webhookStore, sub *stripe.Subscription) error {
+	local, err := store.GetSubscriptionByStripeID(sub.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = store.UpdateSubscription(local.ID, func(s *models.Subscription) error {
+		syncSubscriptionPeriod(s, sub)
+		err := s.SetStatus(gatewayStatus(sub))
+		var invalid *models.InvalidTransitionError
+		if errors.As(err, &invalid) {
+			app.errorLog.Printf("subscription %s: %s", sub.ID, err)
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+//cobranca recorrente da subscription falhou
+func (app *application) handleInvoicePaymentFailed(store webhookStore, event stripe.Event) error {
+	var invoice stripe.Invoice
+	err := json.Unmarshal(event.Data.Raw, &invoice)
+	if err != nil {
+		return err
+	}
+
+	if invoice.Subscription == nil {
+		return nil
+	}
+
+	txn, err := store.GetTransactionByPaymentIntent(invoice.Subscription.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	//transaction status 3 declined
+	return store.UpdateTransactionStatus(txn.ID, 3)
+}
+
+//pegar nome e email do comprador nos dados de cobranca do cartao
+func customerFromCharge(charge *stripe.Charge, receiptEmail string) (string, string, string) {
+	email := receiptEmail
+	name := ""
+
+	if charge != nil && charge.BillingDetails != nil {
+		if charge.BillingDetails.Email != "" {
+			email = charge.BillingDetails.Email
+		}
+		name = charge.BillingDetails.Name
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(name), " ", 2)
+	firstName := parts[0]
+	lastName := ""
+	if len(parts) > 1 {
+		lastName = parts[1]
+	}
+
+	return firstName, lastName, email
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+const testWebhookSecret = "whsec_test_secret"
+
+//fakeEventStore guarda os eventos em memoria com a mesma regra de reserva do banco
+type fakeEventStore struct {
+	mu sync.Mutex
+	claimedUntil map[string]time.Time
+	processed map[string]bool
+}
+
+func newFakeEventStore() *fakeEventStore {
+	return &fakeEventStore{
+		claimedUntil: map[string]time.Time{},
+		processed: map[string]bool{},
+	}
+}
+
+func (s *fakeEventStore) ClaimStripeEvent(e models.StripeEvent, lease time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processed[e.EventID] {
+		return models.ErrStripeEventProcessed
+	}
+	if until, ok := s.claimedUntil[e.EventID]; ok && until.After(time.Now()) {
+		return models.ErrStripeEventClaimed
+	}
+	s.claimedUntil[e.EventID] = time.Now().Add(lease)
+	return nil
+}
+
+func (s *fakeEventStore) ReleaseStripeEvent(eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.claimedUntil, eventID)
+	return nil
+}
+
+func (s *fakeEventStore) MarkStripeEventProcessed(eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.claimedUntil, eventID)
+	s.processed[eventID] = true
+	return nil
+}
+
+func newWebhookTestApp() *application {
+	app := &application{
+		infolog: log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+	}
+	app.config.stripe.webhookSecret = testWebhookSecret
+	return app
+}
+
+func loadWebhookFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	payload, err := os.ReadFile("testdata/webhooks/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+//signWebhook monta o header Stripe-Signature como o stripe envia
+func signWebhook(payload []byte, secret string, at time.Time) string {
+	sig := webhook.ComputeSignature(at, payload, secret)
+	return fmt.Sprintf("t=%d,v1=%s", at.Unix(), hex.EncodeToString(sig))
+}
+
+func deliverWebhook(app *application, store webhookEventStore, handlers map[string]webhookHandler, payload []byte, signature string) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", signature)
+	rr := httptest.NewRecorder()
+	app.receiveStripeEvent(rr, req, store, handlers)
+	return rr.Code
+}
+
+func TestStripeWebhookSignature(t *testing.T) {
+	app := newWebhookTestApp()
+	payload := loadWebhookFixture(t, "payment_intent_succeeded.json")
+	tampered := bytes.Replace(payload, []byte(`"amount": 1000`), []byte(`"amount": 1`), 1)
+
+	tests := []struct {
+		name string
+		payload []byte
+		signature string
+		status int
+	}{
+		{"valid", payload, signWebhook(payload, testWebhookSecret, time.Now()), http.StatusOK},
+		{"missing header", payload, "", http.StatusBadRequest},
+		{"wrong secret", payload, signWebhook(payload, "whsec_other", time.Now()), http.StatusBadRequest},
+		{"tampered payload", tampered, signWebhook(payload, testWebhookSecret, time.Now()), http.StatusBadRequest},
+		{"expired timestamp", payload, signWebhook(payload, testWebhookSecret, time.Now().Add(-time.Hour)), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeEventStore()
+			calls := 0
+			handlers := map[string]webhookHandler{
+				"payment_intent.succeeded": func(event stripe.Event) error {
+					calls++
+					return nil
+				},
+			}
+
+			status := deliverWebhook(app, store, handlers, tt.payload, tt.signature)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+
+			wantCalls := 0
+			if tt.status == http.StatusOK {
+				wantCalls = 1
+			}
+			if calls != wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, wantCalls)
+			}
+			if tt.status != http.StatusOK && len(store.claimedUntil)+len(store.processed) != 0 {
+				t.Error("an event with an invalid signature was recorded")
+			}
+		})
+	}
+}
+
+func TestStripeWebhookDuplicateDelivery(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeEventStore()
+	payload := loadWebhookFixture(t, "payment_intent_succeeded.json")
+
+	calls := 0
+	handlers := map[string]webhookHandler{
+		"payment_intent.succeeded": func(event stripe.Event) error {
+			calls++
+			var pi stripe.PaymentIntent
+			if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+				return err
+			}
+			if pi.ID != "pi_3NtESTwidget" || pi.Amount != 1000 {
+				t.Errorf("unexpected payment intent %s of %d", pi.ID, pi.Amount)
+			}
+			return nil
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		status := deliverWebhook(app, store, handlers, payload, signWebhook(payload, testWebhookSecret, time.Now()))
+		if status != http.StatusOK {
+			t.Fatalf("delivery %d: status = %d, want %d", i+1, status, http.StatusOK)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestStripeWebhookConcurrentDelivery(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeEventStore()
+	payload := loadWebhookFixture(t, "payment_intent_succeeded.json")
+
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	handlers := map[string]webhookHandler{
+		"payment_intent.succeeded": func(event stripe.Event) error {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			<-release
+			return nil
+		},
+	}
+
+	const deliveries = 8
+	statuses := make(chan int, deliveries)
+	var wg sync.WaitGroup
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- deliverWebhook(app, store, handlers, payload, signWebhook(payload, testWebhookSecret, time.Now()))
+		}()
+	}
+
+	//as entregas que nao pegaram o evento respondem antes do handler terminar
+	conflicts := 0
+	for conflicts < deliveries-1 {
+		status := <-statuses
+		if status != http.StatusConflict {
+			t.Fatalf("status = %d while the event is being processed, want %d", status, http.StatusConflict)
+		}
+		conflicts++
+	}
+	close(release)
+	wg.Wait()
+
+	if status := <-statuses; status != http.StatusOK {
+		t.Errorf("status = %d, want %d", status, http.StatusOK)
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestStripeWebhookOutOfOrder(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeEventStore()
+	succeeded := loadWebhookFixture(t, "payment_intent_succeeded.json")
+	refunded := loadWebhookFixture(t, "charge_refunded.json")
+
+	//o refund depende da transaction gravada pelo payment_intent.succeeded
+	recorded := map[string]bool{}
+	refunds := 0
+	handlers := map[string]webhookHandler{
+		"payment_intent.succeeded": func(event stripe.Event) error {
+			var pi stripe.PaymentIntent
+			if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+				return err
+			}
+			recorded[pi.ID] = true
+			return nil
+		},
+		"charge.refunded": func(event stripe.Event) error {
+			var charge stripe.Charge
+			if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+				return err
+			}
+			if !recorded[charge.PaymentIntent.ID] {
+				return errEventOutOfOrder
+			}
+			refunds++
+			return nil
+		},
+	}
+
+	deliver := func(payload []byte) int {
+		return deliverWebhook(app, store, handlers, payload, signWebhook(payload, testWebhookSecret, time.Now()))
+	}
+
+	if status := deliver(refunded); status != http.StatusInternalServerError {
+		t.Fatalf("refund before the payment: status = %d, want %d", status, http.StatusInternalServerError)
+	}
+	if store.processed["evt_1NtESTchrefunded"] {
+		t.Fatal("the refund event was marked as processed before its payment")
+	}
+
+	if status := deliver(succeeded); status != http.StatusOK {
+		t.Fatalf("payment: status = %d, want %d", status, http.StatusOK)
+	}
+
+	//reenvio do stripe depois da falha
+	if status := deliver(refunded); status != http.StatusOK {
+		t.Fatalf("refund redelivery: status = %d, want %d", status, http.StatusOK)
+	}
+	if refunds != 1 {
+		t.Errorf("refund applied %d times, want 1", refunds)
+	}
+}
+
+func TestStripeWebhookUnhandledEvent(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeEventStore()
+	payload := loadWebhookFixture(t, "charge_refunded.json")
+
+	status := deliverWebhook(app, store, map[string]webhookHandler{}, payload, signWebhook(payload, testWebhookSecret, time.Now()))
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if !store.processed["evt_1NtESTchrefunded"] {
+		t.Error("an event without handler should be recorded as processed")
+	}
+}
+
+//fakeWebhookStore guarda em memoria o que os handlers gravam, com a mesma regra do indice unico
+//de payment intent das transactions
+type fakeWebhookStore struct {
+	*fakeEventStore
+	mu sync.Mutex
+	widgets map[int]models.Widget
+	transactions []models.Transaction
+	customers []models.Customer
+	orders []models.Order
+	refunds []models.Refund
+	released []string
+	subscriptions map[string]models.Subscription
+}
+
+func newFakeWebhookStore() *fakeWebhookStore {
+	return &fakeWebhookStore{
+		fakeEventStore: newFakeEventStore(),
+		widgets: map[int]models.Widget{1: {ID: 1, Name: "Widget", Price: 1000}},
+		subscriptions: map[string]models.Subscription{},
+	}
+}
+
+func (s *fakeWebhookStore) GetTransactionByPaymentIntent(pi string) (models.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.transactions {
+		if t.PaymentIntent == pi {
+			return t, nil
+		}
+	}
+	return models.Transaction{}, sql.ErrNoRows
+}
+
+func (s *fakeWebhookStore) UpdateTransactionStatus(id, statusID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.transactions {
+		if s.transactions[i].ID == id {
+			s.transactions[i].TarnsactionStatusID = statusID
+		}
+	}
+	return nil
+}
+
+func (s *fakeWebhookStore) InsertTransaction(transaction models.Transaction) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insertTransaction(transaction)
+}
+
+func (s *fakeWebhookStore) insertTransaction(transaction models.Transaction) (int, error) {
+	for _, t := range s.transactions {
+		if transaction.PaymentIntent != "" && t.PaymentIntent == transaction.PaymentIntent {
+			return 0, models.ErrDuplicateTransaction
+		}
+	}
+	transaction.ID = len(s.transactions) + 1
+	s.transactions = append(s.transactions, transaction)
+	return transaction.ID, nil
+}
+
+func (s *fakeWebhookStore) InsertSale(customer models.Customer, transaction models.Transaction, order models.Order) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactionID, err := s.insertTransaction(transaction)
+	if err != nil {
+		return 0, err
+	}
+	customer.ID = len(s.customers) + 1
+	s.customers = append(s.customers, customer)
+
+	order.ID = len(s.orders) + 1
+	order.TransactionID = transactionID
+	order.CustomerID = customer.ID
+	s.orders = append(s.orders, order)
+	return order.ID, nil
+}
+
+func (s *fakeWebhookStore) GetWidget(id int) (models.Widget, error) {
+	widget, ok := s.widgets[id]
+	if !ok {
+		return widget, sql.ErrNoRows
+	}
+	return widget, nil
+}
+
+func (s *fakeWebhookStore) ReleaseReservationsForPaymentIntent(paymentIntent string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.released = append(s.released, paymentIntent)
+	return nil
+}
+
+func (s *fakeWebhookStore) RecordRefund(refund models.Refund) (models.RefundSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.refunds {
+		if r.GatewayRefundID == refund.GatewayRefundID {
+			return models.RefundSummary{}, nil
+		}
+	}
+	s.refunds = append(s.refunds, refund)
+	return models.RefundSummary{}, nil
+}
+
+func (s *fakeWebhookStore) RefundOrdersByTransactionID(transactionID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.orders {
+		if s.orders[i].TransactionID == transactionID {
+			s.orders[i].StatusID = 2
+		}
+	}
+	return nil
+}
+
+func (s *fakeWebhookStore) GetSubscriptionByStripeID(stripeID string) (models.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[stripeID]
+	if !ok {
+		return sub, sql.ErrNoRows
+	}
+	return sub, nil
+}
+
+func (s *fakeWebhookStore) UpdateSubscription(id int, fn func(s *models.Subscription) error) (models.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, sub := range s.subscriptions {
+		if sub.ID != id {
+			continue
+		}
+		err := fn(&sub)
+		if err != nil {
+			return sub, err
+		}
+		s.subscriptions[key] = sub
+		return sub, nil
+	}
+	return models.Subscription{}, sql.ErrNoRows
+}
+
+//deliverEvent entrega o payload assinado aos handlers reais gravando em store
+func deliverEvent(app *application, store *fakeWebhookStore, payload []byte) int {
+	return deliverWebhook(app, store, app.webhookHandlers(store), payload, signWebhook(payload, testWebhookSecret, time.Now()))
+}
+
+//redelivered troca o id do evento, o stripe manda um evento novo para o mesmo payment intent
+func redelivered(payload []byte, eventID string) []byte {
+	var event map[string]interface{}
+	json.Unmarshal(payload, &event)
+	event["id"] = eventID
+	out, _ := json.Marshal(event)
+	return out
+}
+
+func TestPaymentIntentSucceededCreatesOneOrder(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeWebhookStore()
+	payload := loadWebhookFixture(t, "payment_intent_succeeded.json")
+
+	deliveries := [][]byte{payload, payload, redelivered(payload, "evt_1NtESTpiretry")}
+	for i, p := range deliveries {
+		if status := deliverEvent(app, store, p); status != http.StatusOK {
+			t.Fatalf("delivery %d: status = %d, want %d", i+1, status, http.StatusOK)
+		}
+	}
+
+	if len(store.transactions) != 1 || len(store.orders) != 1 {
+		t.Fatalf("%d transactions and %d orders, want 1 of each", len(store.transactions), len(store.orders))
+	}
+	txn, order := store.transactions[0], store.orders[0]
+	if txn.PaymentIntent != "pi_3NtESTwidget" || txn.Amount != 1000 || txn.Currency != "usd" || txn.TarnsactionStatusID != 2 {
+		t.Errorf("transaction = %+v", txn)
+	}
+	if order.TransactionID != txn.ID || order.WidgetID != 1 || order.Amount != 1000 || order.Quantity != 1 || len(order.Items) != 1 {
+		t.Errorf("order = %+v", order)
+	}
+	if store.customers[0].Email != "jane@example.com" {
+		t.Errorf("customer = %+v", store.customers[0])
+	}
+}
+
+func TestPaymentIntentSucceededConcurrentEvents(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeWebhookStore()
+	payload := loadWebhookFixture(t, "payment_intent_succeeded.json")
+
+	//eventos diferentes do mesmo payment intent ao mesmo tempo, o indice unico decide
+	var wg sync.WaitGroup
+	statuses := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses <- deliverEvent(app, store, redelivered(payload, fmt.Sprintf("evt_concurrent_%d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("status = %d, want %d", status, http.StatusOK)
+		}
+	}
+	if len(store.transactions) != 1 || len(store.orders) != 1 {
+		t.Errorf("%d transactions and %d orders, want 1 of each", len(store.transactions), len(store.orders))
+	}
+}
+
+func TestPaymentIntentSucceededAfterBrowserSale(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeWebhookStore()
+	//o navegador gravou a venda, ainda sem o status cleared
+	store.transactions = []models.Transaction{{ID: 1, PaymentIntent: "pi_3NtESTwidget", Amount: 1000, TarnsactionStatusID: 1}}
+	store.orders = []models.Order{{ID: 1, TransactionID: 1, WidgetID: 1, Amount: 1000, StatusID: 1}}
+
+	if status := deliverEvent(app, store, loadWebhookFixture(t, "payment_intent_succeeded.json")); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if len(store.transactions) != 1 || len(store.orders) != 1 {
+		t.Errorf("%d transactions and %d orders, want the browser's sale only", len(store.transactions), len(store.orders))
+	}
+	if store.transactions[0].TarnsactionStatusID != 2 {
+		t.Errorf("transaction status = %d, want 2 cleared", store.transactions[0].TarnsactionStatusID)
+	}
+}
+
+func TestChargeRefundedHandler(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeWebhookStore()
+	refunded := loadWebhookFixture(t, "charge_refunded.json")
+
+	if status := deliverEvent(app, store, refunded); status != http.StatusInternalServerError {
+		t.Fatalf("refund before the payment: status = %d, want %d", status, http.StatusInternalServerError)
+	}
+
+	if status := deliverEvent(app, store, loadWebhookFixture(t, "payment_intent_succeeded.json")); status != http.StatusOK {
+		t.Fatalf("payment: status = %d", status)
+	}
+	for i := 0; i < 2; i++ {
+		if status := deliverEvent(app, store, refunded); status != http.StatusOK {
+			t.Fatalf("refund delivery %d: status = %d, want %d", i+1, status, http.StatusOK)
+		}
+	}
+
+	if store.transactions[0].TarnsactionStatusID != 4 {
+		t.Errorf("transaction status = %d, want 4 refunded", store.transactions[0].TarnsactionStatusID)
+	}
+	if store.orders[0].StatusID != 2 {
+		t.Errorf("order status = %d, want 2 refunded", store.orders[0].StatusID)
+	}
+}
+
+func TestInvoicePaymentFailedHandler(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeWebhookStore()
+	store.transactions = []models.Transaction{{ID: 1, PaymentIntent: "sub_1NtESTbronze", Amount: 2000, TarnsactionStatusID: 2}}
+
+	if status := deliverEvent(app, store, loadWebhookFixture(t, "invoice_payment_failed.json")); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if store.transactions[0].TarnsactionStatusID != 3 {
+		t.Errorf("transaction status = %d, want 3 declined", store.transactions[0].TarnsactionStatusID)
+	}
+}
+
+func TestSubscriptionEventHandlers(t *testing.T) {
+	app := newWebhookTestApp()
+	store := newFakeWebhookStore()
+	store.subscriptions["sub_1NtESTbronze"] = models.Subscription{ID: 7, StripeSubscriptionID: "sub_1NtESTbronze", Status: models.SubscriptionActive}
+
+	if status := deliverEvent(app, store, loadWebhookFixture(t, "customer_subscription_updated.json")); status != http.StatusOK {
+		t.Fatalf("updated: status = %d", status)
+	}
+	sub := store.subscriptions["sub_1NtESTbronze"]
+	if sub.Status != models.SubscriptionPastDue || sub.CurrentPeriodEnd.Unix() != 1697882000 {
+		t.Errorf("after updated: %+v", sub)
+	}
+
+	if status := deliverEvent(app, store, loadWebhookFixture(t, "customer_subscription_deleted.json")); status != http.StatusOK {
+		t.Fatalf("deleted: status = %d", status)
+	}
+	if sub := store.subscriptions["sub_1NtESTbronze"]; sub.Status != models.SubscriptionEnded {
+		t.Errorf("after deleted: status = %s, want %s", sub.Status, models.SubscriptionEnded)
+	}
+
+	//uma transicao fora da maquina de estados é ignorada sem reenvio
+	if status := deliverEvent(app, store, redelivered(loadWebhookFixture(t, "customer_subscription_updated.json"), "evt_late_update")); status != http.StatusOK {
+		t.Fatalf("late update: status = %d", status)
+	}
+	if sub := store.subscriptions["sub_1NtESTbronze"]; sub.Status != models.SubscriptionEnded {
+		t.Errorf("an ended subscription went back to %s", sub.Status)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
@@ -70,6 +72,35 @@ func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err e
 	return nil
 }
 
+// errorJSON sends a JSON response with the given status, describing the error
+func (app *application) errorJSON(w http.ResponseWriter, status int, err error) error {
+	var payload struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = err.Error()
+
+	return app.writeJSON(w, status, payload)
+}
+
+// idempotencyKey returns the key to forward to the payment gateway for the request Idempotency-Key.
+// Gateway keys are shared by the whole account, so the key is derived from the caller, the path and
+// the client key. The suffix tells apart different gateway calls made by the same request
+func idempotencyKey(r *http.Request, suffix string) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(idempotencyCaller(r) + "\n" + r.URL.Path + "\n" + key))
+	gatewayKey := hex.EncodeToString(hash[:])
+	if suffix == "" {
+		return gatewayKey
+	}
+	return gatewayKey + "-" + suffix
+}
+
 func (app *application) invalidCredencials(w http.ResponseWriter) error {
 	var payload struct {
 		Error bool `json:"error"`
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
+)
+
+//validade dos links de download das invoices mostrados no admin
+const invoiceDownloadTTL = 15 * time.Minute
+
+//intervalo entre as buscas de jobs de invoice, jobs por busca e tempo de cada entrega.
+//O lease, tempo que os jobs ficam com este dispatcher, cobre o lote inteiro entregue um a um,
+//outro dispatcher so pega um job do lote se este parar no meio
+const (
+	invoicePollInterval = 5 * time.Second
+	invoiceBatchSize = 10
+	invoiceRequestTimeout = 30 * time.Second
+	invoiceJobLease = invoiceBatchSize * invoiceRequestTimeout + time.Minute
+)
+
+//dispatchInvoices entrega os jobs de invoice, gravados junto com as orders, e de nota de credito,
+//gravados junto com os refunds, ao microservico.
+//Roda em background ate ctx ser cancelado, a entrega em andamento termina antes de parar e os
+//jobs restantes do lote voltam para a fila quando o lease vence
+func (app *application) dispatchInvoices(ctx context.Context) {
+	ticker := time.NewTicker(invoicePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		jobs, err := app.DB.ClaimInvoiceJobs(invoiceBatchSize, invoiceJobLease)
+		if err != nil {
+			app.errorLog.Println("claim invoice jobs:", err)
+			continue
+		}
+
+		for _, job := range jobs {
+			if ctx.Err() != nil {
+				return
+			}
+
+			var err error
+			if job.RefundID > 0 {
+				err = app.deliverCreditNote(job.RefundID)
+			} else {
+				err = app.deliverInvoice(job.OrderID)
+			}
+			if err == nil {
+				if err := app.DB.MarkInvoiceJobDelivered(job.ID); err != nil {
+					app.errorLog.Println(err)
+				}
+				continue
+			}
+
+			dead, markErr := app.DB.MarkInvoiceJobFailed(job, err)
+			if markErr != nil {
+				app.errorLog.Println(markErr)
+			}
+			document := "invoice"
+			if job.RefundID > 0 {
+				document = fmt.Sprintf("credit note of refund %d", job.RefundID)
+			}
+			if dead {
+				app.errorLog.Printf("%s for order %d is dead after %d attempts: %s", document, job.OrderID, models.InvoiceJobMaxAttempts, err)
+			} else {
+				app.errorLog.Printf("%s for order %d failed, retrying: %s", document, job.OrderID, err)
+			}
+		}
+	}
+}
+
+//payload das rotas de emissao, o microservico carrega a order ou o refund do banco pelo id
+type invoiceRequest struct {
+	ID int `json:"id"`
+}
+
+//deliverInvoice pede a invoice da order e confere a resposta, o microservico ignora
+//as entregas repetidas da mesma order
+func (app *application) deliverInvoice(orderID int) error {
+	return app.postToInvoiceService("/invoice/create-and-send", invoiceRequest{ID: orderID})
+}
+
+//deliverCreditNote pede a nota de credito do refund. O microservico recusa enquanto a invoice
+//da order nao foi emitida, o job tenta de novo depois
+func (app *application) deliverCreditNote(refundID int) error {
+	return app.postToInvoiceService("/credit-note/create-and-send", invoiceRequest{ID: refundID})
+}
+
+//postToInvoiceService envia o payload ao microservico, resposta fora de 2xx é erro
+func (app *application) postToInvoiceService(path string, payload interface{}) error {
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", app.config.invoiceURL + path, bytes.NewBuffer(out))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	urlsigner.SignRequest(req, out, []byte(app.config.invoiceSecret), time.Now())
+
+	client := &http.Client{Timeout: invoiceRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var payload struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &payload) == nil && payload.Message != "" {
+			return fmt.Errorf("invoice service returned %d: %s", resp.StatusCode, payload.Message)
+		}
+		return fmt.Errorf("invoice service returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+//signDownloadLinks preenche os links assinados dos pdfs ja gerados da order
+func (app *application) signDownloadLinks(order *models.Order) error {
+	if order.Invoice != nil && order.Invoice.StorageLocation != "" {
+		link, err := app.signer.Sign(fmt.Sprintf("%s/invoice/%d", app.config.invoicePublicURL, order.Invoice.ID),
+			urlsigner.PurposeInvoiceDownload, invoiceDownloadTTL, nil)
+		if err != nil {
+			return err
+		}
+		order.Invoice.DownloadURL = link
+	}
+
+	for i, note := range order.CreditNotes {
+		if note.StorageLocation == "" {
+			continue
+		}
+		link, err := app.signer.Sign(fmt.Sprintf("%s/credit-note/%d", app.config.invoicePublicURL, note.ID),
+			urlsigner.PurposeInvoiceDownload, invoiceDownloadTTL, nil)
+		if err != nil {
+			return err
+		}
+		order.CreditNotes[i].DownloadURL = link
+	}
+	return nil
+}
@@ -1,14 +1,241 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
 
+	"github.com/ruhancs/go-stripe/internal/models"
+)
+
+type contextKey string
+
+//usuario e scope do token ou api key autenticados pelo middleware Auth
+const (
+	userContextKey = contextKey("user")
+	scopeContextKey = contextKey("scope")
+	apiKeyContextKey = contextKey("apiKey")
+)
+
+var (
+	errIdempotencyKeyTooLong = errors.New("Idempotency-Key must have at most 255 characters")
+	errIdempotencyKeyReused = errors.New("Idempotency-Key already used with a different request body")
+	errIdempotencyKeyInProgress = errors.New("a request with this Idempotency-Key is still being processed")
+)
+
+//Auth aceita o token de login ou uma api key no header Authorization: Bearer
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_,err := app.AuthenticateToken(r)
+		if key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(key, models.APIKeyPrefix) {
+			apiKey,user,err := app.DB.AuthenticateAPIKey(key, clientIP(r))
+			if err != nil {
+				app.errorLog.Println("api key:", err)
+				app.recordAuthFailure(r, models.AuthFailureAPIKey)
+				app.invalidCredencials(w)
+				return
+			}
+			ctx := context.WithValue(r.Context(), userContextKey, user)
+			ctx = context.WithValue(ctx, apiKeyContextKey, apiKey)
+			next.ServeHTTP(w,r.WithContext(ctx))
+			return
+		}
+
+		//o token do cadastro do 2FA passa aqui, mas nao tem permissao em nenhuma rota alem do cadastro
+		user,scope,err := app.AuthenticateToken(r, models.ScopeAuthentication, models.ScopeReadOnly, models.ScopeTwoFactorSetup)
 		if err != nil {
+			app.recordAuthFailure(r, models.AuthFailureToken)
 			app.invalidCredencials(w)
 			return
 		}
-		next.ServeHTTP(w,r)
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, scopeContextKey, scope)
+		next.ServeHTTP(w,r.WithContext(ctx))
 	})
-}
\ No newline at end of file
+}
+
+//RequirePermission protege a rota pela permissao do papel do usuario, deve vir depois de Auth
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.authUser(r)
+			if user == nil || !user.Can(permission) {
+				app.errorJSON(w, http.StatusForbidden, fmt.Errorf("you do not have the %s permission", permission))
+				return
+			}
+			//a api key tem apenas os scopes escolhidos na criacao, alem do papel de quem criou
+			if apiKey := app.authAPIKey(r); apiKey != nil {
+				if !apiKey.Allows(permission) {
+					app.errorJSON(w, http.StatusForbidden, fmt.Errorf("api key %s does not have the %s scope", apiKey.Prefix, permission))
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			scope := app.tokenScope(r)
+			if !models.ScopeAllows(scope, permission) {
+				app.errorJSON(w, http.StatusForbidden, fmt.Errorf("a %s token cannot use the %s permission", scope, permission))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//authUser retorna o usuario colocado no contexto pelo middleware Auth
+func (app *application) authUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value(userContextKey).(*models.User)
+	return user
+}
+
+func (app *application) tokenScope(r *http.Request) string {
+	scope, _ := r.Context().Value(scopeContextKey).(string)
+	return scope
+}
+
+//authAPIKey retorna a api key do request, nil quando o request usa o token de login
+func (app *application) authAPIKey(r *http.Request) *models.APIKey {
+	apiKey, _ := r.Context().Value(apiKeyContextKey).(*models.APIKey)
+	return apiKey
+}
+
+//RequireScope aceita apenas tokens de login com um dos scopes, api keys sao recusadas.
+//Protege as rotas que gerenciam tokens, api keys e o 2FA, deve vir depois de Auth
+func (app *application) RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if app.authAPIKey(r) != nil {
+				app.errorJSON(w, http.StatusForbidden, errors.New("api keys cannot manage logins or api keys"))
+				return
+			}
+			scope := app.tokenScope(r)
+			for _, s := range scopes {
+				if s == scope {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			app.errorJSON(w, http.StatusForbidden, fmt.Errorf("a %s token cannot use this route", scope))
+		})
+	}
+}
+
+//clientIP é o endereco da conexao, usado na allowlist das api keys e no limite de reservas
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//guarda o status e o body da resposta para salvar junto com a Idempotency-Key
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+//Idempotent salva a resposta das requests com o header Idempotency-Key
+//e repete a resposta salva quando o cliente reenvia a mesma key
+func (app *application) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w,r)
+			return
+		}
+
+		if len(key) > 255 {
+			app.badRequest(w, r, errIdempotencyKeyTooLong)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(hash[:])
+
+		caller := idempotencyCaller(r)
+		rec, reserved, err := app.DB.ReserveIdempotencyKey(caller, key, r.URL.Path, requestHash, app.config.idempotencyTTL)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+
+		if !reserved {
+			switch {
+			case rec.RequestHash != requestHash:
+				app.errorJSON(w, http.StatusUnprocessableEntity, errIdempotencyKeyReused)
+			case !rec.Completed():
+				app.errorJSON(w, http.StatusConflict, errIdempotencyKeyInProgress)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.StatusCode)
+				w.Write([]byte(rec.ResponseBody))
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		//so a resposta final fica salva, com erro no servidor o cliente pode tentar de novo com a mesma key
+		if finalResponse(recorder.status) {
+			err = app.DB.SaveIdempotentResponse(caller, key, r.URL.Path, recorder.status, recorder.body.Bytes())
+		} else {
+			err = app.DB.ReleaseIdempotencyKey(caller, key, r.URL.Path)
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+}
+
+//idempotencyCaller identifica quem enviou a Idempotency-Key: a api key, o usuario do token ou,
+//nas rotas publicas, o ip. A mesma key de outro caller nunca repete a resposta salva
+func idempotencyCaller(r *http.Request) string {
+	if apiKey, ok := r.Context().Value(apiKeyContextKey).(*models.APIKey); ok && apiKey != nil {
+		return fmt.Sprintf("api-key:%d", apiKey.ID)
+	}
+	if user, ok := r.Context().Value(userContextKey).(*models.User); ok && user != nil {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	return "ip:" + clientIP(r)
+}
+
+//finalResponse diz se a resposta pode ser repetida para a mesma key. Respostas 2xx e erros do
+//cliente que nao mudam numa nova tentativa ficam salvos, os demais liberam a key
+func finalResponse(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= http.StatusOK && status < http.StatusInternalServerError
+}
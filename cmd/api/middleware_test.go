@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+)
+
+func idempotentRequest(path, key, remoteAddr string, ctxValues map[contextKey]interface{}) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, nil)
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("Idempotency-Key", key)
+	ctx := r.Context()
+	for k, v := range ctxValues {
+		ctx = context.WithValue(ctx, k, v)
+	}
+	return r.WithContext(ctx)
+}
+
+func TestIdempotencyCaller(t *testing.T) {
+	user := &models.User{ID: 7}
+	apiKey := &models.APIKey{ID: 3}
+
+	tests := []struct {
+		name string
+		values map[contextKey]interface{}
+		want string
+	}{
+		{"public route", nil, "ip:203.0.113.9"},
+		{"login token", map[contextKey]interface{}{userContextKey: user}, "user:7"},
+		{"api key", map[contextKey]interface{}{userContextKey: user, apiKeyContextKey: apiKey}, "api-key:3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := idempotentRequest("/api/payment-intent", "k1", "203.0.113.9:51000", tt.values)
+			if got := idempotencyCaller(r); got != tt.want {
+				t.Errorf("idempotencyCaller() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyForGateway(t *testing.T) {
+	userA := map[contextKey]interface{}{userContextKey: &models.User{ID: 1}}
+	userB := map[contextKey]interface{}{userContextKey: &models.User{ID: 2}}
+
+	key := idempotencyKey(idempotentRequest("/api/admin/refund", "same-key", "10.0.0.1:1", userA), "")
+	if key == "same-key" || key == "" {
+		t.Fatalf("the client key was forwarded to the gateway as %q", key)
+	}
+	if again := idempotencyKey(idempotentRequest("/api/admin/refund", "same-key", "10.0.0.2:1", userA), ""); again != key {
+		t.Error("the same caller, path and key must give the same gateway key")
+	}
+	if other := idempotencyKey(idempotentRequest("/api/admin/refund", "same-key", "10.0.0.1:1", userB), ""); other == key {
+		t.Error("two users with the same key must not share the gateway key")
+	}
+	if other := idempotencyKey(idempotentRequest("/api/admin/cancel-subscription", "same-key", "10.0.0.1:1", userA), ""); other == key {
+		t.Error("two routes with the same key must not share the gateway key")
+	}
+	if suffixed := idempotencyKey(idempotentRequest("/api/admin/refund", "same-key", "10.0.0.1:1", userA), "customer"); suffixed != key+"-customer" {
+		t.Errorf("suffixed key = %q", suffixed)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/payment-intent", nil)
+	if got := idempotencyKey(r, "customer"); got != "" {
+		t.Errorf("request without Idempotency-Key gave gateway key %q", got)
+	}
+}
+
+func TestFinalResponse(t *testing.T) {
+	tests := []struct {
+		status int
+		want bool
+	}{
+		{0, false},
+		{http.StatusOK, true},
+		{http.StatusCreated, true},
+		{http.StatusBadRequest, true},
+		{http.StatusUnprocessableEntity, true},
+		{http.StatusConflict, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusBadGateway, false},
+	}
+
+	for _, tt := range tests {
+		if got := finalResponse(tt.status); got != tt.want {
+			t.Errorf("finalResponse(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
+	"github.com/ruhancs/go-stripe/internal/models"
 )
 
 func (app *application) routes() http.Handler {
@@ -14,40 +15,89 @@ func (app *application) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins: []string{"https://*", "http://*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
 		AllowCredentials: false,
 		MaxAge: 300,// 5 minutos
 	}))
 
-	mux.Post("/api/payment-intent", app.GetPaymentIntent)
+	//requests que cobram o cliente aceitam Idempotency-Key
+	mux.With(app.Idempotent).Post("/api/payment-intent", app.GetPaymentIntent)
 
 	mux.Get("/api/widget/{id}", app.GetWidgetById)
 
-	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribe)
+	mux.With(app.Idempotent).Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribe)
 
 	mux.Post("/api/authenticate", app.CreateAuthToken)
+	mux.Post("/api/authenticate/two-factor", app.AuthenticateTwoFactor)
 
 	mux.Post("/api/is-authenticated", app.CheckAthentication)
 
 	mux.Post("/api/forgot-password",app.SendPasswordResetEmail)
 	mux.Post("/api/reset-password",app.ResetPassword)
 
+	//link de acesso ao portal do customer
+	mux.Post("/api/customer/login-link", app.SendCustomerLoginLink)
+
+	//eventos enviados pelo stripe, autenticados pela assinatura
+	mux.Post("/api/webhooks/stripe", app.StripeWebhook)
+
 	//adicionar middleware de protecao de rotas
 	mux.Route("/api/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)//middleware para verificar auth
 		
-		mux.Post("/virtual-terminal-succeded",app.VirtualTerminalPaymentSucceded)
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/all-subscriptions", app.AllSubscriptions)
-		mux.Post("/get-sale/{id}", app.GetSale)
-		//mux.Post("/get-subscription/{id}", app.GetSale)
-		mux.Post("/refund",app.RefundCharge)
-		mux.Post("/cancel-subscription",app.CancelSubscription)
-
-		mux.Post("/all-users",app.AllUsers)
-		mux.Post("/all-users/{id}",app.OneUser)
-		mux.Post("/all-users/edit/{id}",app.EditUser)
-		mux.Post("/all-users/delete/{id}",app.DeleteUser)
+		//tokens do proprio usuario, nao dependem do papel
+		session := app.RequireScope(models.ScopeAuthentication, models.ScopeReadOnly)
+		mux.With(session).Post("/tokens", app.ListTokens)
+		mux.With(session).Post("/tokens/create", app.CreateToken)
+		mux.With(session).Post("/tokens/revoke/{id}", app.RevokeToken)
+		mux.With(app.RequireScope(models.ScopeAuthentication, models.ScopeReadOnly, models.ScopeTwoFactorSetup)).Post("/logout", app.Logout)
+		mux.With(session).Post("/logout-everywhere", app.LogoutEverywhere)
+
+		//2FA do proprio usuario, o cadastro aceita o token dado no login quando o papel exige 2FA
+		enrol := app.RequireScope(models.ScopeAuthentication, models.ScopeTwoFactorSetup)
+		mux.With(enrol).Post("/two-factor", app.TwoFactorStatus)
+		mux.With(enrol).Post("/two-factor/setup", app.SetupTwoFactor)
+		mux.With(enrol).Post("/two-factor/confirm", app.ConfirmTwoFactor)
+		mux.With(app.RequireScope(models.ScopeAuthentication)).Post("/two-factor/recovery-codes", app.RegenerateRecoveryCodes)
+		mux.With(app.RequireScope(models.ScopeAuthentication)).Post("/two-factor/disable", app.DisableTwoFactor)
+
+		//api keys das integracoes entre servidores
+		apiKeys := app.RequirePermission(models.PermAPIKeysManage)
+		mux.With(session, apiKeys).Post("/api-keys", app.ListAPIKeys)
+		mux.With(session, apiKeys).Post("/api-keys/create", app.CreateAPIKey)
+		mux.With(session, apiKeys).Post("/api-keys/revoke/{id}", app.RevokeAPIKey)
+
+		sales := app.RequirePermission(models.PermSalesRead)
+		refunds := app.RequirePermission(models.PermRefundCreate)
+		subscriptions := app.RequirePermission(models.PermSubscriptionsManage)
+
+		mux.With(app.RequirePermission(models.PermTerminalCharge), app.Idempotent).Post("/virtual-terminal-succeded",app.VirtualTerminalPaymentSucceded)
+		mux.With(sales).Post("/all-sales", app.AllSales)
+		mux.With(sales).Post("/all-subscriptions", app.AllSubscriptions)
+		mux.With(sales).Post("/get-sale/{id}", app.GetSale)
+		mux.With(refunds, app.Idempotent).Post("/refund",app.RefundCharge)
+		mux.With(subscriptions, app.Idempotent).Post("/cancel-subscription",app.CancelSubscription)
+		mux.With(sales).Post("/subscriptions/{id}", app.GetSubscription)
+		mux.With(subscriptions, app.Idempotent).Post("/subscriptions/{id}/change-plan", app.ChangeSubscriptionPlan)
+		mux.With(subscriptions, app.Idempotent).Post("/subscriptions/{id}/pause", app.PauseSubscription)
+		mux.With(subscriptions, app.Idempotent).Post("/subscriptions/{id}/resume", app.ResumeSubscription)
+		mux.With(subscriptions, app.Idempotent).Post("/subscriptions/{id}/reactivate", app.ReactivateSubscription)
+		mux.With(sales).Post("/invoice-jobs", app.InvoiceJobs)
+		mux.With(app.RequirePermission(models.PermInvoicesManage)).Post("/invoice-jobs/redrive/{id}", app.RedriveInvoiceJob)
+
+		mux.With(app.RequirePermission(models.PermUsersRead)).Post("/all-users",app.AllUsers)
+		mux.With(app.RequirePermission(models.PermUsersRead)).Post("/all-users/{id}",app.OneUser)
+		mux.With(app.RequirePermission(models.PermUsersWrite)).Post("/all-users/edit/{id}",app.EditUser)
+		mux.With(app.RequirePermission(models.PermUsersDelete)).Post("/all-users/delete/{id}",app.DeleteUser)
+		mux.With(app.RequirePermission(models.PermUsersRead)).Post("/auth-failures", app.AuthFailures)
+		mux.With(app.RequirePermission(models.PermUsersRead)).Post("/blocked-accounts", app.BlockedAccounts)
+		mux.With(app.RequirePermission(models.PermUsersWrite)).Post("/unlock-account", app.UnlockAccount)
+		mux.With(app.RequirePermission(models.PermUsersRead)).Post("/two-factor/roles", app.TwoFactorRoles)
+		mux.With(app.RequirePermission(models.PermUsersWrite)).Post("/two-factor/roles/edit", app.EditTwoFactorRole)
+
+		mux.With(app.RequirePermission(models.PermPlansRead)).Post("/all-plans", app.AllPlans)
+		mux.With(app.RequirePermission(models.PermPlansRead)).Post("/all-plans/{id}", app.OnePlan)
+		mux.With(app.RequirePermission(models.PermPlansWrite)).Post("/all-plans/edit/{id}", app.EditPlan)
 
 	})
 
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+	driverDB "github.com/ruhancs/go-stripe/internal/driver"
+	"github.com/ruhancs/go-stripe/internal/models"
+)
+
+//ferramenta para rodar uma vez: junta os customers duplicados pelo email e move as orders e subscriptions
+//para o customer mais antigo. go run ./cmd/merge-customers -dry-run para conferir antes.
+//A migration merge_duplicate_customers faz a mesma juncao antes do indice unico do email, esta
+//ferramenta serve para conferir com -dry-run o que ela vai juntar
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		fmt.Println("Error loading .env")
+	}
+
+	dbPassword := os.Getenv("DB_PASSWORD")
+	dbUser := os.Getenv("DB_USER")
+
+	var dsn string
+	var dryRun bool
+	flag.StringVar(&dsn, "dataSourceName", fmt.Sprintf(`%s:%s@tcp(localhost:3306)/widgets?parseTime=true&tls=false`,dbUser,dbPassword), "DSN")
+	flag.BoolVar(&dryRun, "dry-run", false, "only list the customers that would be merged")
+	flag.Parse()
+
+	infolog := log.New(os.Stdout, " INFO\t", log.Ldate| log.Ltime)
+	errorLog := log.New(os.Stdout, " ERROR\t", log.Ldate| log.Ltime| log.Lshortfile)
+
+	conn,err := driverDB.OpenDb(dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer conn.Close()
+
+	db := models.DbModel{DB: conn}
+
+	merges, err := db.MergeDuplicateCustomers(dryRun)
+	for _, m := range merges {
+		infolog.Printf("%s: keeping customer %d, merging %v", m.Email, m.KeptID, m.MergedIDs)
+	}
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	if dryRun {
+		infolog.Printf("dry run, %d emails with duplicated customers", len(merges))
+		return
+	}
+	infolog.Printf("merged duplicated customers of %d emails", len(merges))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+)
+
+//locks por refund, como os locks por order das invoices
+var refundLocks sync.Map
+
+//CreateAndSendCreditNote emite a nota de credito do refund contra a invoice da order, gera o pdf
+//e envia ao cliente. O refund e a order sao carregados do banco pelo id do refund recebido.
+//Enquanto a invoice da order nao foi emitida responde erro e a api tenta de novo
+func (app *application) CreateAndSendCreditNote(w http.ResponseWriter, r *http.Request) {
+	var payload issueRequest
+
+	err := app.readJSON(w,r, &payload)
+	if err != nil {
+		app.badRequest(w,r,err)
+		return
+	}
+	if payload.ID <= 0 {
+		app.badRequest(w, r, errors.New("the refund id must be provided"))
+		return
+	}
+
+	lock, _ := refundLocks.LoadOrStore(payload.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	var resp struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+
+	refund, err := app.DB.GetRefund(payload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, http.StatusNotFound, fmt.Errorf("refund %d not found", payload.ID))
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, errors.New("the refund could not be loaded"))
+		return
+	}
+	if refund.Amount <= 0 {
+		app.badRequest(w, r, fmt.Errorf("refund %d has no amount to credit", refund.ID))
+		return
+	}
+
+	order, err := app.DB.GetOrderByTransactionID(refund.TransactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, http.StatusNotFound, fmt.Errorf("the order of refund %d was not found", refund.ID))
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, errors.New("the order could not be loaded"))
+		return
+	}
+
+	invoice, err := app.DB.GetInvoiceForOrder(order.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.badRequest(w, r, fmt.Errorf("the invoice of order %d was not issued yet", order.ID))
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the invoice could not be loaded"))
+		return
+	}
+
+	note, err := app.DB.IssueCreditNote(models.CreditNote{
+		InvoiceID: invoice.ID,
+		RefundID: refund.ID,
+		Currency: invoice.Currency,
+		Amount: refund.Amount,
+		Reason: refund.Reason,
+	})
+	var tooLarge *models.CreditTooLargeError
+	if errors.As(err, &tooLarge) || errors.Is(err, models.ErrInvoiceStatus) {
+		app.badRequest(w, r, err)
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the credit note could not be issued"))
+		return
+	}
+
+	if !note.SentAt.IsZero() {
+		resp.Error = false
+		resp.Message = fmt.Sprintf("Credit note %s was already sent", note.Number)
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	//a nota usa o mesmo layout da invoice, com uma linha do valor devolvido
+	description := fmt.Sprintf("Refund of invoice %s", invoice.Number)
+	if refund.Reason != "" {
+		description += ": " + refund.Reason
+	}
+	document := Order{
+		ID: order.ID,
+		FirstName: order.Customer.FirstName,
+		LastName: order.Customer.LastName,
+		Email: order.Customer.Email,
+		CreatedAt: refund.CreatedAt,
+		Currency: note.Currency,
+		Items: []Products{{Name: description, Amount: note.Amount, Quantity: 1}},
+		Number: note.Number,
+		IssuedAt: note.IssuedAt,
+		Document: "Credit note",
+		Reference: fmt.Sprintf("Credits invoice: %s", invoice.Number),
+	}
+	err = document.normalize(app.config.locale)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	key, pdf, err := app.createInvoicePDF(document)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	err = app.DB.SetCreditNoteStorage(note.ID, key)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	attachments := []Attachment{{Name: key, Data: pdf, MimeType: "application/pdf"}}
+	err = app.SendEmail("info@widgets.com", order.Customer.Email, "Your credit note", "credit-note", attachments, note)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.MarkCreditNoteSent(note.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	resp.Error = false
+	resp.Message = fmt.Sprintf("Credit note %s for invoice %s created and sent to %s", note.Number, invoice.Number, order.Customer.Email)
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
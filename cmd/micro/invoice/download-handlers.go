@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/storage"
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
+)
+
+//DownloadInvoice envia o pdf da invoice. O link é assinado pela api ou pelo front para
+//PurposeInvoiceDownload e vence, o id faz parte do path assinado
+func (app *application) DownloadInvoice(w http.ResponseWriter, r *http.Request) {
+	if !app.verifyDownloadLink(w, r) {
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	invoice, err := app.DB.GetInvoice(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, http.StatusNotFound, errors.New("invoice not found"))
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, errors.New("the invoice could not be loaded"))
+		return
+	}
+
+	app.streamPDF(w, invoice.Number, invoice.StorageLocation)
+}
+
+//DownloadCreditNote envia o pdf da nota de credito, com o link assinado como o da invoice
+func (app *application) DownloadCreditNote(w http.ResponseWriter, r *http.Request) {
+	if !app.verifyDownloadLink(w, r) {
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	note, err := app.DB.GetCreditNote(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, http.StatusNotFound, errors.New("credit note not found"))
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, errors.New("the credit note could not be loaded"))
+		return
+	}
+
+	app.streamPDF(w, note.Number, note.StorageLocation)
+}
+
+func (app *application) verifyDownloadLink(w http.ResponseWriter, r *http.Request) bool {
+	_, err := app.signer.Verify(r.RequestURI, urlsigner.PurposeInvoiceDownload)
+	if errors.Is(err, urlsigner.ErrExpired) {
+		app.errorJSON(w, http.StatusForbidden, errors.New("the download link has expired"))
+		return false
+	} else if err != nil {
+		app.errorJSON(w, http.StatusForbidden, errors.New("invalid download link"))
+		return false
+	}
+	return true
+}
+
+//prazo para ler o pdf do storage e enviar ao navegador
+const downloadTimeout = 30 * time.Second
+
+//streamPDF copia o pdf do storage para a resposta sem carregar o arquivo todo. O WriteTimeout
+//do servidor é curto, o prazo de escrita desta resposta é estendido para o do download
+func (app *application) streamPDF(w http.ResponseWriter, number, key string) {
+	if key == "" {
+		app.errorJSON(w, http.StatusNotFound, fmt.Errorf("the pdf of %s was not generated yet", number))
+		return
+	}
+
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(downloadTimeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.errorLog.Println(err)
+	}
+
+	ctx,cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+
+	pdf, err := app.storage.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		app.errorJSON(w, http.StatusNotFound, fmt.Errorf("the pdf of %s was not found", number))
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.errorJSON(w, http.StatusBadGateway, errors.New("the pdf could not be read from the storage"))
+		return
+	}
+	defer pdf.Close()
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, number))
+	w.Header().Set("Cache-Control", "private, no-store")
+	_, err = io.Copy(w, pdf)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/storage"
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
+)
+
+func newDownloadTestApp(t *testing.T, store storage.Storage) *application {
+	signer, err := urlsigner.New(urlsigner.Key{ID: "k1", Secret: []byte("download-secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &application{
+		infolog: log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		storage: store,
+		signer: signer,
+	}
+}
+
+func TestDownloadInvoiceRejectsLinks(t *testing.T) {
+	app := newDownloadTestApp(t, nil)
+	mux := chi.NewRouter()
+	mux.Get("/invoice/{id}", app.DownloadInvoice)
+
+	expired, _ := app.signer.Sign("/invoice/7", urlsigner.PurposeInvoiceDownload, -time.Minute, nil)
+	valid, _ := app.signer.Sign("/invoice/7", urlsigner.PurposeInvoiceDownload, time.Hour, nil)
+	reset, _ := app.signer.Sign("/invoice/7", urlsigner.PurposePasswordReset, time.Hour, nil)
+
+	tests := []struct {
+		name string
+		url string
+		message string
+	}{
+		{"expired", expired, "the download link has expired"},
+		{"other invoice", strings.Replace(valid, "/invoice/7", "/invoice/8", 1), "invalid download link"},
+		{"other purpose", reset, "invalid download link"},
+		{"unsigned", "/invoice/7", "invalid download link"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.url, nil))
+
+			if rr.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+			}
+			var resp struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			if resp.Message != tt.message {
+				t.Errorf("message = %q, want %q", resp.Message, tt.message)
+			}
+		})
+	}
+
+	if !app.verifyDownloadLink(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, valid, nil)) {
+		t.Error("a valid link was rejected")
+	}
+}
+
+//slowStorage entrega o pdf depois de um atraso, como um bucket lento
+type slowStorage struct {
+	delay time.Duration
+	data string
+}
+
+func (s slowStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return nil
+}
+
+func (s slowStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if key != "INV-1.pdf" {
+		return nil, storage.ErrNotFound
+	}
+	return io.NopCloser(&slowReader{delay: s.delay, r: strings.NewReader(s.data)}), nil
+}
+
+type slowReader struct {
+	delay time.Duration
+	r io.Reader
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+//o download passa do WriteTimeout do servidor, o prazo da resposta é o do download
+func TestStreamPDFOutlastsServerWriteTimeout(t *testing.T) {
+	app := newDownloadTestApp(t, slowStorage{delay: 300 * time.Millisecond, data: "%PDF-1.3 invoice"})
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.streamPDF(w, "INV-1", strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/INV-1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("the download was cut: %v", err)
+	}
+	if string(body) != "%PDF-1.3 invoice" || resp.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("got %q with %s", body, resp.Header.Get("Content-Type"))
+	}
+
+	resp, err = http.Get(srv.URL + "/INV-2.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing pdf: status = %d", resp.StatusCode)
+	}
+}
@@ -68,6 +68,19 @@ func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err e
 	return nil
 }
 
+//errorJSON envia o erro em json com o status indicado
+func (app *application) errorJSON(w http.ResponseWriter, status int, err error) error {
+	var payload struct {
+		Error bool `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = err.Error()
+
+	return app.writeJSON(w, status, payload)
+}
+
 func (app *application) CreateDirIfNotExist(path string) error {
 	const mode = 0755
 	if _, err := os.Stat(path); os.IsNotExist(err) {
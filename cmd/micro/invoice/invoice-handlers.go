@@ -1,110 +1,238 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/phpdave11/gofpdf"
-	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/validator"
 )
 
 type Order struct {
 	ID int `json:"id"`
 	Quantity int `json:"quantity"`
-	Amount int `json:"amount"`
+	Amount int `json:"amount"` //total cobrado, em unidades menores da moeda
 	Product string `json:"product"`
 	FirstName string `json:"first_name"`
 	LastName string `json:"last_name"`
 	Email string `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
-	//Items []Products
+	Currency string `json:"currency"`
+	Locale string `json:"locale"`
+	Items []Products `json:"items"`
+	Discount int `json:"discount"`
+	Tax int `json:"tax"`
+	Number string `json:"-"` //numero da invoice emitida, impresso no pdf
+	IssuedAt time.Time `json:"-"`
+	Document string `json:"-"` //titulo do documento, Invoice quando vazio
+	Reference string `json:"-"` //documento de origem, impresso abaixo da data de emissao
+}
+
+func (o *Order) document() string {
+	if o.Document == "" {
+		return "Invoice"
+	}
+	return o.Document
 }
 
 type Products struct {
-	Name string
-	Amount int
-	Quantity int
+	Name string `json:"name"`
+	Amount int `json:"amount"`
+	Quantity int `json:"quantity"`
+}
+
+//normalize completa os campos opcionais e confere os valores da invoice.
+//Orders antigas sem items viram uma linha com o produto
+func (o *Order) normalize(locale string) error {
+	if o.Currency == "" {
+		o.Currency = "usd"
+	}
+	if !validator.IsCurrency(o.Currency) {
+		return fmt.Errorf("invalid currency %q", o.Currency)
+	}
+	if o.Locale == "" {
+		o.Locale = locale
+	}
+	if !knownLocale(o.Locale) {
+		o.Locale = canonicalLocale(o.Locale, locale)
+	}
+
+	if len(o.Items) == 0 {
+		o.Items = []Products{{Name: o.Product, Amount: o.Amount, Quantity: o.Quantity}}
+	}
+	for _, item := range o.Items {
+		if item.Quantity <= 0 || item.Amount < 0 {
+			return fmt.Errorf("invalid line %q: quantity must be greater than zero and amount can not be negative", item.Name)
+		}
+	}
+	if o.Discount < 0 || o.Tax < 0 {
+		return errors.New("discount and tax can not be negative")
+	}
+	if o.Discount > o.Subtotal() {
+		return errors.New("the discount is greater than the subtotal")
+	}
+	if o.Amount > 0 && o.Total() != o.Amount {
+		return fmt.Errorf("the invoice total %d does not match the order amount %d", o.Total(), o.Amount)
+	}
+	return nil
 }
 
+func (o *Order) Subtotal() int {
+	subtotal := 0
+	for _, item := range o.Items {
+		subtotal += item.Amount
+	}
+	return subtotal
+}
+
+func (o *Order) Total() int {
+	return o.Subtotal() - o.Discount + o.Tax
+}
+
+//orderFromModel monta a invoice com os dados gravados da order. A loja nao cobra imposto,
+//o valor cobrado menor que as linhas vai como desconto e o maior, por arredondamento ou
+//preco alterado depois da venda, vira uma linha de ajuste. O total sempre bate com o cobrado
+func orderFromModel(order models.Order) Order {
+	invoice := Order{
+		ID: order.ID,
+		Amount: order.Amount,
+		Product: order.Widget.Name,
+		Quantity: order.Quantity,
+		FirstName: order.Customer.FirstName,
+		LastName: order.Customer.LastName,
+		Email: order.Customer.Email,
+		CreatedAt: order.CreatedAt,
+		Currency: order.Transaction.Currency,
+		Locale: order.Locale,
+	}
+
+	subtotal := 0
+	names := make([]string, 0, len(order.Items))
+	for _, item := range order.Items {
+		invoice.Items = append(invoice.Items, Products{
+			Name: item.WidgetName,
+			Amount: item.Amount,
+			Quantity: item.Quantity,
+		})
+		names = append(names, item.WidgetName)
+		subtotal += item.Amount
+	}
+	if len(names) > 0 {
+		invoice.Product = strings.Join(names, ", ")
+	}
+	if len(invoice.Items) > 0 && subtotal > order.Amount {
+		invoice.Discount = subtotal - order.Amount
+	} else if len(invoice.Items) > 0 && subtotal < order.Amount {
+		invoice.Items = append(invoice.Items, Products{Name: "Adjustment", Amount: order.Amount - subtotal, Quantity: 1})
+	}
+
+	return invoice
+}
+
+//payload das rotas de emissao, os dados sao carregados do banco pelo id
+type issueRequest struct {
+	ID int `json:"id"`
+}
+
+//locks por order, duas entregas da mesma order ao mesmo tempo nao enviam dois emails
+var orderLocks sync.Map
+
+//CreateAndSendInvoice emite, gera e envia a invoice da order, carregada do banco pelo id recebido.
+//A api reenvia o job ate receber 2xx, a invoice ja emitida para a order é reaproveitada e as
+//entregas depois do envio respondem 200 sem enviar outro email
 func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Request) {
-	var order Order
+	var payload issueRequest
 	
-	err := app.readJSON(w,r, &order)
+	err := app.readJSON(w,r, &payload)
 	if err != nil {
 		app.badRequest(w,r,err)
 		return
 	}
-
-	//gerar pdf de nota fiscal
-	err = app.createInvoicePDF(order)
-	if err != nil {
-		app.badRequest(w, r, err)
+	if payload.ID <= 0 {
+		app.badRequest(w, r, errors.New("the order id must be provided"))
 		return
 	}
 
-	//criar email para enviar
-	attachments := []string {
-		fmt.Sprintf("./invoices/%d.pdf", order.ID),
+	saved, err := app.DB.GetOrderByID(payload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, http.StatusNotFound, fmt.Errorf("order %d not found", payload.ID))
+		return
+	} else if err != nil {
+		app.errorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, errors.New("the order could not be loaded"))
+		return
 	}
-
-	//enviar email
-	err = app.SendEmail("info@widgets.com", order.Email, "You invoice", "invoice", attachments, nil)
+	order := orderFromModel(saved)
+	err = order.normalize(app.config.locale)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
+	lock, _ := orderLocks.LoadOrStore(order.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
 	var resp struct {
 		Error bool `json:"error"`
 		Message string `json:"message"`
 	}
-	resp.Error = false
-	resp.Message = fmt.Sprintf("Invoice %d.pdf created and sent to %s", order.ID,order.Email)
 
-	app.writeJSON(w, http.StatusCreated, resp)
-}
+	//o numero é reservado junto com a invoice, uma nova entrega recebe a mesma invoice
+	invoice, err := app.DB.IssueInvoice(models.Invoice{
+		OrderID: order.ID,
+		Currency: strings.ToLower(order.Currency),
+		Subtotal: order.Subtotal(),
+		Discount: order.Discount,
+		Tax: order.Tax,
+		Total: order.Total(),
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the invoice could not be issued"))
+		return
+	}
+	order.Number = invoice.Number
+	order.IssuedAt = invoice.IssuedAt
 
-func (app *application) createInvoicePDF(order Order) error {
-	pdf := gofpdf.New("P", "mm", "Letter", "")
-	pdf.SetMargins(10,13,10)
-	pdf.SetAutoPageBreak(true, 0)
-
-	importer := gofpdi.NewImporter()
-
-	template := importer.ImportPage(pdf, "./pdf-templates/invoice.pdf", 1, "/MediaBox")
-
-	pdf.AddPage()
-	importer.UseImportedTemplate(pdf, template, 0,0,215.9,0)
-
-	//escrever na template do pdf na posicao em y 50mm
-	pdf.SetY(50)
-	pdf.SetX(10)
-	pdf.SetFont("Times", "", 11)
-	//escrita no pdf
-	pdf.CellFormat(97, 8, fmt.Sprintf("Attention: %s %s", order.FirstName, order.LastName), "", 0, "L", false, 0, "")
-	pdf.Ln(5)//espacamento de linha
-	//escrever o email
-	pdf.CellFormat(97, 8, order.Email, "", 0, "L", false, 0, "")
-	pdf.Ln(5)//espacamento de linha
-	//escrever o data
-	pdf.CellFormat(97, 8, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
-	
+	if !invoice.SentAt.IsZero() {
+		resp.Error = false
+		resp.Message = fmt.Sprintf("Invoice %s was already sent", invoice.Number)
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
 
-	pdf.SetX(58)
-	pdf.SetY(93)
-	pdf.CellFormat(155, 8, order.Product, "", 0, "L", false, 0, "")
-	pdf.SetX(166)
-	pdf.CellFormat(20, 8, fmt.Sprintf("%d",order.Quantity), "", 0, "C", false, 0, "")
-	
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f",float32(order.Amount/100.0)), "", 0, "R", false, 0, "")
+	//gerar pdf de nota fiscal
+	key, pdf, err := app.createInvoicePDF(order)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	err = app.DB.SetInvoiceStorage(invoice.ID, key)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	//enviar email
+	attachments := []Attachment{{Name: key, Data: pdf, MimeType: "application/pdf"}}
+	err = app.SendEmail("info@widgets.com", order.Email, "You invoice", "invoice", attachments, nil)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
 
-	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
-	err := pdf.OutputFileAndClose(invoicePath)//abrir o arquivo e fechar automaticamente
+	err = app.DB.MarkInvoiceSent(invoice.ID)
 	if err != nil {
-		return err
+		app.errorLog.Println(err)
 	}
 
-	return nil
-}
\ No newline at end of file
+	resp.Error = false
+	resp.Message = fmt.Sprintf("Invoice %s created and sent to %s", invoice.Number,order.Email)
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+)
+
+func TestOrderFromModel(t *testing.T) {
+	saved := models.Order{
+		ID: 9,
+		Amount: 2700,
+		Quantity: 3,
+		CreatedAt: time.Date(2023, 9, 20, 10, 0, 0, 0, time.UTC),
+		Widget: models.Widget{Name: "Widget"},
+		Transaction: models.Transaction{Currency: "eur"},
+		Customer: models.Customer{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+		Items: []models.OrderItem{
+			{WidgetName: "Widget", Quantity: 2, Amount: 2000},
+			{WidgetName: "Gadget", Quantity: 1, Amount: 1000},
+		},
+	}
+
+	order := orderFromModel(saved)
+	if err := order.normalize(defaultLocale); err != nil {
+		t.Fatal(err)
+	}
+
+	if order.Email != "jane@example.com" || order.Currency != "eur" || order.Product != "Widget, Gadget" {
+		t.Errorf("order = %+v", order)
+	}
+	if len(order.Items) != 2 || order.Subtotal() != 3000 {
+		t.Errorf("items = %+v", order.Items)
+	}
+	//o valor cobrado menor que as linhas vira desconto
+	if order.Discount != 300 || order.Total() != saved.Amount {
+		t.Errorf("discount = %d, total = %d, want the charged %d", order.Discount, order.Total(), saved.Amount)
+	}
+
+	//orders antigas sem items viram uma linha com o widget
+	saved.Items = nil
+	saved.Amount = 1500
+	order = orderFromModel(saved)
+	if err := order.normalize(defaultLocale); err != nil {
+		t.Fatal(err)
+	}
+	if len(order.Items) != 1 || order.Items[0].Name != "Widget" || order.Items[0].Quantity != 3 || order.Total() != 1500 {
+		t.Errorf("items = %+v", order.Items)
+	}
+}
+
+//order de plano como CreateCustomerAndSubscribe grava: uma linha do plano, moeda da transaction
+//e o idioma do comprador
+func TestOrderFromModelSubscription(t *testing.T) {
+	saved := models.Order{
+		ID: 12,
+		Amount: 2000,
+		Quantity: 1,
+		Locale: "pt-br",
+		CreatedAt: time.Date(2023, 9, 20, 10, 0, 0, 0, time.UTC),
+		Widget: models.Widget{Name: "Bronze Plan"},
+		Transaction: models.Transaction{Currency: "brl"},
+		Customer: models.Customer{FirstName: "Ana", LastName: "Souza", Email: "ana@example.com"},
+		Items: []models.OrderItem{
+			{WidgetName: "Bronze Plan", Quantity: 1, UnitPrice: 2000, Amount: 2000},
+		},
+	}
+
+	order := orderFromModel(saved)
+	if err := order.normalize(defaultLocale); err != nil {
+		t.Fatal(err)
+	}
+	if order.Currency != "brl" || order.Locale != "pt-BR" || order.Total() != 2000 {
+		t.Errorf("order = %+v", order)
+	}
+	if got := formatMoney(int64(order.Total()), order.Currency, order.Locale); got != "R$ 20,00" {
+		t.Errorf("total = %q, want R$ 20,00", got)
+	}
+}
+
+func TestOrderFromModelAdjustment(t *testing.T) {
+	saved := models.Order{
+		ID: 13,
+		Amount: 1001,
+		Quantity: 3,
+		Widget: models.Widget{Name: "Widget"},
+		Transaction: models.Transaction{Currency: "usd"},
+		Items: []models.OrderItem{
+			{WidgetName: "Widget", Quantity: 3, UnitPrice: 333, Amount: 999},
+		},
+	}
+
+	order := orderFromModel(saved)
+	if err := order.normalize(defaultLocale); err != nil {
+		t.Fatalf("a rounded order should be invoiced: %v", err)
+	}
+	if len(order.Items) != 2 || order.Items[1].Name != "Adjustment" || order.Items[1].Amount != 2 {
+		t.Errorf("items = %+v", order.Items)
+	}
+	if order.Discount != 0 || order.Total() != saved.Amount {
+		t.Errorf("discount = %d, total = %d, want the charged %d", order.Discount, order.Total(), saved.Amount)
+	}
+}
+
+func TestNormalizeLocale(t *testing.T) {
+	tests := []struct {
+		locale, fallback, want string
+	}{
+		{"de-DE", "en-US", "de-DE"},
+		{"fr-fr", "en-US", "fr-FR"},
+		{"", "ja-JP", "ja-JP"},
+		{"xx-YY", "en-GB", "en-GB"},
+		{"xx-YY", "zz", defaultLocale},
+	}
+	for _, tt := range tests {
+		order := Order{Locale: tt.locale, Currency: "usd", Amount: 100, Quantity: 1, Product: "Widget"}
+		if err := order.normalize(tt.fallback); err != nil {
+			t.Fatal(err)
+		}
+		if order.Locale != tt.want {
+			t.Errorf("locale %q with fallback %q = %q, want %q", tt.locale, tt.fallback, order.Locale, tt.want)
+		}
+	}
+}
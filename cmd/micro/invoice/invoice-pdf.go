@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/phpdave11/gofpdf"
+	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+)
+
+//posicoes em mm na template do pdf
+const (
+	invoiceLinesTop = 93.0 //primeira linha de produtos, abaixo do cabecalho da tabela
+	invoiceLinesBottom = 240.0 //as linhas que passam daqui vao para a proxima pagina
+	invoiceLineHeight = 5.0
+	invoiceNameWidth = 155.0
+	invoiceFooterY = 265.0
+)
+
+//createInvoicePDF gera o pdf da invoice, ou da nota de credito, e guarda no storage com o numero
+//na chave. Retorna a chave e o pdf para o anexo do email
+func (app *application) createInvoicePDF(order Order) (string, []byte, error) {
+	var buf bytes.Buffer
+	err := renderInvoicePDF(order, "./pdf-templates/invoice.pdf", &buf)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ctx,cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+	defer cancel()
+
+	key := order.Number + ".pdf"
+	err = app.storage.Put(ctx, key, buf.Bytes(), "application/pdf")
+	if err != nil {
+		return "", nil, err
+	}
+	return key, buf.Bytes(), nil
+}
+
+//renderInvoicePDF escreve a invoice com todas as linhas da order, abrindo novas paginas
+//quando as linhas nao cabem, e os totais no fim. As datas do arquivo sao a data de emissao
+func renderInvoicePDF(order Order, templatePath string, w io.Writer) error {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(10,13,10)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetCreationDate(order.IssuedAt)
+	pdf.SetModificationDate(order.IssuedAt)
+	pdf.AliasNbPages("")
+
+	//as fontes padrao usam cp1252, os textos em utf-8 como € e nomes com acento sao convertidos
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	money := func(amount int) string {
+		return tr(formatMoney(int64(amount), order.Currency, order.Locale))
+	}
+
+	importer := gofpdi.NewImporter()
+	template := importer.ImportPage(pdf, templatePath, 1, "/MediaBox")
+
+	newPage := func() {
+		pdf.AddPage()
+		importer.UseImportedTemplate(pdf, template, 0,0,215.9,0)
+		pdf.SetFont("Times", "", 11)
+
+		pdf.SetXY(10, invoiceFooterY)
+		pdf.CellFormat(195.9, 8, fmt.Sprintf("%s %s - page %d of {nb}", order.document(), order.Number, pdf.PageNo()), "", 0, "C", false, 0, "")
+
+		if pdf.PageNo() > 1 {
+			pdf.SetXY(10, 50)
+			pdf.CellFormat(97, 8, fmt.Sprintf("%s %s (continued)", order.document(), order.Number), "", 0, "L", false, 0, "")
+		}
+	}
+
+	newPage()
+
+	//escrever na template do pdf na posicao em y 50mm
+	pdf.SetXY(10, 50)
+	pdf.CellFormat(97, 8, tr(fmt.Sprintf("Attention: %s %s", order.FirstName, order.LastName)), "", 0, "L", false, 0, "")
+	pdf.Ln(5)//espacamento de linha
+	pdf.CellFormat(97, 8, order.Email, "", 0, "L", false, 0, "")
+	pdf.Ln(5)
+	pdf.CellFormat(97, 8, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
+
+	//numero e data de emissao da invoice, na coluna da direita
+	pdf.SetXY(108, 50)
+	pdf.CellFormat(97, 8, fmt.Sprintf("%s: %s", order.document(), order.Number), "", 0, "R", false, 0, "")
+	pdf.SetXY(108, 55)
+	pdf.CellFormat(97, 8, fmt.Sprintf("Issued: %s", order.IssuedAt.Format("2006-01-02")), "", 0, "R", false, 0, "")
+	if order.Reference != "" {
+		pdf.SetXY(108, 60)
+		pdf.CellFormat(97, 8, order.Reference, "", 0, "R", false, 0, "")
+	}
+
+	y := invoiceLinesTop
+	for _, item := range order.Items {
+		//nomes longos quebram em varias linhas dentro da coluna do produto
+		nameLines := splitName(pdf, tr(item.Name), invoiceNameWidth-5)
+		height := float64(len(nameLines)) * invoiceLineHeight
+
+		if y+height > invoiceLinesBottom {
+			newPage()
+			y = invoiceLinesTop
+		}
+
+		for i, line := range nameLines {
+			pdf.SetXY(10, y+float64(i)*invoiceLineHeight)
+			pdf.CellFormat(invoiceNameWidth, invoiceLineHeight, line, "", 0, "L", false, 0, "")
+		}
+		pdf.SetXY(166, y)
+		pdf.CellFormat(20, invoiceLineHeight, fmt.Sprintf("%d", item.Quantity), "", 0, "C", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, invoiceLineHeight, money(item.Amount), "", 0, "R", false, 0, "")
+
+		y += height + 1
+	}
+
+	//subtotal, desconto, imposto e total
+	totals := [][2]string{{"Subtotal", money(order.Subtotal())}}
+	if order.Discount > 0 {
+		totals = append(totals, [2]string{"Discount", money(-order.Discount)})
+	}
+	totals = append(totals, [2]string{"Tax", money(order.Tax)})
+	totals = append(totals, [2]string{"Total", money(order.Total())})
+
+	height := float64(len(totals)+1) * (invoiceLineHeight + 1)
+	if y+height > invoiceLinesBottom {
+		newPage()
+		y = invoiceLinesTop
+	}
+
+	y += invoiceLineHeight
+	pdf.Line(135, y-1, 205, y-1)
+	for i, t := range totals {
+		if i == len(totals)-1 {
+			pdf.SetFont("Times", "B", 11)
+		}
+		pdf.SetXY(135, y)
+		pdf.CellFormat(50, invoiceLineHeight, t[0], "", 0, "R", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, invoiceLineHeight, t[1], "", 0, "R", false, 0, "")
+		y += invoiceLineHeight + 1
+	}
+
+	return pdf.Output(w)
+}
+
+//splitName quebra o nome ja convertido para cp1252 em linhas que cabem na largura.
+//O SplitText do gofpdf le o texto como utf-8 e entra em panic com os acentos em cp1252
+func splitName(pdf *gofpdf.Fpdf, name string, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(name) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && pdf.GetStringWidth(candidate) > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	return append(lines, line)
+}
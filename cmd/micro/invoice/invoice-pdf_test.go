@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const testTemplatePath = "../../pdf-templates/invoice.pdf"
+
+//invoice com linhas suficientes para duas paginas, nomes longos, desconto e imposto em euro
+func goldenOrder() Order {
+	order := Order{
+		ID: 42,
+		FirstName: "Zoë",
+		LastName: "Müller",
+		Email: "zoe@example.com",
+		CreatedAt: time.Date(2023, 9, 20, 14, 30, 0, 0, time.UTC),
+		Currency: "eur",
+		Locale: "de-DE",
+		Discount: 12345,
+		Tax: 2050,
+		Number: "INV-2023-000042",
+		IssuedAt: time.Date(2023, 9, 21, 9, 0, 0, 0, time.UTC),
+	}
+	for i := 1; i <= 30; i++ {
+		name := fmt.Sprintf("Widget %02d", i)
+		if i%10 == 0 {
+			name = fmt.Sprintf("Widget %02d with a very long product name that does not fit in the product column of the invoice and wraps", i)
+		}
+		order.Items = append(order.Items, Products{Name: name, Amount: 1999 * i, Quantity: i})
+	}
+	order.Items = append(order.Items, Products{Name: "Großes Paket", Amount: 123456789, Quantity: 1})
+	return order
+}
+
+func TestRenderInvoicePDFGolden(t *testing.T) {
+	order := goldenOrder()
+	err := order.normalize(defaultLocale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = renderInvoicePDF(order, testTemplatePath, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := pdfPageTexts(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) < 2 {
+		t.Fatalf("the invoice has %d pages, the fixture should need at least 2", len(pages))
+	}
+
+	var got strings.Builder
+	for i, lines := range pages {
+		fmt.Fprintf(&got, "--- page %d ---\n", i+1)
+		for _, line := range lines {
+			got.WriteString(line + "\n")
+		}
+	}
+
+	golden := "testdata/invoice.golden"
+	if *update {
+		err = os.WriteFile(golden, []byte(got.String()), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != string(want) {
+		t.Errorf("the invoice text does not match %s, run go test -update to review the change\n--- got ---\n%s", golden, got.String())
+	}
+}
+
+//os textos do pdf estao nos Tj dos streams de conteudo de cada pagina
+var (
+	pdfKids = regexp.MustCompile(`/Type /Pages\s*/Kids \[([^\]]*)\]`)
+	pdfRef = regexp.MustCompile(`(\d+) 0 R`)
+	pdfText = regexp.MustCompile(`\(((?:\\.|[^\\)])*)\)\s*Tj`)
+)
+
+//pdfPageTexts extrai o texto escrito em cada pagina, na ordem em que foi escrito
+func pdfPageTexts(pdf []byte) ([][]string, error) {
+	kids := pdfKids.FindSubmatch(pdf)
+	if kids == nil {
+		return nil, fmt.Errorf("pdf without pages")
+	}
+
+	var pages [][]string
+	for _, ref := range pdfRef.FindAllSubmatch(kids[1], -1) {
+		page, err := pdfObject(pdf, string(ref[1]))
+		if err != nil {
+			return nil, err
+		}
+		contents := regexp.MustCompile(`/Contents (\d+) 0 R`).FindSubmatch(page)
+		if contents == nil {
+			return nil, fmt.Errorf("page %s without contents", ref[1])
+		}
+		stream, err := pdfStream(pdf, string(contents[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		var lines []string
+		for _, m := range pdfText.FindAllSubmatch(stream, -1) {
+			lines = append(lines, pdfString(m[1]))
+		}
+		pages = append(pages, lines)
+	}
+	return pages, nil
+}
+
+func pdfObject(pdf []byte, id string) ([]byte, error) {
+	start := bytes.Index(pdf, []byte("\n"+id+" 0 obj\n"))
+	if start < 0 {
+		return nil, fmt.Errorf("object %s not found", id)
+	}
+	end := bytes.Index(pdf[start:], []byte("endobj"))
+	if end < 0 {
+		return nil, fmt.Errorf("object %s not closed", id)
+	}
+	return pdf[start : start+end], nil
+}
+
+func pdfStream(pdf []byte, id string) ([]byte, error) {
+	obj, err := pdfObject(pdf, id)
+	if err != nil {
+		return nil, err
+	}
+	start := bytes.Index(obj, []byte("stream\n"))
+	end := bytes.LastIndex(obj, []byte("endstream"))
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("object %s is not a stream", id)
+	}
+	data := bytes.TrimSuffix(obj[start+len("stream\n"):end], []byte("\n"))
+
+	if !bytes.Contains(obj[:start], []byte("/FlateDecode")) {
+		return data, nil
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+//pdfString desfaz os escapes da string do pdf e converte o cp1252 das fontes padrao para utf-8
+func pdfString(s []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			i++
+			switch {
+			case s[i] >= '0' && s[i] <= '7':
+				j := i
+				for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+					j++
+				}
+				n, _ := strconv.ParseUint(string(s[i:j]), 8, 8)
+				c = byte(n)
+				i = j - 1
+			case s[i] == 'n':
+				c = '\n'
+			default:
+				c = s[i]
+			}
+		}
+		switch c {
+		case 0x80:
+			b.WriteRune('€')
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
@@ -19,7 +19,20 @@ func (app *application) routes() http.Handler {
 		MaxAge: 300,// 5 minutos
 	}))
 
+	//downloads com link assinado, as unicas rotas abertas ao navegador
+	mux.Get("/invoice/{id}", app.DownloadInvoice)
+	mux.Get("/credit-note/{id}", app.DownloadCreditNote)
+
+	return mux
+}
+
+//internalRoutes sao as rotas de emissao, servidas so no listener interno e assinadas pela api
+func (app *application) internalRoutes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.RequireSignedRequest)
+
 	mux.Post("/invoice/create-and-send", app.CreateAndSendInvoice)
+	mux.Post("/credit-note/create-and-send", app.CreateAndSendCreditNote)
 
 	return mux
 }
@@ -9,12 +9,21 @@ import (
 	"time"
 
 	"github.com/joho/godotenv"
+	driverDB "github.com/ruhancs/go-stripe/internal/driver"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/storage"
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
 )
 
 const version = "1.0.0"
 
 type config struct {
 	port int
+	env string
+	internalAddr string //listener das rotas de emissao, chamadas so pela api
+	db struct {
+		dataSourceName string
+	}
 	smtp struct {
 		host string
 		port int
@@ -22,6 +31,14 @@ type config struct {
 		password string
 	}
 	frontend string // url de reset de senha
+	locale string //formato dos valores nas invoices quando a order nao informa o locale
+	signingKeys string //chaves dos links assinados no formato id:base64,id2:base64, as mesmas da api
+	serviceSecret string //segredo das requisicoes assinadas pela api, o mesmo INVOICE_SERVICE_SECRET da api
+	storage struct {
+		backend string //local ou s3
+		dir string
+		s3 storage.S3Config
+	}
 }
 
 type application struct {
@@ -29,8 +46,13 @@ type application struct {
 	infolog *log.Logger
 	errorLog *log.Logger
 	version string
+	DB models.DbModel
+	storage storage.Storage //onde os pdfs sao guardados
+	signer *urlsigner.URLSigner //verifica os links de download
 }
 
+//server escuta os downloads na porta publica e a emissao no endereco interno, que nao deve ser
+//exposto fora da rede da api. O download estende o proprio prazo de escrita em streamPDF
 func (app *application) server() error {
 	srv := &http.Server{
 		Addr: fmt.Sprintf(":%d", app.config.port),
@@ -41,9 +63,27 @@ func (app *application) server() error {
 		WriteTimeout: 5 * time.Second,
 	}
 
-	app.infolog.Println( fmt.Printf("Starting invoice service on port %d", app.config.port))
+	//a emissao gera o pdf, grava no storage e envia o email antes de responder
+	internal := &http.Server{
+		Addr: app.config.internalAddr,
+		Handler: app.internalRoutes(),
+		IdleTimeout: 30 * time.Second,
+		ReadTimeout: 10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		app.infolog.Printf("Starting internal invoice service on %s", app.config.internalAddr)
+		errs <- internal.ListenAndServe()
+	}()
+	go func() {
+		app.infolog.Printf("Starting invoice service on port %d", app.config.port)
+		errs <- srv.ListenAndServe()
+	}()
 
-	return srv.ListenAndServe()
+	return <-errs
 }
 
 func main() {
@@ -52,10 +92,20 @@ func main() {
 		fmt.Println("Error loading .env")
 	}
 	var cfg config
+
+	dbPassword := os.Getenv("DB_PASSWORD")
+	dbUser := os.Getenv("DB_USER")
 	
 	//flag para usar na linha de comando
 	flag.IntVar(&cfg.port, "port", 5000, "Server Port to listen on")
+	flag.StringVar(&cfg.env, "env", "development", "Application enviroment {development | production}")
+	flag.StringVar(&cfg.internalAddr, "internaladdr", "localhost:5001", "address of the internal listener used by the api to issue invoices and credit notes")
+	flag.StringVar(&cfg.db.dataSourceName, "dataSourceName", fmt.Sprintf(`%s:%s@tcp(localhost:3306)/widgets?parseTime=true&tls=false`,dbUser,dbPassword), "DSN")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "frontend url")
+	flag.StringVar(&cfg.locale, "locale", defaultLocale, "default locale of the invoices: en-US, en-GB, pt-BR, es-ES, de-DE, fr-FR or ja-JP")
+	flag.StringVar(&cfg.storage.backend, "storage", "local", "where the pdfs are stored {local | s3}")
+	flag.StringVar(&cfg.storage.dir, "storagedir", "./invoices", "directory of the local storage")
+	flag.BoolVar(&cfg.storage.s3.PathStyle, "s3pathstyle", true, "put the bucket in the path of the s3 urls, as MinIO expects")
 	flag.StringVar(&cfg.smtp.host, "smthost", "smtp.mailtrap.io", "smtp host")
 	flag.IntVar(&cfg.smtp.port, "smtport", 587, "smtp port")
 	//flag.StringVar(&cfg.smtp.username, "smtusername", "username", "smtp port")
@@ -66,20 +116,70 @@ func main() {
 
 	cfg.smtp.username = os.Getenv("SMTP_USERNAME")
 	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
+	cfg.signingKeys = os.Getenv("URL_SIGNING_KEYS")
+	cfg.serviceSecret = os.Getenv("INVOICE_SERVICE_SECRET")
+
+	cfg.storage.s3.Endpoint = os.Getenv("S3_ENDPOINT")
+	cfg.storage.s3.Region = os.Getenv("S3_REGION")
+	cfg.storage.s3.Bucket = os.Getenv("S3_BUCKET")
+	cfg.storage.s3.AccessKey = os.Getenv("S3_ACCESS_KEY")
+	cfg.storage.s3.SecretKey = os.Getenv("S3_SECRET_KEY")
 
 	//logs da app
 	infolog := log.New(os.Stdout, " INFO\t", log.Ldate| log.Ltime)
 	errorLog := log.New(os.Stdout, " ERROR\t", log.Ldate| log.Ltime| log.Lshortfile)
 
+	//sem o segredo qualquer um na rede interna emitiria invoices
+	if cfg.serviceSecret == "" {
+		errorLog.Fatal("INVOICE_SERVICE_SECRET must be set")
+	}
+
+	//o banco guarda as invoices e a sequencia dos numeros
+	conn,err := driverDB.OpenDb(cfg.db.dataSourceName)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer conn.Close()
+
+	var store storage.Storage
+	switch cfg.storage.backend {
+	case "local":
+		store, err = storage.NewLocal(cfg.storage.dir)
+	case "s3":
+		store, err = storage.NewS3(cfg.storage.s3)
+	default:
+		err = fmt.Errorf("unknown storage %q", cfg.storage.backend)
+	}
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	//as mesmas chaves da api, obrigatorias fora de desenvolvimento
+	if cfg.env != "development" && cfg.signingKeys == "" {
+		errorLog.Fatal("URL_SIGNING_KEYS must be set outside development")
+	}
+	signingKeys := []urlsigner.Key{urlsigner.DevelopmentKey}
+	if cfg.signingKeys != "" {
+		signingKeys, err = urlsigner.ParseKeys(cfg.signingKeys)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+	signer, err := urlsigner.New(signingKeys...)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	app := &application{
 		config: cfg,
 		infolog: infolog,
 		errorLog: errorLog,
 		version: version,
+		DB: models.DbModel{DB: conn},
+		storage: store,
+		signer: signer,
 	}
 
-	app.CreateDirIfNotExist("./invoices")
-
 	err = app.server()
 	if err != nil {
 		log.Fatal(err)
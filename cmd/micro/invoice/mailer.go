@@ -13,7 +13,14 @@ import (
 //go:embed email-templates
 var emailTemplateFS embed.FS
 
-func (app *application) SendEmail(from, to, subject, tmpl string, attachments []string, data interface{}) error {
+//Attachment é um arquivo anexado ao email, os pdfs vem do storage e nao de um arquivo local
+type Attachment struct {
+	Name string
+	Data []byte
+	MimeType string
+}
+
+func (app *application) SendEmail(from, to, subject, tmpl string, attachments []Attachment, data interface{}) error {
 	templateToRender := fmt.Sprintf("email-templates/%s.html.tmpl", tmpl)
 	
 	t, err := template.New("email-html").ParseFS(emailTemplateFS, templateToRender)
@@ -78,7 +85,7 @@ func (app *application) SendEmail(from, to, subject, tmpl string, attachments []
 
 	if len(attachments) > 0 {
 		for _, x := range attachments {
-			email.AddAttachment(x)
+			email.Attach(&mail.File{Name: x.Name, Data: x.Data, MimeType: x.MimeType})
 		}
 	}
 	
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
+)
+
+//tempo que uma requisicao assinada pela api continua valida
+const signedRequestMaxAge = 5 * time.Minute
+
+//RequireSignedRequest aceita apenas as requisicoes assinadas pela api com INVOICE_SERVICE_SECRET
+func (app *application) RequireSignedRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		err = urlsigner.VerifyRequest(r, body, []byte(app.config.serviceSecret), time.Now(), signedRequestMaxAge)
+		if err != nil {
+			app.errorJSON(w, http.StatusUnauthorized, errors.New("invalid request signature"))
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
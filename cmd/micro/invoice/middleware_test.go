@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
+)
+
+func TestRequireSignedRequest(t *testing.T) {
+	app := newDownloadTestApp(t, nil)
+	app.config.serviceSecret = "shared-secret"
+
+	var received string
+	handler := app.RequireSignedRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	request := func(secret string, at time.Time) *http.Request {
+		body := `{"id":42}`
+		r := httptest.NewRequest(http.MethodPost, "/invoice/create-and-send", strings.NewReader(body))
+		if secret != "" {
+			urlsigner.SignRequest(r, []byte(body), []byte(secret), at)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r *http.Request
+		status int
+	}{
+		{"signed by the api", request("shared-secret", time.Now()), http.StatusCreated},
+		{"unsigned", request("", time.Now()), http.StatusUnauthorized},
+		{"other secret", request("guess", time.Now()), http.StatusUnauthorized},
+		{"replayed later", request("shared-secret", time.Now().Add(-time.Hour)), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, tt.r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status == http.StatusCreated && received != `{"id":42}` {
+				t.Errorf("the handler read %q", received)
+			}
+			if tt.status != http.StatusCreated && received != "" {
+				t.Error("an unsigned request reached the handler")
+			}
+		})
+	}
+
+	//as rotas de emissao nao ficam no listener publico
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, request("shared-secret", time.Now()))
+	if rr.Code != http.StatusMethodNotAllowed && rr.Code != http.StatusNotFound {
+		t.Errorf("the public listener served the issue route with status %d", rr.Code)
+	}
+}
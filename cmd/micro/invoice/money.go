@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+//casas decimais das moedas que nao usam 2, os valores chegam em unidades menores (centavos)
+var currencyExponents = map[string]int{
+	"bif": 0, "clp": 0, "djf": 0, "gnf": 0, "isk": 0, "jpy": 0, "kmf": 0, "krw": 0, "pyg": 0,
+	"rwf": 0, "ugx": 0, "vnd": 0, "vuv": 0, "xaf": 0, "xof": 0, "xpf": 0,
+	"bhd": 3, "iqd": 3, "jod": 3, "kwd": 3, "lyd": 3, "omr": 3, "tnd": 3,
+}
+
+var currencySymbols = map[string]string{
+	"usd": "$",
+	"eur": "€",
+	"gbp": "£",
+	"brl": "R$",
+	"jpy": "¥",
+	"cad": "CA$",
+	"aud": "A$",
+}
+
+//formato de numero e posicao do simbolo de cada locale
+type localeFormat struct {
+	decimal string
+	group string
+	symbolAfter bool //1.234,56 € em vez de €1,234.56
+	space bool //espaco entre o simbolo e o numero
+}
+
+var localeFormats = map[string]localeFormat{
+	"en-US": {decimal: ".", group: ","},
+	"en-GB": {decimal: ".", group: ","},
+	"pt-BR": {decimal: ",", group: ".", space: true},
+	"es-ES": {decimal: ",", group: ".", symbolAfter: true, space: true},
+	"de-DE": {decimal: ",", group: ".", symbolAfter: true, space: true},
+	"fr-FR": {decimal: ",", group: " ", symbolAfter: true, space: true},
+	"ja-JP": {decimal: ".", group: ","},
+}
+
+const defaultLocale = "en-US"
+
+func knownLocale(locale string) bool {
+	_, ok := localeFormats[locale]
+	return ok
+}
+
+//canonicalLocale acha o locale conhecido sem diferenca de maiusculas, pt-br vira pt-BR.
+//Um idioma desconhecido usa fallback e, se fallback tambem nao for conhecido, o locale padrao
+func canonicalLocale(locale, fallback string) string {
+	for known := range localeFormats {
+		if strings.EqualFold(known, locale) {
+			return known
+		}
+	}
+	if knownLocale(fallback) {
+		return fallback
+	}
+	return defaultLocale
+}
+
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToLower(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+//formatMoney formata o valor em unidades menores da moeda, sem passar por float.
+//Moeda sem simbolo conhecido usa o codigo, como CHF 10.00
+func formatMoney(amount int64, currency, locale string) string {
+	f, ok := localeFormats[locale]
+	if !ok {
+		f = localeFormats[defaultLocale]
+	}
+
+	negative := amount < 0
+	if negative {
+		amount = -amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	exp := currencyExponent(currency)
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	whole, frac := digits[:len(digits)-exp], digits[len(digits)-exp:]
+
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(f.group)
+		}
+		b.WriteRune(c)
+	}
+	number := b.String()
+	if exp > 0 {
+		number += f.decimal + frac
+	}
+
+	symbol, ok := currencySymbols[strings.ToLower(currency)]
+	space := f.space
+	if !ok {
+		symbol = strings.ToUpper(currency)
+		space = true
+	}
+	sep := ""
+	if space {
+		sep = " "
+	}
+
+	var s string
+	if f.symbolAfter {
+		s = number + sep + symbol
+	} else {
+		s = symbol + sep + number
+	}
+	if negative {
+		s = "-" + s
+	}
+	return s
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount int64
+		currency string
+		locale string
+		want string
+	}{
+		{123456, "usd", "en-US", "$1,234.56"},
+		{5, "usd", "en-US", "$0.05"},
+		{0, "usd", "en-US", "$0.00"},
+		{-1050, "usd", "en-US", "-$10.50"},
+		{123456, "eur", "de-DE", "1.234,56 €"},
+		{-12345, "eur", "de-DE", "-123,45 €"},
+		{123456789, "eur", "fr-FR", "1 234 567,89 €"},
+		{123456, "brl", "pt-BR", "R$ 1.234,56"},
+		{123456, "USD", "en-GB", "$1,234.56"},
+		{1000, "chf", "en-US", "CHF 10.00"},
+		{1000, "usd", "xx-XX", "$10.00"},
+
+		//moedas sem casas decimais
+		{1234, "jpy", "ja-JP", "¥1,234"},
+		{0, "jpy", "ja-JP", "¥0"},
+		{-500, "jpy", "en-US", "-¥500"},
+		{1500000, "krw", "en-US", "KRW 1,500,000"},
+
+		//moedas com 3 casas decimais
+		{1234567, "kwd", "en-US", "KWD 1,234.567"},
+		{5, "kwd", "en-US", "KWD 0.005"},
+		{-1500, "bhd", "de-DE", "-1,500 BHD"},
+	}
+
+	for _, tt := range tests {
+		if got := formatMoney(tt.amount, tt.currency, tt.locale); got != tt.want {
+			t.Errorf("formatMoney(%d, %q, %q) = %q, want %q", tt.amount, tt.currency, tt.locale, got, tt.want)
+		}
+	}
+}
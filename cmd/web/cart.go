@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+)
+
+//item do carrinho salvo na sessao
+type CartItem struct {
+	WidgetID int
+	Name string
+	UnitPrice int
+	Quantity int
+}
+
+func (i CartItem) Amount() int {
+	return i.UnitPrice * i.Quantity
+}
+
+type Cart struct {
+	Items []CartItem
+}
+
+func (c Cart) Total() int {
+	total := 0
+	for _, i := range c.Items {
+		total += i.Amount()
+	}
+	return total
+}
+
+func (c Cart) Count() int {
+	count := 0
+	for _, i := range c.Items {
+		count += i.Quantity
+	}
+	return count
+}
+
+func (c *Cart) Add(widget models.Widget, quantity int) {
+	for i := range c.Items {
+		if c.Items[i].WidgetID == widget.ID {
+			c.Items[i].Quantity += quantity
+			return
+		}
+	}
+	c.Items = append(c.Items, CartItem{
+		WidgetID: widget.ID,
+		Name: widget.Name,
+		UnitPrice: widget.Price,
+		Quantity: quantity,
+	})
+}
+
+//quantidade menor ou igual a zero remove o item
+func (c *Cart) SetQuantity(widgetID, quantity int) {
+	for i := range c.Items {
+		if c.Items[i].WidgetID == widgetID {
+			if quantity <= 0 {
+				c.Items = append(c.Items[:i], c.Items[i+1:]...)
+			} else {
+				c.Items[i].Quantity = quantity
+			}
+			return
+		}
+	}
+}
+
+//itens da order com o preco copiado do carrinho
+func (c Cart) OrderItems() []models.OrderItem {
+	items := make([]models.OrderItem, 0, len(c.Items))
+	for _, i := range c.Items {
+		items = append(items, models.OrderItem{
+			WidgetID: i.WidgetID,
+			WidgetName: i.Name,
+			Quantity: i.Quantity,
+			UnitPrice: i.UnitPrice,
+			Amount: i.Amount(),
+		})
+	}
+	return items
+}
+
+//payment intent criado para o carrinho, guardado na sessao ate o pagamento
+type CheckoutData struct {
+	PaymentIntentID string
+	Cart Cart
+}
+
+func (app *application) getCart(r *http.Request) Cart {
+	cart, ok := app.Session.Get(r.Context(), "cart").(Cart)
+	if !ok {
+		return Cart{}
+	}
+	return cart
+}
+
+func (app *application) saveCart(r *http.Request, cart Cart) {
+	app.Session.Put(r.Context(), "cart", cart)
+
+	//o carrinho mudou, o payment intent anterior nao vale mais e o estoque reservado é liberado
+	if checkout, ok := app.Session.Pop(r.Context(), "checkout").(CheckoutData); ok {
+		err := app.DB.ReleaseReservationsForPaymentIntent(checkout.PaymentIntentID)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+}
+
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["cart"] = app.getCart(r)
+
+	if err := app.renderTemplate(w, r, "cart", &templateData{
+		Data: data,
+		Error: app.Session.PopString(r.Context(), "error"),
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	widgetID, _ := strconv.Atoi(r.Form.Get("widget_id"))
+	quantity, err := strconv.Atoi(r.Form.Get("quantity"))
+	if err != nil || quantity < 1 {
+		quantity = 1
+	}
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	//planos sao vendidos pela pagina de subscription
+	if widget.IsRecurring {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart := app.getCart(r)
+	cart.Add(widget, quantity)
+	app.saveCart(r, cart)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func (app *application) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	widgetID, _ := strconv.Atoi(r.Form.Get("widget_id"))
+	quantity, _ := strconv.Atoi(r.Form.Get("quantity"))
+
+	cart := app.getCart(r)
+	cart.SetQuantity(widgetID, quantity)
+	app.saveCart(r, cart)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func (app *application) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	widgetID, _ := strconv.Atoi(r.Form.Get("widget_id"))
+
+	cart := app.getCart(r)
+	cart.SetQuantity(widgetID, 0)
+	app.saveCart(r, cart)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+//Checkout cria um unico payment intent com o total do carrinho
+func (app *application) Checkout(w http.ResponseWriter, r *http.Request) {
+	cart := app.getCart(r)
+	if len(cart.Items) == 0 {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	//precos atualizados do banco, o cliente paga o preco atual do widget
+	for i, item := range cart.Items {
+		widget, err := app.DB.GetWidget(item.WidgetID)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+		cart.Items[i].Name = widget.Name
+		cart.Items[i].UnitPrice = widget.Price
+	}
+
+	//reutilizar o payment intent se o carrinho nao mudou, recarregar a pagina nao cria outro
+	checkout, ok := app.Session.Get(r.Context(), "checkout").(CheckoutData)
+	clientSecret := ""
+	if ok && checkout.Cart.Total() == cart.Total() {
+		pi, err := app.Gateway.GetPaymentIntent(checkout.PaymentIntentID)
+		if err == nil {
+			clientSecret = pi.ClientSecret
+		}
+	}
+
+	if clientSecret == "" {
+		//o payment intent anterior nao é reutilizado, a reserva dele é liberada antes da nova
+		if ok {
+			err := app.DB.ReleaseReservationsForPaymentIntent(checkout.PaymentIntentID)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+			app.Session.Remove(r.Context(), "checkout")
+		}
+
+		//reservar o estoque antes de cobrar, sem estoque o checkout é recusado
+		reservation, err := app.DB.ReserveInventory(cart.OrderItems(), clientIP(r), app.config.maxReservations, app.config.reservationTTL)
+		var outOfStock *models.OutOfStockError
+		if errors.As(err, &outOfStock) {
+			app.Session.Put(r.Context(), "error", outOfStock.Error())
+			http.Redirect(w, r, "/cart", http.StatusSeeOther)
+			return
+		} else if errors.Is(err, models.ErrTooManyReservations) {
+			app.Session.Put(r.Context(), "error", "Too many pending checkouts, please finish one of them or try again later")
+			http.Redirect(w, r, "/cart", http.StatusSeeOther)
+			return
+		} else if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		metadata := map[string]string{
+			"items": models.ItemsMetadata(cart.OrderItems()),
+			"locale": models.LocaleFromHeader(r.Header.Get("Accept-Language")),
+		}
+
+		pi, msg, err := app.Gateway.CreatePaymentIntent("cad", cart.Total(), metadata, "")
+		if err != nil {
+			app.errorLog.Println(err)
+			if err := app.DB.ReleaseReservation(reservation); err != nil {
+				app.errorLog.Println(err)
+			}
+			app.Session.Put(r.Context(), "error", msg)
+			http.Redirect(w, r, "/cart", http.StatusSeeOther)
+			return
+		}
+
+		err = app.DB.AttachReservation(reservation, pi.ID)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+
+		checkout = CheckoutData{
+			PaymentIntentID: pi.ID,
+			Cart: cart,
+		}
+		clientSecret = pi.ClientSecret
+		app.Session.Put(r.Context(), "checkout", checkout)
+	}
+
+	data := make(map[string]interface{})
+	data["cart"] = checkout.Cart
+
+	stringMap := make(map[string]string)
+	stringMap["client_secret"] = clientSecret
+
+	if err := app.renderTemplate(w, r, "checkout", &templateData{
+		Data: data,
+		StringMap: stringMap,
+	}, "stripe-js"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//CheckoutSucceeded grava uma order com todos os itens do carrinho pago
+func (app *application) CheckoutSucceeded(w http.ResponseWriter, r *http.Request) {
+	checkout, ok := app.Session.Get(r.Context(), "checkout").(CheckoutData)
+	if !ok {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	transactionData, err := app.GetTransactionData(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if transactionData.PaymentIntentID != checkout.PaymentIntentID {
+		app.errorLog.Println(errors.New("payment intent does not match the checkout"))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	//o webhook do stripe pode ter salvo a venda antes do navegador
+	_, err = app.DB.GetTransactionByPaymentIntent(transactionData.PaymentIntentID)
+	if err != nil {
+		order := models.Order{
+			WidgetID: checkout.Cart.Items[0].WidgetID,
+			StatusID: 1,
+			Quantity: checkout.Cart.Count(),
+			Amount: checkout.Cart.Total(),
+			Items: checkout.Cart.OrderItems(),
+			Locale: models.LocaleFromHeader(r.Header.Get("Accept-Language")),
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+
+		//a invoice vai para a fila na mesma transacao da order
+		_, err := app.SaveSale(models.Customer{
+			FirstName: transactionData.FirstName,
+			LastName: transactionData.LastName,
+			Email: transactionData.Email,
+		}, models.Transaction{
+			Amount: checkout.Cart.Total(),
+			Currency: transactionData.PaymentCurrency,
+			LastFour: transactionData.LastFour,
+			ExpiryMonth: transactionData.ExpiryMonth,
+			ExpiryYear: transactionData.ExpiryYear,
+			PaymentIntent: transactionData.PaymentIntentID,
+			PaymentMethod: transactionData.PaymentMethodID,
+			BankReturnCode: transactionData.BankReturnCode,
+			TarnsactionStatusID: 2,
+		}, order)
+		if err != nil && !errors.Is(err, models.ErrDuplicateTransaction) {
+			return
+		}
+	}
+
+	app.Session.Remove(r.Context(), "cart")
+	app.Session.Remove(r.Context(), "checkout")
+	app.Session.Put(r.Context(), "receipt", transactionData)
+
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+}
@@ -1,16 +1,15 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/ruhancs/go-stripe/internal/cards"
-	"github.com/ruhancs/go-stripe/internal/encryption"
 	"github.com/ruhancs/go-stripe/internal/models"
 	"github.com/ruhancs/go-stripe/internal/urlsigner"
 )
@@ -64,18 +63,13 @@ func(app *application) GetTransactionData(r *http.Request) (TransactionData,erro
 
 	amount,_ := strconv.Atoi(paymentAmount)
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key: app.config.stripe.key,
-	}
-
-	pi, err := card.GetPaymentIntent(paymentIntent)
+	pi, err := app.Gateway.GetPaymentIntent(paymentIntent)
 	if err != nil {
 		app.errorLog.Println(err)
 		return transactionData,nil
 	}
 	
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	pm, err := app.Gateway.GetPaymentMethod(paymentMethod)
 	if err != nil {
 		app.errorLog.Println(err)
 		return transactionData,nil
@@ -101,18 +95,6 @@ func(app *application) GetTransactionData(r *http.Request) (TransactionData,erro
 	return transactionData,nil
 }
 
-type Invoice struct {
-	ID int `json:"id"`
-	Quantity int `json:"quantity"`
-	Amount int `json:"amount"`
-	Product string `json:"product"`
-	FirstName string `json:"first_name"`
-	LastName string `json:"last_name"`
-	Email string `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
-	//Items []Products
-}
-
 func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request) {
 	err:= r.ParseForm()//pegar erros do formulario
 	if err != nil {
@@ -128,15 +110,14 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	//create customer
-	customerID, err := app.SaveCustomer(transactionData.FirstName,transactionData.LastName,transactionData.Email)
-	if err != nil {
-		app.errorLog.Println(err)
+	//o webhook do stripe pode ter salvo a venda antes do navegador
+	_, err = app.DB.GetTransactionByPaymentIntent(transactionData.PaymentIntentID)
+	if err == nil {
+		app.Session.Put(r.Context(), "receipt", transactionData)
+		http.Redirect(w,r, "/receipt", http.StatusSeeOther)
 		return
 	}
 
-	app.infolog.Println(customerID)
-
 	//create transaction
 	transaction := models.Transaction{
 		Amount: transactionData.PaymentAmount,
@@ -149,44 +130,28 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		BankReturnCode: transactionData.BankReturnCode,
 		TarnsactionStatusID: 2,//transaction status cleared ocorreu tudo certo
 	}
-	transactionID,err := app.SaveTransaction(transaction)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
-	}
 	
 	//create order
 	order:= models.Order{
 		WidgetID: widgetID,
-		TransactionID: transactionID,
-		CustomerID: customerID,
 		StatusID: 1,//status cleared
 		Quantity: 1,
 		Amount: transactionData.PaymentAmount,
+		Locale: models.LocaleFromHeader(r.Header.Get("Accept-Language")),
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
-	orderID,err := app.SaveOrder(order)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
-	}
 
-	// chamar microservico para gerar nota fiscal por email
-	invoice := Invoice {
-		ID: orderID,
-		Amount: order.Amount,
-		Product: "Widget",
-		Quantity: order.Quantity,
+	//create customer, transaction e order, a invoice vai para a fila na mesma transacao
+	_,err = app.SaveSale(models.Customer{
 		FirstName: transactionData.FirstName,
 		LastName: transactionData.LastName,
 		Email: transactionData.Email,
-		CreatedAt: time.Now(),
-	}
-
-	err = app.CallInvoiceMicro(invoice)
-	if err != nil {
+	}, transaction, order)
+	//o webhook do stripe gravou a venda entre a consulta e o insert
+	if err != nil && !errors.Is(err, models.ErrDuplicateTransaction) {
 		app.errorLog.Println(err)
+		return
 	}
 
 	//should write this data to session, and redirect user
@@ -197,30 +162,6 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	http.Redirect(w,r, "/receipt", http.StatusSeeOther)
 }
 
-func(app *application) CallInvoiceMicro(invoice Invoice) error {
-	url := "http://localhost:5000/invoice/create-and-send"
-	out, err := json.MarshalIndent(invoice, "", "\t")
-	if err != nil {
-		return err
-	}
-
-	req,err := http.NewRequest("POST", url, bytes.NewBuffer(out))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	app.infolog.Println(resp.Body)
-	return nil
-}
-
 func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
 	transactionData,err := app.GetTransactionData(r)
 	if err != nil {
@@ -254,10 +195,22 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 	http.Redirect(w,r, "/virtual-terminal-receipt", http.StatusSeeOther)
 }
 
+//validade do link da invoice no recibo, a invoice chega depois pela fila
+const receiptInvoiceTTL = 7 * 24 * time.Hour
+
 func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	txn := app.Session.Get(r.Context(), "receipt").(TransactionData)//pegar os dados da requisicao em receipt apos o pagamento
 	data := make(map[string]interface{})
 	data["txn"] = txn
+
+	//o link vale para a venda do payment intent, o recibo nao tem login
+	invoiceLink, err := app.signer.Sign("/receipt/invoice", urlsigner.PurposeInvoiceDownload, receiptInvoiceTTL,
+		map[string]string{"payment_intent": txn.PaymentIntentID})
+	if err != nil {
+		app.errorLog.Println(err)
+	} else {
+		data["invoiceLink"] = invoiceLink
+	}
 	app.Session.Remove(r.Context(), "receipt")// remover os dados da sessao apos utilizados
 	if err := app.renderTemplate(w,r,"receipt", &templateData{
 		Data: data,
@@ -266,6 +219,34 @@ func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//ReceiptInvoice abre o pdf da invoice pelo link do recibo. Enquanto a invoice nao foi emitida
+//o cliente vai para o portal, onde a invoice tambem fica disponivel
+func (app *application) ReceiptInvoice(w http.ResponseWriter, r *http.Request) {
+	claims, err := app.signer.Verify(r.RequestURI, urlsigner.PurposeInvoiceDownload)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "This invoice link is invalid or has expired, please sign in to download your invoices")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	txn, err := app.DB.GetTransactionByPaymentIntent(claims.Get("payment_intent"))
+	var order models.Order
+	if err == nil {
+		order, err = app.DB.GetOrderByTransactionID(txn.ID)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorLog.Println(err)
+	}
+
+	link, ok := app.invoiceDownloadLink(order)
+	if err != nil || !ok {
+		app.Session.Put(r.Context(), "error", "Your invoice is still being prepared and will be emailed to you, you can also sign in to download it")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, link, http.StatusSeeOther)
+}
+
 func (app *application) VirtualTerminalReceipt(w http.ResponseWriter, r *http.Request) {
 	txn := app.Session.Get(r.Context(), "receipt").(TransactionData)//pegar os dados da requisicao em receipt apos o pagamento
 	data := make(map[string]interface{})
@@ -278,21 +259,6 @@ func (app *application) VirtualTerminalReceipt(w http.ResponseWriter, r *http.Re
 	}
 }
 
-func (app *application) SaveCustomer(firstName string, lastName string, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName: lastName,
-		Email: email,
-	}
-
-	id,err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		app.errorLog.Println(err)
-		return 0, err
-	}
-	return id, nil
-}
-
 func (app *application) SaveTransaction(t models.Transaction) (int, error) {
 	id,err := app.DB.InsertTransaction(t)
 	if err != nil {
@@ -302,13 +268,33 @@ func (app *application) SaveTransaction(t models.Transaction) (int, error) {
 	return id, nil
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id,err := app.DB.InsertOrder(order)
+//SaveSale grava customer, transaction e order na mesma transacao do banco,
+//se uma das gravacoes falhar nenhuma fica salva
+func (app *application) SaveSale(customer models.Customer, transaction models.Transaction, order models.Order) (int, error) {
+	var orderID int
+	err := app.DB.WithTx(context.Background(), func(tx *models.DbModel) error {
+		customerID, err := tx.SaveCustomer(customer)
+		if err != nil {
+			return err
+		}
+
+		transactionID, err := tx.InsertTransaction(transaction)
+		if err != nil {
+			return err
+		}
+
+		order.CustomerID = customerID
+		order.TransactionID = transactionID
+		orderID, err = tx.InsertOrder(order)
+		return err
+	})
 	if err != nil {
-		app.errorLog.Println(err)
+		if !errors.Is(err, models.ErrDuplicateTransaction) {
+			app.errorLog.Println(err)
+		}
 		return 0, err
 	}
-	return id, nil
+	return orderID, nil
 }
 
 //dispaly page to buy one item
@@ -332,32 +318,79 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (app *application) BronzePlan(w http.ResponseWriter, r * http.Request) {
+//Plans mostra o catalogo de planos
+func (app *application) Plans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.DB.GetPlans()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
 
-	widget,err := app.DB.GetWidget(2)
+	data := make(map[string]interface{})
+	data["plans"] = plans
+
+	if err := app.renderTemplate(w, r, "plans", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//Plan é a pagina de assinatura de um plano do catalogo
+func (app *application) Plan(w http.ResponseWriter, r *http.Request) {
+	plan, err := app.DB.GetPlanBySlug(chi.URLParam(r, "slug"))
 	if err != nil {
 		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
 	}
+
 	//variavel para enviar dados para atemplate
 	data := make(map[string]interface{})
-	data["widget"] = widget
+	data["widget"] = plan
+
+	if err := app.renderTemplate(w,r, "plan", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) PlanReceipt(w http.ResponseWriter, r *http.Request) {
+	plan, err := app.DB.GetPlanBySlug(chi.URLParam(r, "slug"))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["widget"] = plan
 
-	if err := app.renderTemplate(w,r, "bronze-plan", &templateData{
+	if err := app.renderTemplate(w,r, "receipt-plan", &templateData{
 		Data: data,
 	}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-func (app *application) BronzePlanreceipt(w http.ResponseWriter, r * http.Request) {
+func (app *application) AllPlans(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-plans", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
 
-	if err := app.renderTemplate(w,r, "receipt-plan", &templateData{}); err != nil {
+func (app *application) OnePlan(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "one-plan", &templateData{}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
 func (app *application) LoginPage(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w,r, "login", &templateData{}); err != nil {
+	if err := app.renderTemplate(w,r, "login", &templateData{
+		Flash: app.Session.PopString(r.Context(), "flash"),
+		Error: app.Session.PopString(r.Context(), "error"),
+	}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -373,16 +406,45 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
+	ip := clientIP(r)
+
+	//o login do site segue as mesmas esperas do login da api
+	var blocked *models.LoginBlockedError
+	if err := app.DB.CheckLogin(email, ip); errors.As(err, &blocked) {
+		if err := app.DB.InsertAuthFailure(models.AuthFailure{Email: email, IP: ip, Reason: models.AuthFailureBlocked}); err != nil {
+			app.errorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", blocked.Error())
+		http.Redirect(w,r, "/login", http.StatusSeeOther)
+		return
+	}
 
 	id, err := app.DB.Authenticate(email,password)
 	if err != nil {
 		fmt.Println("error no db")
+		_, err = app.DB.RecordLoginFailure(models.AuthFailure{Email: email, IP: ip, Reason: models.AuthFailurePassword})
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		http.Redirect(w,r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	//o token de login da api so é criado depois do segundo passo do 2FA, sem ele a sessao nao é criada
+	user, err := app.DB.GetUserForToken(r.Form.Get("token"), models.ScopeAuthentication)
+	if err != nil || user.ID != id {
+		app.errorLog.Println("login without a valid api token for user", id, err)
+		if err := app.DB.InsertAuthFailure(models.AuthFailure{UserID: id, Email: email, IP: ip, Reason: models.AuthFailureToken}); err != nil {
+			app.errorLog.Println(err)
+		}
 		http.Redirect(w,r, "/login", http.StatusSeeOther)
 		return
 	}
 
 	//inserir o userID no contexto
 	app.Session.Put(r.Context(), "userID", id)
+	app.Session.Put(r.Context(), "role", user.Role)
+	app.Session.Put(r.Context(), "loginAt", time.Now().Unix())
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -392,47 +454,56 @@ func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w,r, "/login", http.StatusSeeOther)
 }
 
-func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w,r, "forgot-password", &templateData{}); err != nil {
-		app.errorLog.Println(err)
+//UnlockAccount desbloqueia o login pelo link enviado por email quando a conta foi bloqueada
+func (app *application) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	claims, err := app.signer.Verify(r.RequestURI, urlsigner.PurposeUnlockAccount)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "This unlock link is invalid or has expired")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
 	}
-}
 
-func (app *application) ShowResetPassword(w http.ResponseWriter,r *http.Request) {
-	email := r.URL.Query().Get("email")//pegar o email do queryparams
-	resetUrl := r.RequestURI
-	testUrl := fmt.Sprintf("%s%s", app.config.frontend, resetUrl)
-
-	signer := urlsigner.Signer{
-		Secret: []byte(app.config.secretKey),
+	err = app.DB.UnlockAccount(claims.Get("email"))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "The account could not be unlocked, try again later")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
 	}
 
-	valid := signer.VerifyToken(testUrl)//checar se a url é valida
+	app.Session.Put(r.Context(), "flash", "Your account was unlocked, you can log in again")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
 
-	if !valid {
-		app.errorLog.Println("Invalid url - reset password ")
-		return
+//AuthFailures mostra a auditoria das falhas de login e os emails bloqueados
+func (app *application) AuthFailures(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w,r, "auth-failures", &templateData{}); err != nil {
+		app.errorLog.Println(err)
 	}
+}
 
-	//verificar se o token nao expirou testUrl é o token
-	expired := signer.Expire(testUrl, 60) //60 minutos para expiracao
-	if expired {
-		app.errorLog.Println("Link expired")
-		return
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w,r, "forgot-password", &templateData{}); err != nil {
+		app.errorLog.Println(err)
 	}
+}
 
-	//encryptografar email
-	encryptor := encryption.Encryption{
-		Key: []byte(app.config.secretKey),
-	}
-	encryptedEmail, err := encryptor.Encrypt(email)
-	if err != nil {
-		app.errorLog.Println("encryption failed")
+//ShowResetPassword mostra o formulario se o token do link ainda vale, o token é usado so na api
+func (app *application) ShowResetPassword(w http.ResponseWriter,r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	data := make(map[string]interface{})
+
+	_, err := app.DB.GetUserForPasswordReset(token)
+	if errors.Is(err, models.ErrInvalidResetToken) {
+		data["invalid"] = true
+	} else if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
+	} else {
+		data["token"] = token
 	}
-	
-	data := make(map[string]interface{})
-	data["email"] = encryptedEmail
 
 	if err := app.renderTemplate(w,r, "reset-password", &templateData{
 		Data: data,
@@ -447,6 +518,13 @@ func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//InvoiceJobs mostra a fila de invoices e os jobs que esgotaram as tentativas
+func (app *application) InvoiceJobs(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w,r, "invoice-jobs", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w,r, "all-subscriptions", &templateData{}); err != nil {
 		app.errorLog.Println(err)
@@ -461,6 +539,7 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap["refund-btn"] = "Refunds Order"
 	stringMap["refunded-msg"] = "Charge refunded"
 	stringMap["refunded-badge"] = "Refunded"
+	stringMap["permission"] = models.PermRefundCreate
 	if err := app.renderTemplate(w,r, "sale", &templateData{
 		StringMap: stringMap,
 	}); err != nil {
@@ -476,6 +555,8 @@ func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request)
 	stringMap["refund-btn"] = "Cancel Subscription"
 	stringMap["refunded-msg"] = "Subscription cancelled"
 	stringMap["refunded-badge"] = "Cancelled"
+	stringMap["subscription"] = "true"
+	stringMap["permission"] = models.PermSubscriptionsManage
 	if err := app.renderTemplate(w,r, "sale", &templateData{
 		StringMap: stringMap,
 	}); err != nil {
@@ -483,6 +564,37 @@ func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+//Tokens mostra os logins e tokens de api do usuario logado
+func (app *application) Tokens(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w,r, "tokens", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//APIKeys mostra as api keys das integracoes, os scopes disponiveis vao para os checkboxes
+func (app *application) APIKeys(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["scopes"] = models.APIKeyScopes
+
+	if err := app.renderTemplate(w,r, "api-keys", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//TwoFactor mostra o 2FA do usuario logado e, para quem ve os usuarios, os papeis que exigem 2FA
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["roles"] = models.Roles
+
+	if err := app.renderTemplate(w,r, "two-factor", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w,r, "all-users", &templateData{}); err != nil {
 		app.errorLog.Println(err)
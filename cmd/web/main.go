@@ -7,14 +7,17 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"text/template"
 	"time"
 
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
 	"github.com/joho/godotenv"
+	"github.com/ruhancs/go-stripe/internal/cards"
 	driverDB "github.com/ruhancs/go-stripe/internal/driver"
 	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
 )
 
 const version = "1.0.0"
@@ -31,9 +34,14 @@ type config struct {
 	stripe struct {
 		secret string
 		key string
+		gateway string
+		gatewayState string //arquivo do estado do gateway fake, o mesmo na api e no web
 	}
-	secretKey string
+	signingKeys string //chaves dos links assinados no formato id:base64,id2:base64, a primeira assina
 	frontend string
+	reservationTTL time.Duration //tempo que o estoque fica reservado aguardando o pagamento
+	maxReservations int //reservas em aberto por ip
+	invoicePublicURL string //url do microservico de invoice vista pelo navegador, usada nos links de download
 }
 
 type application struct {
@@ -43,7 +51,9 @@ type application struct {
 	templateCahe map[string]*template.Template
 	version string
 	DB models.DbModel
+	Gateway cards.PaymentGateway
 	Session *scs.SessionManager
+	signer *urlsigner.URLSigner //verifica os links assinados enviados pela api e assina os downloads das invoices
 }
 
 func (app *application) server() error {
@@ -64,6 +74,8 @@ func (app *application) server() error {
 func main() {
 	
 	gob.Register(TransactionData{})//colocar um map de string na sessao para inserir valores
+	gob.Register(Cart{})
+	gob.Register(CheckoutData{})
 	err := godotenv.Load()
 	if err != nil {
 		fmt.Println("Error loading .env")
@@ -76,9 +88,14 @@ func main() {
 	//flag para usar na linha de comando
 	flag.IntVar(&cfg.port, "port", 4000, "Server Port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application enviroment {development | production}")
+	flag.StringVar(&cfg.stripe.gateway, "gateway", "stripe", "Payment gateway {stripe | fake}")
+	flag.StringVar(&cfg.stripe.gatewayState, "gatewaystate", filepath.Join(os.TempDir(), "go-stripe-fake-gateway.json"), "file shared by the api and web fake gateways")
 	flag.StringVar(&cfg.db.dataSourceName, "dataSourceName", fmt.Sprintf(`%s:%s@tcp(localhost:3306)/widgets?parseTime=true&tls=false`,dbUser,dbPassword), "DSN")
 	flag.StringVar(&cfg.api, "api", "http://localhost:4001", "URL to api")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "frontend url")
+	flag.StringVar(&cfg.invoicePublicURL, "invoicepublicurl", "http://localhost:5000", "invoice service url used in the download links")
+	flag.DurationVar(&cfg.reservationTTL, "reservationttl", 30 * time.Minute, "how long stock is held for an unpaid payment intent")
+	flag.IntVar(&cfg.maxReservations, "maxreservations", 3, "unpaid stock reservations allowed per client ip")
 
 	//definir as variaveis na linah de comando
 	flag.Parse()
@@ -86,7 +103,7 @@ func main() {
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
 
-	cfg.secretKey = os.Getenv("SECRET_RESET_PASSWORD")
+	cfg.signingKeys = os.Getenv("URL_SIGNING_KEYS")
 
 	//logs da app
 	infolog := log.New(os.Stdout, " INFO\t", log.Ldate| log.Ltime)
@@ -105,6 +122,35 @@ func main() {
 
 	templateCache := make(map[string] *template.Template)
 
+	//gateway fake nao chama o stripe, usado em desenvolvimento e testes
+	var gateway cards.PaymentGateway = cards.New(cfg.stripe.secret, cfg.stripe.key)
+	if cfg.stripe.gateway == "fake" {
+		//em producao o pagamento precisa passar pelo stripe
+		if cfg.env == "production" {
+			errorLog.Fatal("the fake gateway can not be used in production")
+		}
+		gateway, err = cards.NewFakeGatewayFile(cfg.stripe.gatewayState)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	//as mesmas chaves da api, obrigatorias fora de desenvolvimento
+	if cfg.env != "development" && cfg.signingKeys == "" {
+		errorLog.Fatal("URL_SIGNING_KEYS must be set outside development")
+	}
+	signingKeys := []urlsigner.Key{urlsigner.DevelopmentKey}
+	if cfg.signingKeys != "" {
+		signingKeys, err = urlsigner.ParseKeys(cfg.signingKeys)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+	signer, err := urlsigner.New(signingKeys...)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	app:= &application{
 		config: cfg,
 		infolog: infolog,
@@ -112,7 +158,9 @@ func main() {
 		templateCahe: templateCache,
 		version: version,
 		DB: models.DbModel{DB: conn},
+		Gateway: gateway,
 		Session: session,
+		signer: signer,
 	}
 
 	//executar em background conexao com websocket
@@ -1,6 +1,14 @@
 package main
 
-import "net/http"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+
+	"github.com/ruhancs/go-stripe/internal/models"
+)
 
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
@@ -13,6 +21,92 @@ func (app *application) Auth(next http.Handler) http.Handler {
 			http.Redirect(w,r, "/login", http.StatusTemporaryRedirect)
 			return
 		} 
+
+		//o reset de senha revoga as sessoes criadas antes dele, o banco grava so os segundos
+		user, err := app.DB.GetUser(app.Session.GetInt(r.Context(), "userID"))
+		revoked := !user.SessionsRevokedAt.IsZero() && app.Session.GetInt64(r.Context(), "loginAt") <= user.SessionsRevokedAt.Unix()
+		if err != nil || revoked {
+			app.Session.Destroy(r.Context())
+			http.Redirect(w,r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+
+		//o papel fica na sessao para RequirePermission e o menu nao lerem o usuario de novo,
+		//é atualizado aqui a cada request para a mudanca de papel valer na hora
+		if app.Session.GetString(r.Context(), "role") != user.Role {
+			app.Session.Put(r.Context(), "role", user.Role)
+		}
 		next.ServeHTTP(w,r)
 	})
-}
\ No newline at end of file
+}
+
+//RequirePermission protege a pagina pela permissao do papel do usuario logado. Roda depois
+//de Auth, que le o usuario do banco e atualiza o papel na sessao
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !models.Permissions(app.Session.GetString(r.Context(), "role"))[permission] {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//csrfToken retorna o token anti-CSRF da sessao, criado na primeira pagina que precisa dele
+func (app *application) csrfToken(r *http.Request) string {
+	token := app.Session.GetString(r.Context(), "csrfToken")
+	if token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		app.errorLog.Println(err)
+		return ""
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	app.Session.Put(r.Context(), "csrfToken", token)
+	return token
+}
+
+//VerifyCSRF recusa os POST sem o csrf_token da sessao, os formularios do portal enviam o token
+//de templateData.CSRFToken em um input hidden
+func (app *application) VerifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := app.Session.GetString(r.Context(), "csrfToken")
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(r.PostFormValue("csrf_token"))) != 1 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//CustomerAuth protege as paginas do portal do customer
+func (app *application) CustomerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Session.Exists(r.Context(), "customerID") {
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//clientIP é o endereco da conexao, usado nas esperas depois das falhas de login e no limite de reservas
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
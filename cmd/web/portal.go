@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/models"
+	"github.com/ruhancs/go-stripe/internal/urlsigner"
+)
+
+//pagina para o customer pedir o link de acesso por email
+func (app *application) CustomerLoginPage(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "customer-login", &templateData{
+		Error: app.Session.PopString(r.Context(), "error"),
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//VerifyCustomerLogin valida o link assinado enviado por email e abre a sessao do customer
+func (app *application) VerifyCustomerLogin(w http.ResponseWriter, r *http.Request) {
+	claims, err := app.signer.Verify(r.RequestURI, urlsigner.PurposeCustomerLogin)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "This login link is invalid or has expired, please request a new one")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(claims.Get("email"))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "customerID", customer.ID)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+func (app *application) CustomerLogout(w http.ResponseWriter, r *http.Request) {
+	app.Session.Remove(r.Context(), "customerID")
+	app.Session.RenewToken(r.Context())
+	http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+}
+
+//CustomerAccount mostra as compras e subscriptions do customer logado
+func (app *application) CustomerAccount(w http.ResponseWriter, r *http.Request) {
+	customerID := app.Session.GetInt(r.Context(), "customerID")
+
+	customer, err := app.DB.GetCustomer(customerID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	orders, err := app.DB.GetOrdersForCustomer(customerID, false)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	subscriptions, err := app.DB.GetOrdersForCustomer(customerID, true)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["customer"] = customer
+	data["orders"] = orders
+	data["subscriptions"] = subscriptions
+
+	if err := app.renderTemplate(w, r, "account", &templateData{
+		Data: data,
+		Flash: app.Session.PopString(r.Context(), "flash"),
+		Error: app.Session.PopString(r.Context(), "error"),
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//order do customer logado, outra order retorna erro
+func (app *application) customerOrder(r *http.Request) (models.Order, error) {
+	orderID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	order, err := app.DB.GetOrderByID(orderID)
+	if err != nil {
+		return order, err
+	}
+
+	if order.CustomerID != app.Session.GetInt(r.Context(), "customerID") {
+		return order, errors.New("order does not belong to the customer")
+	}
+	return order, nil
+}
+
+//DownloadInvoice leva o customer ao pdf da invoice no microservico de invoice, com um link
+//assinado de vida curta
+func (app *application) DownloadInvoice(w http.ResponseWriter, r *http.Request) {
+	order, err := app.customerOrder(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	link, ok := app.invoiceDownloadLink(order)
+	if !ok {
+		app.Session.Put(r.Context(), "error", "The invoice of this order is still being prepared, please try again in a few minutes")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, link, http.StatusSeeOther)
+}
+
+//validade do link do pdf, o customer é redirecionado na hora
+const invoiceDownloadTTL = 5 * time.Minute
+
+//invoiceDownloadLink assina o link do pdf da invoice da order, false enquanto o pdf nao existe
+func (app *application) invoiceDownloadLink(order models.Order) (string, bool) {
+	if order.Invoice == nil || order.Invoice.StorageLocation == "" {
+		return "", false
+	}
+
+	link, err := app.signer.Sign(fmt.Sprintf("%s/invoice/%d", app.config.invoicePublicURL, order.Invoice.ID),
+		urlsigner.PurposeInvoiceDownload, invoiceDownloadTTL, nil)
+	if err != nil {
+		app.errorLog.Println(err)
+		return "", false
+	}
+	return link, true
+}
+
+//pagina para o customer trocar o cartao usado nas subscriptions
+func (app *application) UpdateCardPage(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "update-card", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+//UpdateCard salva o novo cartao no customer do stripe como padrao das proximas cobrancas
+func (app *application) UpdateCard(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	customer, err := app.DB.GetCustomer(app.Session.GetInt(r.Context(), "customerID"))
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if customer.StripeCustomerID == "" {
+		app.Session.Put(r.Context(), "error", "There is no card on file for your account")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	paymentMethod := r.Form.Get("payment_method")
+	msg, err := app.Gateway.AttachPaymentMethod(customer.StripeCustomerID, paymentMethod, "")
+	if err != nil {
+		app.errorLog.Println(err)
+		if msg == "" {
+			msg = "Your card could not be saved"
+		}
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	flash := "Your card was updated"
+	pm, err := app.Gateway.GetPaymentMethod(paymentMethod)
+	if err == nil && pm.Card != nil {
+		flash = fmt.Sprintf("Card ending in %s saved for your next payments", pm.Card.Last4)
+	}
+
+	app.Session.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+//CancelCustomerSubscription cancela a subscription no fim do periodo ja pago
+func (app *application) CancelCustomerSubscription(w http.ResponseWriter, r *http.Request) {
+	order, err := app.customerOrder(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	//a maquina de estados da subscription decide se ainda pode ser cancelada
+	if order.Subscription == nil {
+		http.NotFound(w, r)
+		return
+	}
+	check := *order.Subscription
+	if err := check.Cancel(); err != nil {
+		app.Session.Put(r.Context(), "error", "This subscription is not active")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	//a key muda a cada alteracao da subscription: as novas tentativas do mesmo cancelamento repetem
+	//a key, um cancelamento depois de reativar a subscription usa outra
+	key := fmt.Sprintf("portal-cancel-%d-%d", order.Subscription.ID, order.Subscription.UpdatedAt.UnixNano())
+	err = app.Gateway.CancelSubscription(order.Subscription.StripeSubscriptionID, key)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Your subscription could not be cancelled, please try again")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	_, err = app.DB.UpdateSubscription(order.Subscription.ID, func(s *models.Subscription) error {
+		return s.Cancel()
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your subscription will be cancelled at the end of the current period")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
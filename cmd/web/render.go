@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"strings"
 	"text/template"
+
+	"github.com/ruhancs/go-stripe/internal/models"
 )
 
 //informacoes para enviar para ass templates
@@ -20,10 +22,12 @@ type templateData struct {
 	Error string
 	IsAuthenticated int
 	UserID int
+	Permissions map[string]bool //permissoes do papel do usuario logado, para esconder as acoes
 	API string
 	CssVersion string
 	StripSK string
 	StripePK string
+	CartCount int
 }
 
 //funcoes para utilizar nas templates 
@@ -47,10 +51,17 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	td.StripSK = app.config.stripe.secret
 	td.StripePK = app.config.stripe.key
 
+	td.CSRFToken = app.csrfToken(r)
+
+	//quantidade de itens no carrinho para o menu
+	td.CartCount = app.getCart(r).Count()
+
 	//checar se o usuario esta autenticado verificando se tem userId salvo na sessao
 	if app.Session.Exists(r.Context(), "userID"){
 		td.IsAuthenticated = 1
 		td.UserID = app.Session.GetInt(r.Context(), "userID")
+		//o papel guardado no login e atualizado por Auth, sem ler o usuario a cada pagina
+		td.Permissions = models.Permissions(app.Session.GetString(r.Context(), "role"))
 	} else {
 		td.IsAuthenticated = 0
 		td.UserID = 0
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/ruhancs/go-stripe/internal/models"
 )
 
 func (app *application) routes() http.Handler{
@@ -16,25 +17,62 @@ func (app *application) routes() http.Handler{
 	
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
-		mux.Get("/sales/{id}", app.ShowSale)
-		mux.Get("/subscriptions/{id}", app.ShowSubscription)
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+		mux.Get("/tokens", app.Tokens)
+		mux.Get("/two-factor", app.TwoFactor)
+		sales := app.RequirePermission(models.PermSalesRead)
+
+		mux.With(app.RequirePermission(models.PermTerminalCharge)).Get("/virtual-terminal", app.VirtualTerminal)
+		mux.With(sales).Get("/all-sales", app.AllSales)
+		mux.With(sales).Get("/all-subscriptions", app.AllSubscriptions)
+		mux.With(sales).Get("/sales/{id}", app.ShowSale)
+		mux.With(sales).Get("/subscriptions/{id}", app.ShowSubscription)
+		mux.With(sales).Get("/invoice-jobs", app.InvoiceJobs)
+		mux.With(app.RequirePermission(models.PermUsersRead)).Get("/all-users", app.AllUsers)
+		mux.With(app.RequirePermission(models.PermUsersRead)).Get("/all-users/{id}", app.OneUser)
+		mux.With(app.RequirePermission(models.PermUsersRead)).Get("/auth-failures", app.AuthFailures)
+		mux.With(app.RequirePermission(models.PermPlansRead)).Get("/all-plans", app.AllPlans)
+		mux.With(app.RequirePermission(models.PermPlansRead)).Get("/all-plans/{id}", app.OnePlan)
+		mux.With(app.RequirePermission(models.PermAPIKeysManage)).Get("/api-keys", app.APIKeys)
 	})
 	
+	//portal do customer, o acesso é por link assinado enviado por email
+	mux.Get("/account/login", app.CustomerLoginPage)
+	mux.Get("/account/verify", app.VerifyCustomerLogin)
+	mux.Get("/account/logout", app.CustomerLogout)
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Use(app.CustomerAuth)
+		mux.Use(app.VerifyCSRF)
+		mux.Get("/", app.CustomerAccount)
+		mux.Get("/orders/{id}/invoice", app.DownloadInvoice)
+		mux.Get("/card", app.UpdateCardPage)
+		mux.Post("/card", app.UpdateCard)
+		mux.Post("/subscriptions/{id}/cancel", app.CancelCustomerSubscription)
+	})
+
 	mux.Get("/widget/{id}", app.ChargeOnce)
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/receipt", app.Receipt)
+	mux.Get("/receipt/invoice", app.ReceiptInvoice)
 
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.BronzePlanreceipt)
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/update", app.UpdateCart)
+	mux.Post("/cart/remove", app.RemoveFromCart)
+	mux.Get("/cart/checkout", app.Checkout)
+	mux.Post("/cart/checkout", app.CheckoutSucceeded)
+
+	mux.Get("/plans", app.Plans)
+	mux.Get("/plans/{slug}", app.Plan)
+	mux.Get("/plans/{slug}/receipt", app.PlanReceipt)
+	//link antigo do recibo do bronze plan
+	mux.Get("/receipt/bronze", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/plans/bronze/receipt", http.StatusMovedPermanently)
+	})
 
 	mux.Get("/login", app.LoginPage)
 	mux.Post("/login", app.PostLoginPage)
 	mux.Get("/logout", app.Logout)
+	mux.Get("/unlock-account", app.UnlockAccount)
 
 	mux.Get("/forgot-password", app.ForgotPassword)
 	mux.Get("/reset-password", app.ShowResetPassword)
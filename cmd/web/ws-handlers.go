@@ -99,6 +99,13 @@ func (app *application) ListenToWsChannel() {
 			response.UserID = event.UserID //enviar o id do usuario no evento
 			app.broadcastToAll(response)//informa para todos conectado no canal que usuario foi deletado
 
+		case "logoutEverywhere":
+			//os tokens ja foram revogados na api, os navegadores do usuario saem da sessao
+			response.Action = "logout"
+			response.Message = "You have been logged out from every device"
+			response.UserID = event.UserID
+			app.broadcastToAll(response)
+
 		default:
 		}
 	}
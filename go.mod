@@ -3,24 +3,23 @@ module github.com/ruhancs/go-stripe
 go 1.20
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/alexedwards/scs/mysqlstore v0.0.0-20230327161757-10d4299e3b24
 	github.com/alexedwards/scs/v2 v2.5.1
 	github.com/go-chi/chi/v5 v5.0.10
 	github.com/go-chi/cors v1.2.1
 	github.com/go-sql-driver/mysql v1.7.1
+	github.com/gorilla/websocket v1.5.0
 	github.com/joho/godotenv v1.5.1
+	github.com/phpdave11/gofpdf v1.4.2
 	github.com/stripe/stripe-go/v72 v72.122.0
-	github.com/xhit/go-simple-mail v2.2.2+incompatible
 	github.com/xhit/go-simple-mail/v2 v2.16.0
 	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 )
 
 require (
-	github.com/bwmarrin/go-alone v0.0.0-20190806015146-742bb55d1631 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
-	github.com/phpdave11/gofpdf v1.4.2 // indirect
+	github.com/go-test/deep v1.1.1 // indirect
 	github.com/phpdave11/gofpdi v1.0.12 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/toorop/go-dkim v0.0.0-20201103131630-e1cd1a0a5208 // indirect
-	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
 )
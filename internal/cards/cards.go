@@ -1,19 +1,64 @@
 package cards
 
 import (
+	"fmt"
 
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/paymentintent"
-	"github.com/stripe/stripe-go/v72/paymentmethod"
-	"github.com/stripe/stripe-go/v72/refund"
-	"github.com/stripe/stripe-go/v72/sub"
+	"github.com/stripe/stripe-go/v72/client"
 )
 
+//PaymentGateway sao as operacoes de pagamento usadas pelas apps,
+//Card é a implementacao com o stripe e FakeGateway a implementacao em memoria.
+//As operacoes que alteram dados recebem uma idempotency key, repassada ao stripe
+//para que a mesma chamada repetida nao gere outra cobranca, vazio desativa
+type PaymentGateway interface {
+	CreatePaymentIntent(currency string, amount int, metadata map[string]string, idempotencyKey string) (*stripe.PaymentIntent, string, error)
+	GetPaymentIntent(id string) (*stripe.PaymentIntent, error)
+	GetPaymentMethod(id string) (*stripe.PaymentMethod, error)
+	CreateCustomer(paymentMethod, email, idempotencyKey string) (*stripe.Customer, string, error)
+	AttachPaymentMethod(customerID, paymentMethod, idempotencyKey string) (string, error)
+	SubscribeToPlan(cust *stripe.Customer, plan Plan, email, last4, cardType, idempotencyKey string) (*stripe.Subscription, error)
+	GetPrice(id string) (*stripe.Price, error)
+	Refunds(pi string, amount int, idempotencyKey string) (*stripe.Refund, error)
+	CancelSubscription(subID, idempotencyKey string) error
+	GetSubscription(subID string) (*stripe.Subscription, error)
+	ChangeSubscriptionPlan(subID string, plan Plan, idempotencyKey string) (*stripe.Subscription, error)
+	PauseSubscription(subID, idempotencyKey string) (*stripe.Subscription, error)
+	ResumeSubscription(subID, idempotencyKey string) (*stripe.Subscription, error)
+	ReactivateSubscription(subID, idempotencyKey string) (*stripe.Subscription, error)
+}
+
+//Plan é o preco recorrente cadastrado no gateway, com o intervalo e os dias de teste gratis
+type Plan struct {
+	ID string
+	Interval string
+	TrialDays int
+}
+
 type Card struct {
 	Secret string
 	Key string
 	Currency string
+	sc *client.API
+}
+
+//New cria o gateway do stripe com um client proprio, sem usar o stripe.Key global
+func New(secret, key string) *Card {
+	c := &Card{
+		Secret: secret,
+		Key: key,
+	}
+	c.sc = client.New(secret, nil)
+	return c
+}
+
+var _ PaymentGateway = (*Card)(nil)
+
+func (c *Card) client() *client.API {
+	if c.sc == nil {
+		c.sc = client.New(c.Secret, nil)
+	}
+	return c.sc
 }
 
 type Transaction struct {
@@ -24,13 +69,11 @@ type Transaction struct {
 	BankReturnCode string
 }
 
-func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymenIntent(currency,amount)
+func (c *Card) Charge(currency string, amount int, metadata map[string]string, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
+	return c.CreatePaymentIntent(currency,amount,metadata,idempotencyKey)
 }
 
-func (c *Card) CreatePaymenIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	stripe.Key = c.Secret //secret key do stripe
-
+func (c *Card) CreatePaymentIntent(currency string, amount int, metadata map[string]string, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
 	//create payment intent
 	params := &stripe.PaymentIntentParams{
 		//converter o int para 64 para o stripe
@@ -38,10 +81,13 @@ func (c *Card) CreatePaymenIntent(currency string, amount int) (*stripe.PaymentI
 		Currency: stripe.String(currency),
 	}
 
-	//se quiser adicionar alguma informacao na transacao
-	//params.AddMetadata("key","value")
+	//informacoes extras da transacao, usadas pelo webhook para criar a order
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
+	setIdempotencyKey(&params.Params, idempotencyKey)
 
-	paymentIntent,err := paymentintent.New(params)
+	paymentIntent,err := c.client().PaymentIntents.New(params)
 	if err!= nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -54,9 +100,7 @@ func (c *Card) CreatePaymenIntent(currency string, amount int) (*stripe.PaymentI
 
 //pegar o metodo de pagamento pelo payment Intent Id
 func (c *Card) GetPaymentMethod( s string) (*stripe.PaymentMethod, error) {
-	stripe.Key = c.Secret
-
-	paymentMeth,err := paymentmethod.Get(s, nil)
+	paymentMeth,err := c.client().PaymentMethods.Get(s, nil)
 	if err != nil{
 		return nil, err
 	}
@@ -65,9 +109,7 @@ func (c *Card) GetPaymentMethod( s string) (*stripe.PaymentMethod, error) {
 
 //pegar um payment intent existent pelo id
 func(c *Card) GetPaymentIntent(id string) (*stripe.PaymentIntent, error) {
-	stripe.Key = c.Secret
-
-	paymentInt,err := paymentintent.Get(id,nil)
+	paymentInt,err := c.client().PaymentIntents.Get(id,nil)
 	if err != nil{
 		return nil, err
 	}
@@ -75,30 +117,42 @@ func(c *Card) GetPaymentIntent(id string) (*stripe.PaymentIntent, error) {
 }
 
 //subscrever o customer no plano
-func(c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+func(c *Card) SubscribeToPlan(cust *stripe.Customer, plan Plan, email, last4, cardType, idempotencyKey string) (*stripe.Subscription, error) {
 	stripeCustomerID := cust.ID
 	items := []*stripe.SubscriptionItemsParams{
-		{Plan: stripe.String(plan)},
+		{Plan: stripe.String(plan.ID)},
 	}
 
 	params := &stripe.SubscriptionParams{
 		Customer: stripe.String(stripeCustomerID),
 		Items: items,
 	}
+	if plan.TrialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(plan.TrialDays))
+	}
 
 	params.AddMetadata("last_four", last4)
 	params.AddMetadata("card_type", cardType)
 	params.AddExpand("latest_invoice.payment_intent")
-	subscription, err := sub.New(params)
+	setIdempotencyKey(&params.Params, idempotencyKey)
+	subscription, err := c.client().Subscriptions.New(params)
 	if err != nil {
 		return nil, err
 	}
 	return subscription,nil
 }
 
+//pegar o preco cadastrado no stripe, usado para validar o plan_id dos planos
+func (c *Card) GetPrice(id string) (*stripe.Price, error) {
+	price, err := c.client().Prices.Get(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return price, nil
+}
+
 //criar um customer no dashbioard do stripe
-func (c *Card) CreateCustomer(paymentMethod, email string) (*stripe.Customer, string, error) {
-	stripe.Key = c.Secret
+func (c *Card) CreateCustomer(paymentMethod, email, idempotencyKey string) (*stripe.Customer, string, error) {
 	customerParams := &stripe.CustomerParams{
 		PaymentMethod: stripe.String(paymentMethod),
 		Email: stripe.String(email),
@@ -106,8 +160,9 @@ func (c *Card) CreateCustomer(paymentMethod, email string) (*stripe.Customer, st
 			DefaultPaymentMethod: stripe.String(paymentMethod),
 		},
 	}
+	setIdempotencyKey(&customerParams.Params, idempotencyKey)
 
-	cust,err := customer.New(customerParams)
+	cust,err := c.client().Customers.New(customerParams)
 	if err != nil {
 		msg:= ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -118,37 +173,147 @@ func (c *Card) CreateCustomer(paymentMethod, email string) (*stripe.Customer, st
 	return cust, "", nil
 }
 
-func(c *Card) Refunds(pi string, amount int) error {
-	stripe.Key = c.Secret
+//salvar um novo cartao em um customer ja existente no stripe e usar como padrao das cobrancas
+func (c *Card) AttachPaymentMethod(customerID, paymentMethod, idempotencyKey string) (string, error) {
+	attachParams := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	}
+	if idempotencyKey != "" {
+		setIdempotencyKey(&attachParams.Params, idempotencyKey + "-attach")
+	}
+
+	_, err := c.client().PaymentMethods.Attach(paymentMethod, attachParams)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMsg(stripeErr.Code)
+		}
+		return msg, err
+	}
+
+	customerParams := &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(paymentMethod),
+		},
+	}
+	if idempotencyKey != "" {
+		setIdempotencyKey(&customerParams.Params, idempotencyKey + "-default")
+	}
+
+	_, err = c.client().Customers.Update(customerID, customerParams)
+	if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+//devolver amount do payment intent, retorna o refund criado no stripe
+func(c *Card) Refunds(pi string, amount int, idempotencyKey string) (*stripe.Refund, error) {
 	amountToRefund := int64(amount)
 
 	refundParams := &stripe.RefundParams{
 		Amount: &amountToRefund,
 		PaymentIntent: &pi,
 	}
+	setIdempotencyKey(&refundParams.Params, idempotencyKey)
 
-	_, err := refund.New(refundParams)
+	refund, err := c.client().Refunds.New(refundParams)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return refund, nil
 }
 
-func (c *Card) CancelSubscription(subID string) error {
-	stripe.Key = c.Secret
-
+func (c *Card) CancelSubscription(subID, idempotencyKey string) error {
 	params := &stripe.SubscriptionParams{
 		CancelAtPeriodEnd: stripe.Bool(true),
 	}
+	setIdempotencyKey(&params.Params, idempotencyKey)
 
-	_, err := sub.Update(subID, params)
+	_, err := c.client().Subscriptions.Update(subID, params)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func (c *Card) GetSubscription(subID string) (*stripe.Subscription, error) {
+	subscription, err := c.client().Subscriptions.Get(subID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+//trocar o preco da subscription, a diferenca do periodo atual entra como proration na proxima fatura
+func (c *Card) ChangeSubscriptionPlan(subID string, plan Plan, idempotencyKey string) (*stripe.Subscription, error) {
+	current, err := c.GetSubscription(subID)
+	if err != nil {
+		return nil, err
+	}
+	if current.Items == nil || len(current.Items.Data) == 0 {
+		return nil, fmt.Errorf("subscription %s has no items", subID)
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID: stripe.String(current.Items.Data[0].ID),
+				Price: stripe.String(plan.ID),
+			},
+		},
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+	}
+	setIdempotencyKey(&params.Params, idempotencyKey)
+
+	return c.client().Subscriptions.Update(subID, params)
+}
+
+//pausar a cobranca, as faturas do periodo pausado sao anuladas
+func (c *Card) PauseSubscription(subID, idempotencyKey string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+		},
+	}
+	setIdempotencyKey(&params.Params, idempotencyKey)
+
+	return c.client().Subscriptions.Update(subID, params)
+}
+
+func (c *Card) ResumeSubscription(subID, idempotencyKey string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	//pause_collection vazio retoma a cobranca
+	params.AddExtra("pause_collection", "")
+	setIdempotencyKey(&params.Params, idempotencyKey)
+
+	return c.client().Subscriptions.Update(subID, params)
+}
+
+//desfazer o cancelamento agendado para o fim do periodo
+func (c *Card) ReactivateSubscription(subID, idempotencyKey string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+	setIdempotencyKey(&params.Params, idempotencyKey)
+
+	return c.client().Subscriptions.Update(subID, params)
+}
+
+func setIdempotencyKey(params *stripe.Params, key string) {
+	if key != "" {
+		params.SetIdempotencyKey(key)
+	}
+}
+
+//IsNotFound informa se o erro do gateway é de um objeto que nao existe mais,
+//como um customer apagado no dashboard do stripe
+func IsNotFound(err error) bool {
+	stripeErr, ok := err.(*stripe.Error)
+	return ok && stripeErr.Code == stripe.ErrorCodeResourceMissing
+}
+
 func cardErrorMsg(code stripe.ErrorCode) string {
 	var msg = ""
 
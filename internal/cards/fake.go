@@ -0,0 +1,519 @@
+package cards
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+//payment methods de teste do stripe que o FakeGateway recusa, com o codigo de erro do stripe
+var fakeDeclines = map[string]stripe.ErrorCode{
+	"pm_card_chargeDeclined": stripe.ErrorCodeCardDeclined,
+	"pm_card_chargeDeclinedExpiredCard": stripe.ErrorCodeExpiredCard,
+	"pm_card_chargeDeclinedIncorrectCvc": stripe.ErrorCodeIncorrectCVC,
+	"pm_card_chargeDeclinedInsufficientFunds": stripe.ErrorCodeBalanceInsufficient,
+	"pm_card_incorrectZip": stripe.ErrorCodeIncorrectZip,
+	"pm_card_invalidPostalCode": stripe.ErrorCodePostalCodeInvalid,
+}
+
+//limites de valor do stripe para cobrancas em centavos
+const (
+	fakeMinAmount = 50
+	fakeMaxAmount = 99999999
+)
+
+//FakeGateway é um PaymentGateway em memoria e deterministico para testes e desenvolvimento,
+//os ids sao sequenciais e nenhuma chamada sai para a rede. Criado com NewFakeGatewayFile o estado
+//fica num arquivo, assim a api e o web usam os mesmos payment intents, customers e subscriptions
+type FakeGateway struct {
+	mu sync.Mutex
+	nextError stripe.ErrorCode
+	statePath string //arquivo do estado compartilhado, vazio mantem tudo na memoria
+	stateErr error //erro ao gravar o estado, retornado na proxima chamada
+
+	fakeState
+}
+
+//fakeState sao os dados do gateway, gravados em json no arquivo do estado
+type fakeState struct {
+	Seq int `json:"seq"`
+	PaymentIntents map[string]*stripe.PaymentIntent `json:"payment_intents"`
+	Customers map[string]*stripe.Customer `json:"customers"`
+	Subscriptions map[string]*stripe.Subscription `json:"subscriptions"`
+	Prices map[string]*stripe.Price `json:"prices"`
+	RefundsIssued map[string]*stripe.Refund `json:"refunds"`
+	Refunded map[string]int64 `json:"refunded"`
+
+	//operacao e id do resultado da primeira chamada de cada idempotency key
+	Idempotent map[string]fakeIdempotent `json:"idempotent"`
+}
+
+type fakeIdempotent struct {
+	Op string `json:"op"`
+	ID string `json:"id"`
+}
+
+func NewFakeGateway() *FakeGateway {
+	f := &FakeGateway{}
+	f.reset()
+	return f
+}
+
+func (f *FakeGateway) reset() {
+	f.fakeState = fakeState{
+		PaymentIntents: make(map[string]*stripe.PaymentIntent),
+		Customers: make(map[string]*stripe.Customer),
+		Subscriptions: make(map[string]*stripe.Subscription),
+		Prices: make(map[string]*stripe.Price),
+		RefundsIssued: make(map[string]*stripe.Refund),
+		Refunded: make(map[string]int64),
+		Idempotent: make(map[string]fakeIdempotent),
+	}
+}
+
+//replay retorna o id do resultado da primeira chamada com a key. Como no stripe, a key usada
+//em outra operacao é recusada com um erro de idempotency
+func (f *FakeGateway) replay(op, key string) (string, bool, error) {
+	if key == "" {
+		return "", false, nil
+	}
+	result, ok := f.Idempotent[key]
+	if !ok {
+		return "", false, nil
+	}
+	if result.Op != op {
+		return "", false, &stripe.Error{
+			Type: stripe.ErrorTypeIdempotency,
+			Msg: fmt.Sprintf("Keys for idempotent requests can only be used for the same endpoint they were first used for (%s)", result.Op),
+			HTTPStatusCode: 400,
+		}
+	}
+	return result.ID, true, nil
+}
+
+func (f *FakeGateway) remember(op, key, id string) {
+	if key != "" {
+		f.Idempotent[key] = fakeIdempotent{Op: op, ID: id}
+	}
+}
+
+//Decline faz a proxima chamada do gateway falhar com o codigo informado
+func (f *FakeGateway) Decline(code stripe.ErrorCode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextError = code
+}
+
+func (f *FakeGateway) newID(prefix string) string {
+	f.Seq++
+	return fmt.Sprintf("%s_fake_%06d", prefix, f.Seq)
+}
+
+//retorna o erro forcado por Decline, se houver, e limpa
+func (f *FakeGateway) takeError() *stripe.Error {
+	if f.nextError == "" {
+		return nil
+	}
+	err := fakeError(f.nextError)
+	f.nextError = ""
+	return err
+}
+
+func fakeError(code stripe.ErrorCode) *stripe.Error {
+	return &stripe.Error{
+		Type: stripe.ErrorTypeCard,
+		Code: code,
+		Msg: string(code),
+		HTTPStatusCode: 402,
+	}
+}
+
+func fakeNotFound(id string) *stripe.Error {
+	return &stripe.Error{
+		Type: stripe.ErrorTypeInvalidRequest,
+		Code: stripe.ErrorCodeResourceMissing,
+		Msg: fmt.Sprintf("No such object: '%s'", id),
+		HTTPStatusCode: 404,
+	}
+}
+
+func (f *FakeGateway) CreatePaymentIntent(currency string, amount int, metadata map[string]string, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, "", err
+	}
+	defer unlock()
+
+	if id, ok, err := f.replay("payment_intents", idempotencyKey); err != nil {
+		return nil, "", err
+	} else if ok {
+		return f.PaymentIntents[id], "", nil
+	}
+
+	if err := f.takeError(); err != nil {
+		return nil, cardErrorMsg(err.Code), err
+	}
+
+	if amount < fakeMinAmount {
+		err := fakeError(stripe.ErrorCodeAmountTooSmall)
+		return nil, cardErrorMsg(err.Code), err
+	}
+	if amount > fakeMaxAmount {
+		err := fakeError(stripe.ErrorCodeAmountTooLarge)
+		return nil, cardErrorMsg(err.Code), err
+	}
+
+	id := f.newID("pi")
+	//o pagamento fake ja nasce confirmado, com uma charge como o stripe retorna apos o confirmCardPayment
+	pi := &stripe.PaymentIntent{
+		ID: id,
+		Amount: int64(amount),
+		Currency: currency,
+		ClientSecret: id + "_secret",
+		Status: stripe.PaymentIntentStatusSucceeded,
+		Metadata: metadata,
+		Charges: &stripe.ChargeList{
+			Data: []*stripe.Charge{
+				{ID: f.newID("ch"), Amount: int64(amount), Paid: true},
+			},
+		},
+	}
+	f.PaymentIntents[id] = pi
+	f.remember("payment_intents", idempotencyKey, id)
+	return pi, "", nil
+}
+
+func (f *FakeGateway) GetPaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	pi, ok := f.PaymentIntents[id]
+	if !ok {
+		return nil, fakeNotFound(id)
+	}
+	return pi, nil
+}
+
+func (f *FakeGateway) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := f.takeError(); err != nil {
+		return nil, err
+	}
+
+	//cartao expirado tem data no passado, os demais validos por 3 anos
+	expYear := time.Now().Year() + 3
+	if fakeDeclines[id] == stripe.ErrorCodeExpiredCard {
+		expYear = time.Now().Year() - 1
+	}
+
+	return &stripe.PaymentMethod{
+		ID: id,
+		Type: stripe.PaymentMethodTypeCard,
+		Card: &stripe.PaymentMethodCard{
+			Brand: stripe.PaymentMethodCardBrandVisa,
+			Last4: "4242",
+			ExpMonth: 12,
+			ExpYear: uint64(expYear),
+		},
+	}, nil
+}
+
+func (f *FakeGateway) CreateCustomer(paymentMethod, email, idempotencyKey string) (*stripe.Customer, string, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, "", err
+	}
+	defer unlock()
+
+	if id, ok, err := f.replay("customers", idempotencyKey); err != nil {
+		return nil, "", err
+	} else if ok {
+		return f.Customers[id], "", nil
+	}
+
+	if err := f.takeError(); err != nil {
+		return nil, cardErrorMsg(err.Code), err
+	}
+
+	if code, declined := fakeDeclines[paymentMethod]; declined {
+		err := fakeError(code)
+		return nil, cardErrorMsg(code), err
+	}
+
+	cust := &stripe.Customer{
+		ID: f.newID("cus"),
+		Email: email,
+	}
+	f.Customers[cust.ID] = cust
+	f.remember("customers", idempotencyKey, cust.ID)
+	return cust, "", nil
+}
+
+func (f *FakeGateway) AttachPaymentMethod(customerID, paymentMethod, idempotencyKey string) (string, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, ok, err := f.replay("payment_methods.attach", idempotencyKey); err != nil {
+		return "", err
+	} else if ok {
+		return "", nil
+	}
+
+	if err := f.takeError(); err != nil {
+		return cardErrorMsg(err.Code), err
+	}
+
+	cust, ok := f.Customers[customerID]
+	if !ok {
+		return "", fakeNotFound(customerID)
+	}
+
+	if code, declined := fakeDeclines[paymentMethod]; declined {
+		return cardErrorMsg(code), fakeError(code)
+	}
+
+	cust.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+		DefaultPaymentMethod: &stripe.PaymentMethod{ID: paymentMethod},
+	}
+	f.remember("payment_methods.attach", idempotencyKey, cust.ID)
+	return "", nil
+}
+
+func (f *FakeGateway) SubscribeToPlan(cust *stripe.Customer, plan Plan, email, last4, cardType, idempotencyKey string) (*stripe.Subscription, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if id, ok, err := f.replay("subscriptions", idempotencyKey); err != nil {
+		return nil, err
+	} else if ok {
+		return f.Subscriptions[id], nil
+	}
+
+	if err := f.takeError(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.Customers[cust.ID]; !ok {
+		return nil, fakeNotFound(cust.ID)
+	}
+
+	now := time.Now()
+	subscription := &stripe.Subscription{
+		ID: f.newID("sub"),
+		Customer: cust,
+		Status: stripe.SubscriptionStatusActive,
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd: fakePeriodEnd(now, plan.Interval).Unix(),
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{ID: f.newID("si"), Price: &stripe.Price{ID: plan.ID}},
+			},
+		},
+		Metadata: map[string]string{
+			"plan": plan.ID,
+			"last_four": last4,
+			"card_type": cardType,
+		},
+	}
+	if plan.TrialDays > 0 {
+		subscription.Status = stripe.SubscriptionStatusTrialing
+		subscription.TrialStart = now.Unix()
+		subscription.TrialEnd = now.AddDate(0, 0, plan.TrialDays).Unix()
+		subscription.CurrentPeriodEnd = subscription.TrialEnd
+	}
+	f.Subscriptions[subscription.ID] = subscription
+	f.remember("subscriptions", idempotencyKey, subscription.ID)
+	return subscription, nil
+}
+
+//fim do periodo de cobranca a partir de start
+func fakePeriodEnd(start time.Time, interval string) time.Time {
+	switch interval {
+	case "day":
+		return start.AddDate(0, 0, 1)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "year":
+		return start.AddDate(1, 0, 0)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+//GetPrice retorna o preco registrado em Prices. Ids "price_" nao registrados existem como
+//precos recorrentes sem intervalo e valor definidos, assim os planos do seed funcionam em desenvolvimento
+func (f *FakeGateway) GetPrice(id string) (*stripe.Price, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if price, ok := f.Prices[id]; ok {
+		return price, nil
+	}
+
+	if !strings.HasPrefix(id, "price_") {
+		return nil, fakeNotFound(id)
+	}
+
+	return &stripe.Price{
+		ID: id,
+		Active: true,
+		Type: stripe.PriceTypeRecurring,
+		Recurring: &stripe.PriceRecurring{},
+	}, nil
+}
+
+func (f *FakeGateway) Refunds(pi string, amount int, idempotencyKey string) (*stripe.Refund, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if id, ok, err := f.replay("refunds", idempotencyKey); err != nil {
+		return nil, err
+	} else if ok {
+		return f.RefundsIssued[id], nil
+	}
+
+	if err := f.takeError(); err != nil {
+		return nil, err
+	}
+
+	paymentIntent, ok := f.PaymentIntents[pi]
+	if !ok {
+		return nil, fakeNotFound(pi)
+	}
+
+	if f.Refunded[pi] >= paymentIntent.Amount {
+		return nil, fakeError(stripe.ErrorCodeChargeAlreadyRefunded)
+	}
+	if f.Refunded[pi] + int64(amount) > paymentIntent.Amount {
+		return nil, fakeError(stripe.ErrorCodeAmountTooLarge)
+	}
+
+	f.Refunded[pi] += int64(amount)
+	refund := &stripe.Refund{
+		ID: f.newID("re"),
+		Amount: int64(amount),
+		PaymentIntent: paymentIntent,
+		Status: stripe.RefundStatusSucceeded,
+	}
+	f.RefundsIssued[refund.ID] = refund
+	f.remember("refunds", idempotencyKey, refund.ID)
+	return refund, nil
+}
+
+func (f *FakeGateway) CancelSubscription(subID, idempotencyKey string) error {
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok, err := f.replay("subscriptions.cancel", idempotencyKey); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	if err := f.takeError(); err != nil {
+		return err
+	}
+
+	subscription, ok := f.Subscriptions[subID]
+	if !ok {
+		return fakeNotFound(subID)
+	}
+	subscription.CancelAtPeriodEnd = true
+	f.remember("subscriptions.cancel", idempotencyKey, subscription.ID)
+	return nil
+}
+
+func (f *FakeGateway) GetSubscription(subID string) (*stripe.Subscription, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	subscription, ok := f.Subscriptions[subID]
+	if !ok {
+		return nil, fakeNotFound(subID)
+	}
+	return subscription, nil
+}
+
+//updateSubscription aplica fn na subscription com o mesmo tratamento de idempotency key e erros das outras operacoes
+func (f *FakeGateway) updateSubscription(op, subID, idempotencyKey string, fn func(s *stripe.Subscription)) (*stripe.Subscription, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if id, ok, err := f.replay(op, idempotencyKey); err != nil {
+		return nil, err
+	} else if ok {
+		return f.Subscriptions[id], nil
+	}
+
+	if err := f.takeError(); err != nil {
+		return nil, err
+	}
+
+	subscription, ok := f.Subscriptions[subID]
+	if !ok {
+		return nil, fakeNotFound(subID)
+	}
+	fn(subscription)
+	f.remember(op, idempotencyKey, subscription.ID)
+	return subscription, nil
+}
+
+//o fake nao calcula a proration, apenas troca o preco do item
+func (f *FakeGateway) ChangeSubscriptionPlan(subID string, plan Plan, idempotencyKey string) (*stripe.Subscription, error) {
+	return f.updateSubscription("subscriptions.change_plan", subID, idempotencyKey, func(s *stripe.Subscription) {
+		s.Items.Data[0].Price = &stripe.Price{ID: plan.ID}
+		s.Metadata["plan"] = plan.ID
+	})
+}
+
+func (f *FakeGateway) PauseSubscription(subID, idempotencyKey string) (*stripe.Subscription, error) {
+	return f.updateSubscription("subscriptions.pause", subID, idempotencyKey, func(s *stripe.Subscription) {
+		s.PauseCollection.Behavior = stripe.SubscriptionPauseCollectionBehaviorVoid
+	})
+}
+
+func (f *FakeGateway) ResumeSubscription(subID, idempotencyKey string) (*stripe.Subscription, error) {
+	return f.updateSubscription("subscriptions.resume", subID, idempotencyKey, func(s *stripe.Subscription) {
+		s.PauseCollection = stripe.SubscriptionPauseCollection{}
+	})
+}
+
+func (f *FakeGateway) ReactivateSubscription(subID, idempotencyKey string) (*stripe.Subscription, error) {
+	return f.updateSubscription("subscriptions.reactivate", subID, idempotencyKey, func(s *stripe.Subscription) {
+		s.CancelAtPeriodEnd = false
+	})
+}
+
+var _ PaymentGateway = (*FakeGateway)(nil)
@@ -0,0 +1,268 @@
+package cards
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestFakeGatewayDeclines(t *testing.T) {
+	tests := []struct {
+		name string
+		paymentMethod string
+		code stripe.ErrorCode
+		msg string
+	}{
+		{"card declined", "pm_card_chargeDeclined", stripe.ErrorCodeCardDeclined, "Your Card was declined"},
+		{"expired card", "pm_card_chargeDeclinedExpiredCard", stripe.ErrorCodeExpiredCard, "Your Card is expired"},
+		{"incorrect cvc", "pm_card_chargeDeclinedIncorrectCvc", stripe.ErrorCodeIncorrectCVC, "Incorrect CVC code"},
+		{"incorrect zip", "pm_card_incorrectZip", stripe.ErrorCodeIncorrectZip, "Incorrect Zip/Postal code"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFakeGateway()
+			_, msg, err := f.CreateCustomer(tt.paymentMethod, "jane@example.com", "")
+			var stripeErr *stripe.Error
+			if !errors.As(err, &stripeErr) || stripeErr.Code != tt.code {
+				t.Fatalf("CreateCustomer error = %v, want code %s", err, tt.code)
+			}
+			if msg != tt.msg {
+				t.Errorf("message = %q, want %q", msg, tt.msg)
+			}
+			if len(f.Customers) != 0 {
+				t.Error("a declined card created a customer")
+			}
+		})
+	}
+}
+
+func TestFakeGatewayExpiredCardMethod(t *testing.T) {
+	f := NewFakeGateway()
+
+	pm, err := f.GetPaymentMethod("pm_card_chargeDeclinedExpiredCard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(pm.Card.ExpYear) >= time.Now().Year() {
+		t.Errorf("expired card expires in %d", pm.Card.ExpYear)
+	}
+
+	pm, err = f.GetPaymentMethod("pm_card_visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(pm.Card.ExpYear) <= time.Now().Year() {
+		t.Errorf("valid card expires in %d", pm.Card.ExpYear)
+	}
+}
+
+func TestFakeGatewayDecline(t *testing.T) {
+	f := NewFakeGateway()
+	f.Decline(stripe.ErrorCodeBalanceInsufficient)
+
+	_, msg, err := f.CreatePaymentIntent("usd", 1000, nil, "")
+	if err == nil {
+		t.Fatal("the forced decline was ignored")
+	}
+	if msg != cardErrorMsg(stripe.ErrorCodeBalanceInsufficient) {
+		t.Errorf("message = %q", msg)
+	}
+
+	//o erro forcado vale so para a proxima chamada
+	pi, _, err := f.CreatePaymentIntent("usd", 1000, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.ID != "pi_fake_000001" {
+		t.Errorf("payment intent id = %s, want the first sequential id", pi.ID)
+	}
+}
+
+func TestFakeGatewayAmountLimits(t *testing.T) {
+	f := NewFakeGateway()
+
+	for _, tt := range []struct {
+		amount int
+		code stripe.ErrorCode
+	}{
+		{fakeMinAmount - 1, stripe.ErrorCodeAmountTooSmall},
+		{fakeMaxAmount + 1, stripe.ErrorCodeAmountTooLarge},
+	} {
+		_, _, err := f.CreatePaymentIntent("usd", tt.amount, nil, "")
+		var stripeErr *stripe.Error
+		if !errors.As(err, &stripeErr) || stripeErr.Code != tt.code {
+			t.Errorf("amount %d: error = %v, want code %s", tt.amount, err, tt.code)
+		}
+	}
+}
+
+func TestFakeGatewayIdempotencyKeys(t *testing.T) {
+	f := NewFakeGateway()
+
+	first, _, err := f.CreatePaymentIntent("usd", 1000, nil, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := f.CreatePaymentIntent("usd", 1000, nil, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID || len(f.PaymentIntents) != 1 {
+		t.Errorf("the same key created payment intents %s and %s", first.ID, again.ID)
+	}
+
+	//a mesma key em outra operacao nao pode repetir o resultado de outro tipo
+	_, err = f.Refunds(first.ID, 500, "key-1")
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) || stripeErr.Type != stripe.ErrorTypeIdempotency {
+		t.Fatalf("reusing the key for a refund: error = %v, want an idempotency error", err)
+	}
+	if f.Refunded[first.ID] != 0 {
+		t.Error("the refund ran with a key used by another operation")
+	}
+
+	refund, err := f.Refunds(first.ID, 500, "key-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := f.Refunds(first.ID, 500, "key-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ID != refund.ID || f.Refunded[first.ID] != 500 {
+		t.Errorf("the refund was repeated, refunded %d", f.Refunded[first.ID])
+	}
+
+	_, err = f.Refunds(first.ID, 600, "key-3")
+	if !errors.As(err, &stripeErr) || stripeErr.Code != stripe.ErrorCodeAmountTooLarge {
+		t.Errorf("refund over the charge: error = %v", err)
+	}
+}
+
+func TestFakeGatewaySubscriptionKeys(t *testing.T) {
+	f := NewFakeGateway()
+
+	cust, _, err := f.CreateCustomer("pm_card_visa", "jane@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := f.SubscribeToPlan(cust, Plan{ID: "price_bronze", Interval: "month"}, "jane@example.com", "4242", "visa", "sub-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//pause e resume com a mesma key sao operacoes diferentes
+	_, err = f.PauseSubscription(sub.ID, "change-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ResumeSubscription(sub.ID, "change-key")
+	if err == nil {
+		t.Fatal("resume replayed the pause response")
+	}
+	if err := f.CancelSubscription(sub.ID, "sub-key"); err == nil {
+		t.Fatal("cancel replayed the subscribe response")
+	}
+	if f.Subscriptions[sub.ID].CancelAtPeriodEnd {
+		t.Error("the subscription was cancelled with a reused key")
+	}
+}
+
+func TestFakeGatewaySharedState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.json")
+
+	api, err := NewFakeGatewayFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := NewFakeGatewayFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//o payment intent criado pela api é lido pelo web
+	pi, _, err := api.CreatePaymentIntent("usd", 2500, map[string]string{"widget_id": "1"}, "checkout-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := web.GetPaymentIntent(pi.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Amount != 2500 || got.Metadata["widget_id"] != "1" || got.Charges == nil || len(got.Charges.Data) != 1 {
+		t.Errorf("web read payment intent %+v", got)
+	}
+
+	//a key e a sequencia dos ids tambem sao compartilhadas
+	replayed, _, err := web.CreatePaymentIntent("usd", 2500, nil, "checkout-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ID != pi.ID {
+		t.Errorf("web created %s for a key used by the api", replayed.ID)
+	}
+
+	cust, _, err := api.CreateCustomer("pm_card_visa", "jane@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := api.SubscribeToPlan(cust, Plan{ID: "price_bronze", Interval: "month"}, "jane@example.com", "4242", "visa", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := web.CancelSubscription(sub.ID, "portal-cancel"); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := api.GetSubscription(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.CancelAtPeriodEnd || updated.Customer == nil || updated.Customer.ID != cust.ID {
+		t.Errorf("api read subscription %+v", updated)
+	}
+}
+
+func TestFakeGatewaySharedStateConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.json")
+
+	gateways := make([]*FakeGateway, 3)
+	for i := range gateways {
+		f, err := NewFakeGatewayFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gateways[i] = f
+	}
+
+	const perGateway = 10
+	var wg sync.WaitGroup
+	for _, f := range gateways {
+		wg.Add(1)
+		go func(f *FakeGateway) {
+			defer wg.Done()
+			for i := 0; i < perGateway; i++ {
+				if _, _, err := f.CreatePaymentIntent("usd", 1000, nil, ""); err != nil {
+					t.Error(err)
+				}
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	//nenhum processo sobrescreveu o que o outro gravou
+	f, err := NewFakeGatewayFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.GetPaymentIntent("pi_fake_000001"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.PaymentIntents); n != len(gateways)*perGateway {
+		t.Errorf("%d payment intents saved, want %d", n, len(gateways)*perGateway)
+	}
+}
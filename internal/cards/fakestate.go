@@ -0,0 +1,127 @@
+package cards
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//tempo maximo esperando o lock do arquivo do estado, e depois de quanto tempo um lock
+//deixado por um processo que caiu é removido
+const (
+	fakeLockWait = 5 * time.Second
+	fakeLockStale = 10 * time.Second
+)
+
+//NewFakeGatewayFile cria o FakeGateway com o estado no arquivo path. Cada chamada le o estado
+//gravado pelos outros processos e grava o resultado, a api e o web podem usar o mesmo arquivo
+func NewFakeGatewayFile(path string) (*FakeGateway, error) {
+	f := NewFakeGateway()
+	f.statePath = path
+
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	unlock()
+	return f, f.stateErr
+}
+
+//lock trava o gateway para uma chamada. Com o estado em arquivo trava tambem o arquivo
+//e carrega o estado, a funcao retornada grava o estado e libera os locks
+func (f *FakeGateway) lock() (func(), error) {
+	f.mu.Lock()
+	if f.statePath == "" {
+		return f.mu.Unlock, nil
+	}
+
+	if f.stateErr != nil {
+		err := f.stateErr
+		f.stateErr = nil
+		f.mu.Unlock()
+		return nil, err
+	}
+
+	unlockFile, err := lockFile(f.statePath + ".lock")
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+
+	err = f.loadState()
+	if err != nil {
+		unlockFile()
+		f.mu.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		f.stateErr = f.saveState()
+		unlockFile()
+		f.mu.Unlock()
+	}, nil
+}
+
+func (f *FakeGateway) loadState() error {
+	data, err := os.ReadFile(f.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		f.reset()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f.reset()
+	return json.Unmarshal(data, &f.fakeState)
+}
+
+//o estado é gravado num arquivo temporario e renomeado, o arquivo nunca fica pela metade
+func (f *FakeGateway) saveState() error {
+	data, err := json.Marshal(f.fakeState)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.statePath), ".fake-gateway-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.statePath)
+}
+
+//lockFile cria o arquivo de lock, outro processo espera ate ele ser removido
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(fakeLockWait)
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		//lock deixado por um processo que caiu no meio da chamada
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > fakeLockStale {
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("cards: timed out waiting for the fake gateway state lock " + path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -5,45 +5,222 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
-type Encryption struct {
-	Key []byte//secret key para encriptografar
+//versao do formato do dado criptografado: v1.<key id>.<base64 do nonce + dado + tag do AES-GCM>
+const Version = "v1"
+
+var (
+	ErrMalformed = errors.New("encryption: malformed ciphertext")
+	ErrUnsupportedVersion = errors.New("encryption: unsupported ciphertext version")
+	ErrUnknownKey = errors.New("encryption: unknown key id")
+	ErrTampered = errors.New("encryption: ciphertext could not be authenticated")
+)
+
+//KeyRing guarda as chaves pelo key id. O dado novo é criptografado com a chave primaria e as
+//outras chaves continuam abrindo o dado antigo ate a rotacao
+type KeyRing struct {
+	primary string
+	aeads map[string]cipher.AEAD
+	legacy []byte //chave do formato antigo AES-CFB, usada apenas na rotacao
 }
 
-func (e *Encryption) Encrypt(text string) (string, error) {
-	plainText := []byte(text)
+func validKeyID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
 
-	block,err := aes.NewCipher(e.Key)
-	if err != nil {
+//NewKeyRing cria o key ring, as chaves tem 16, 24 ou 32 bytes e primary precisa estar entre elas
+func NewKeyRing(primary string, keys map[string][]byte) (*KeyRing, error) {
+	k := &KeyRing{
+		primary: primary,
+		aeads: make(map[string]cipher.AEAD),
+	}
+	for id, key := range keys {
+		if !validKeyID(id) {
+			return nil, fmt.Errorf("encryption: invalid key id %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %s: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+	}
+	if _, ok := k.aeads[primary]; !ok {
+		return nil, fmt.Errorf("encryption: primary key %q is not in the key ring", primary)
+	}
+	return k, nil
+}
+
+//ParseKeyRing le as chaves no formato id:base64,id2:base64, a primeira é a primaria
+func ParseKeyRing(spec string) (*KeyRing, error) {
+	keys := make(map[string][]byte)
+	primary := ""
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("encryption: key %q must be id:base64", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %s: %w", id, err)
+		}
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("encryption: duplicated key id %q", id)
+		}
+		keys[id] = key
+		if primary == "" {
+			primary = id
+		}
+	}
+	if primary == "" {
+		return nil, errors.New("encryption: no keys")
+	}
+	return NewKeyRing(primary, keys)
+}
+
+//SetLegacyKey permite a rotacao abrir os dados gravados no formato antigo sem versao
+func (k *KeyRing) SetLegacyKey(key []byte) {
+	k.legacy = key
+}
+
+func (k *KeyRing) Primary() string {
+	return k.primary
+}
+
+//o cabecalho vai como dado adicional, trocar a versao ou o key id invalida a tag
+func header(keyID string) string {
+	return Version + "." + keyID
+}
+
+func (k *KeyRing) Encrypt(text string) (string, error) {
+	aead := k.aeads[k.primary]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(text)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
 
-	cipherText := make([]byte, aes.BlockSize+len(plainText))
-	iv := cipherText[:aes.BlockSize]
-	if _,err := io.ReadFull(rand.Reader, iv); err != nil {
+	h := header(k.primary)
+	sealed := aead.Seal(nonce, nonce, []byte(text), []byte(h))
+	return h + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+//parse separa versao, key id e dado, sem abrir o dado
+func parse(cryptoText string) (string, []byte, error) {
+	parts := strings.Split(cryptoText, ".")
+	if len(parts) != 3 {
+		return "", nil, ErrMalformed
+	}
+	if parts[0] != Version {
+		return "", nil, ErrUnsupportedVersion
+	}
+	if !validKeyID(parts[1]) {
+		return "", nil, ErrMalformed
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, ErrMalformed
+	}
+	return parts[1], sealed, nil
+}
+
+func (k *KeyRing) Decrypt(cryptoText string) (string, error) {
+	keyID, sealed, err := parse(cryptoText)
+	if err != nil {
 		return "", err
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], plainText)
-	//retorna o dado encryptografado em formato de string
-	return base64.URLEncoding.EncodeToString(cipherText), nil
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return "", ErrMalformed
+	}
+
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plainText, err := aead.Open(nil, nonce, data, []byte(header(keyID)))
+	if err != nil {
+		return "", ErrTampered
+	}
+	return string(plainText), nil
+}
+
+//KeyID é a chave usada no dado criptografado
+func (k *KeyRing) KeyID(cryptoText string) (string, error) {
+	keyID, _, err := parse(cryptoText)
+	return keyID, err
 }
 
-func (e *Encryption) Decrypt(cryptoText string) (string, error) {
-	// transformar de string para slice de byte
-	cipherText,_ := base64.URLEncoding.DecodeString(cryptoText)
-	
-	block,err := aes.NewCipher(e.Key)
+//Rotate criptografa de novo com a chave primaria o dado de outra chave ou do formato antigo.
+//Retorna false quando o dado ja esta na chave primaria
+func (k *KeyRing) Rotate(cryptoText string) (string, bool, error) {
+	var plainText string
+	if !strings.HasPrefix(cryptoText, Version+".") {
+		if k.legacy == nil {
+			return "", false, ErrUnsupportedVersion
+		}
+		text, err := decryptLegacy(k.legacy, cryptoText)
+		if err != nil {
+			return "", false, err
+		}
+		plainText = text
+	} else {
+		keyID, err := k.KeyID(cryptoText)
+		if err != nil {
+			return "", false, err
+		}
+		if keyID == k.primary {
+			return cryptoText, false, nil
+		}
+		text, err := k.Decrypt(cryptoText)
+		if err != nil {
+			return "", false, err
+		}
+		plainText = text
+	}
+
+	rotated, err := k.Encrypt(plainText)
+	if err != nil {
+		return "", false, err
+	}
+	return rotated, true, nil
+}
+
+//decryptLegacy abre o formato antigo AES-CFB, que nao tem autenticacao
+func decryptLegacy(key []byte, cryptoText string) (string, error) {
+	cipherText, err := base64.URLEncoding.DecodeString(cryptoText)
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	block,err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
 
 	if len(cipherText) < aes.BlockSize {
-		return "", err
+		return "", ErrMalformed
 	}
 
 	iv := cipherText[:aes.BlockSize]
@@ -52,5 +229,5 @@ func (e *Encryption) Decrypt(cryptoText string) (string, error) {
 	stream := cipher.NewCFBDecrypter(block, iv)
 	stream.XORKeyStream(cipherText, cipherText)
 
-	return fmt.Sprintf("%s", cipherText), nil
-}
\ No newline at end of file
+	return string(cipherText), nil
+}
@@ -0,0 +1,205 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+var (
+	testKey1 = []byte("0123456789abcdef0123456789abcdef")
+	testKey2 = []byte("fedcba9876543210")
+)
+
+func testRing(t *testing.T, primary string, keys map[string][]byte) *KeyRing {
+	t.Helper()
+	k, err := NewKeyRing(primary, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRoundTripProperty(t *testing.T) {
+	k := testRing(t, "k1", map[string][]byte{"k1": testKey1})
+
+	roundTrip := func(text string) bool {
+		sealed, err := k.Encrypt(text)
+		if err != nil {
+			return false
+		}
+		opened, err := k.Decrypt(sealed)
+		return err == nil && opened == text
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+
+	//o nonce é aleatorio, o mesmo texto nao gera o mesmo dado
+	a, _ := k.Encrypt("4242424242424242")
+	b, _ := k.Encrypt("4242424242424242")
+	if a == b {
+		t.Error("two encryptions of the same text are equal")
+	}
+}
+
+//trocar qualquer bit do dado, do nonce ou da tag nunca abre um texto
+func TestTamperDetectionProperty(t *testing.T) {
+	k := testRing(t, "k1", map[string][]byte{"k1": testKey1})
+
+	tampered := func(text string, pos uint16, bit uint8) bool {
+		sealed, err := k.Encrypt(text)
+		if err != nil {
+			return false
+		}
+		keyID, data, err := parse(sealed)
+		if err != nil {
+			return false
+		}
+		data[int(pos)%len(data)] ^= 1 << (bit % 8)
+		changed := header(keyID) + "." + base64.RawURLEncoding.EncodeToString(data)
+
+		_, err = k.Decrypt(changed)
+		return errors.Is(err, ErrTampered)
+	}
+	if err := quick.Check(tampered, nil); err != nil {
+		t.Error(err)
+	}
+
+	truncated := func(text string, cut uint16) bool {
+		sealed, _ := k.Encrypt(text)
+		_, data, _ := parse(sealed)
+		data = data[:int(cut)%len(data)]
+		_, err := k.Decrypt(header("k1") + "." + base64.RawURLEncoding.EncodeToString(data))
+		return errors.Is(err, ErrTampered) || errors.Is(err, ErrMalformed)
+	}
+	if err := quick.Check(truncated, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+//o key id faz parte do dado autenticado, o dado de uma chave nao é aberto como se fosse de outra
+func TestHeaderIsAuthenticated(t *testing.T) {
+	k := testRing(t, "k1", map[string][]byte{"k1": testKey1, "k2": testKey1})
+
+	sealed, _ := k.Encrypt("secret")
+	moved := strings.Replace(sealed, "v1.k1.", "v1.k2.", 1)
+	if _, err := k.Decrypt(moved); !errors.Is(err, ErrTampered) {
+		t.Errorf("changed key id: error = %v, want ErrTampered", err)
+	}
+
+	tests := []struct {
+		text string
+		want error
+	}{
+		{"plain", ErrMalformed},
+		{"v2.k1." + strings.SplitN(sealed, ".", 3)[2], ErrUnsupportedVersion},
+		{"v1.k9." + strings.SplitN(sealed, ".", 3)[2], ErrUnknownKey},
+		{"v1.k1.!!!", ErrMalformed},
+		{"v1.k1.AAAA", ErrMalformed},
+	}
+	for _, tt := range tests {
+		if _, err := k.Decrypt(tt.text); !errors.Is(err, tt.want) {
+			t.Errorf("Decrypt(%q) = %v, want %v", tt.text, err, tt.want)
+		}
+	}
+}
+
+//o dado da chave antiga abre enquanto ela esta no ring e, depois da rotacao, abre so com a nova
+func TestKeyRingRotationProperty(t *testing.T) {
+	old := testRing(t, "k1", map[string][]byte{"k1": testKey1})
+	both := testRing(t, "k2", map[string][]byte{"k1": testKey1, "k2": testKey2})
+	onlyNew := testRing(t, "k2", map[string][]byte{"k2": testKey2})
+
+	rotation := func(text string) bool {
+		sealed, err := old.Encrypt(text)
+		if err != nil {
+			return false
+		}
+		if opened, err := both.Decrypt(sealed); err != nil || opened != text {
+			return false
+		}
+		if _, err := onlyNew.Decrypt(sealed); !errors.Is(err, ErrUnknownKey) {
+			return false
+		}
+
+		rotated, changed, err := both.Rotate(sealed)
+		if err != nil || !changed {
+			return false
+		}
+		if id, _ := both.KeyID(rotated); id != "k2" {
+			return false
+		}
+		opened, err := onlyNew.Decrypt(rotated)
+		if err != nil || opened != text {
+			return false
+		}
+
+		//rodar de novo nao muda o dado
+		again, changed, err := both.Rotate(rotated)
+		return err == nil && !changed && again == rotated
+	}
+	if err := quick.Check(rotation, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+//encryptLegacy grava no formato antigo AES-CFB, como a versao anterior
+func encryptLegacy(t *testing.T, key []byte, text string) string {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText := make([]byte, aes.BlockSize+len(text))
+	iv := cipherText[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(cipherText[aes.BlockSize:], []byte(text))
+	return base64.URLEncoding.EncodeToString(cipherText)
+}
+
+func TestRotateLegacy(t *testing.T) {
+	legacyKey := []byte("legacy-secret-16")
+	k := testRing(t, "k1", map[string][]byte{"k1": testKey1})
+
+	legacy := encryptLegacy(t, legacyKey, "JBSWY3DPEHPK3PXP")
+	if _, _, err := k.Rotate(legacy); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("rotation without the legacy key: error = %v", err)
+	}
+
+	k.SetLegacyKey(legacyKey)
+	rotated, changed, err := k.Rotate(legacy)
+	if err != nil || !changed {
+		t.Fatalf("Rotate() = %v, %v", changed, err)
+	}
+	opened, err := k.Decrypt(rotated)
+	if err != nil || opened != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("rotated legacy value = %q, %v", opened, err)
+	}
+}
+
+func TestParseKeyRing(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(testKey1)
+	k2 := base64.StdEncoding.EncodeToString(testKey2)
+
+	k, err := ParseKeyRing("new:" + k2 + ", old:" + k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Primary() != "new" {
+		t.Errorf("primary = %s, want the first key", k.Primary())
+	}
+
+	for _, spec := range []string{"", "new", "new:" + k2 + ",new:" + k1, "new:not-base64!", "new:" + base64.StdEncoding.EncodeToString([]byte("short")), "bad.id:" + k1} {
+		if _, err := ParseKeyRing(spec); err == nil {
+			t.Errorf("ParseKeyRing(%q) accepted an invalid spec", spec)
+		}
+	}
+}
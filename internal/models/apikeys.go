@@ -0,0 +1,311 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//APIKeyPrefix inicia toda api key, o Auth da api usa para diferenciar dos tokens de login
+const APIKeyPrefix = "gsk_"
+
+//permissoes que podem ser dadas a uma api key, usuarios e api keys sao geridos apenas pelo admin logado
+var APIKeyScopes = []string{
+	PermSalesRead,
+	PermRefundCreate,
+	PermSubscriptionsManage,
+	PermTerminalCharge,
+	PermPlansRead,
+	PermPlansWrite,
+}
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	ErrAPIKeyExpired = errors.New("api key has expired")
+	ErrAPIKeyIPNotAllowed = errors.New("api key is not allowed from this address")
+)
+
+func ValidAPIKeyScope(scope string) bool {
+	for _, s := range APIKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//ValidAllowedIP aceita um ip ou uma rede em CIDR
+func ValidAllowedIP(entry string) bool {
+	if strings.Contains(entry, "/") {
+		_, _, err := net.ParseCIDR(entry)
+		return err == nil
+	}
+	return net.ParseIP(entry) != nil
+}
+
+//APIKey é uma chave de integracao entre servidores. A chave completa é APIKeyPrefix + Prefix + "_" + secret,
+//no banco fica o prefix, que identifica a chave na lista, e o hash do secret
+type APIKey struct {
+	ID int `json:"id"`
+	UserID int `json:"user_id"` //admin que criou a chave, a chave nunca tem mais acesso que o papel dele
+	UserName string `json:"user_name"`
+	Name string `json:"name"`
+	Prefix string `json:"prefix"`
+	Key string `json:"key,omitempty"` //apenas na criacao
+	Hash []byte `json:"-"`
+	Scopes []string `json:"scopes"`
+	AllowedIPs []string `json:"allowed_ips"` //vazio aceita qualquer ip
+	ExpiresAt time.Time `json:"expires_at"` //zero nao expira
+	LastUsedAt time.Time `json:"last_used_at"`
+	LastUsedIP string `json:"last_used_ip"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func randomString(n int) (string, error) {
+	randomBytes := make([]byte, n)
+	_,err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)), nil
+}
+
+//GenerateAPIKey cria a chave com prefix e secret aleatorios
+func GenerateAPIKey(userID int, name string, scopes, allowedIPs []string, expiresAt time.Time) (*APIKey, error) {
+	prefix, err := randomString(5)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomString(20)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	return &APIKey{
+		UserID: userID,
+		Name: name,
+		Prefix: prefix,
+		Key: APIKeyPrefix + prefix + "_" + secret,
+		Hash: hash[:],
+		Scopes: scopes,
+		AllowedIPs: allowedIPs,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+//Allows informa se a chave tem a permissao nos seus scopes
+func (k *APIKey) Allows(permission string) bool {
+	for _, s := range k.Scopes {
+		if s == permission {
+			return true
+		}
+	}
+	return false
+}
+
+//AllowsIP confere o ip do request com a allowlist da chave
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range k.AllowedIPs {
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err == nil && network.Contains(addr) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+const apiKeyColumns = `k.id, k.user_id, concat(u.first_name, ' ', u.last_name), k.name, k.prefix, k.secret_hash,
+	k.scopes, k.allowed_ips, k.expires_at, k.last_used_at, k.last_used_ip, k.created_at`
+
+func scanAPIKey(row scanner, k *APIKey) error {
+	var scopes string
+	var allowedIPs sql.NullString
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(
+		&k.ID,
+		&k.UserID,
+		&k.UserName,
+		&k.Name,
+		&k.Prefix,
+		&k.Hash,
+		&scopes,
+		&allowedIPs,
+		&expiresAt,
+		&lastUsedAt,
+		&k.LastUsedIP,
+		&k.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	k.Scopes = splitList(scopes)
+	k.AllowedIPs = splitList(allowedIPs.String)
+	if expiresAt.Valid {
+		k.ExpiresAt = expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = lastUsedAt.Time
+	}
+	return nil
+}
+
+func (m *DbModel) InsertAPIKey(k *APIKey) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var allowedIPs sql.NullString
+	if len(k.AllowedIPs) > 0 {
+		allowedIPs = sql.NullString{String: strings.Join(k.AllowedIPs, ","), Valid: true}
+	}
+
+	stmt := `
+		insert into api_keys (user_id, name, prefix, secret_hash, scopes, allowed_ips, expires_at, created_at, updated_at)
+		values(?,?,?,?,?,?,?,?,?)
+	`
+	result,err := m.DB.ExecContext(ctx, stmt,
+		k.UserID,
+		k.Name,
+		k.Prefix,
+		k.Hash,
+		strings.Join(k.Scopes, ","),
+		allowedIPs,
+		nullTime(k.ExpiresAt),
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	id,err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	k.ID = int(id)
+	k.CreatedAt = time.Now()
+	return nil
+}
+
+func (m *DbModel) GetAPIKeys() ([]*APIKey, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	keys := []*APIKey{}
+
+	query := `select ` + apiKeyColumns + ` from api_keys k inner join users u on (k.user_id = u.id) order by k.created_at desc`
+	rows,err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k APIKey
+		err = scanAPIKey(rows, &k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+
+	return keys, rows.Err()
+}
+
+//DeleteAPIKey revoga a chave, retorna sql.ErrNoRows se a chave nao existe
+func (m *DbModel) DeleteAPIKey(id int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	result,err := m.DB.ExecContext(ctx, `delete from api_keys where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+//AuthenticateAPIKey confere a chave completa recebida no request e o ip do cliente.
+//Retorna a chave e o admin dono dela, que da o papel usado nas permissoes
+func (m *DbModel) AuthenticateAPIKey(key, ip string) (*APIKey, *User, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	prefix, secret, found := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !found || prefix == "" || secret == "" {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	var k APIKey
+	query := `select ` + apiKeyColumns + ` from api_keys k inner join users u on (k.user_id = u.id) where k.prefix = ?`
+	err := scanAPIKey(m.DB.QueryRowContext(ctx, query, prefix), &k)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrInvalidAPIKey
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], k.Hash) != 1 {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	if !k.ExpiresAt.IsZero() && !time.Now().Before(k.ExpiresAt) {
+		return nil, nil, ErrAPIKeyExpired
+	}
+	if !k.AllowsIP(ip) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrAPIKeyIPNotAllowed, ip)
+	}
+
+	user, err := m.GetUser(k.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//last_used_at gravado no maximo uma vez por minuto, como nos tokens
+	_,err = m.DB.ExecContext(ctx, `
+		update api_keys set last_used_at = ?, last_used_ip = ? where id = ? and (last_used_at is null or last_used_at < ?)`,
+		time.Now(), ip, k.ID, time.Now().Add(-time.Minute))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &k, &user, nil
+}
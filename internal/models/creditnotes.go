@@ -0,0 +1,207 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//serie das notas de credito, numeradas a parte das invoices
+const CreditNoteSeries = "CN"
+
+type CreditNote struct {
+	ID int `json:"id"`
+	InvoiceID int `json:"invoice_id"`
+	InvoiceNumber string `json:"invoice_number"`
+	RefundID int `json:"refund_id"`
+	Year int `json:"year"`
+	Sequence int `json:"sequence"`
+	Number string `json:"number"`
+	IssuedAt time.Time `json:"issued_at"`
+	Currency string `json:"currency"`
+	Amount int `json:"amount"`
+	Reason string `json:"reason"`
+	StorageLocation string `json:"storage_location"`
+	DownloadURL string `json:"download_url,omitempty"`
+	SentAt time.Time `json:"sent_at"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+//CreditTooLargeError é retornado quando as notas de credito passariam do total da invoice
+type CreditTooLargeError struct {
+	Requested int
+	Creditable int
+}
+
+func (e *CreditTooLargeError) Error() string {
+	return fmt.Sprintf("credit note of %d is more than the %d left to credit on the invoice", e.Requested, e.Creditable)
+}
+
+const creditNoteColumns = `
+	c.id, c.invoice_id, i.number, c.refund_id, c.year, c.sequence, c.number, c.issued_at, c.currency, c.amount,
+	c.reason, coalesce(c.storage_location, ''), c.sent_at, c.created_at, c.updated_at`
+
+func scanCreditNote(row scanner) (CreditNote, error) {
+	var c CreditNote
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&c.ID,
+		&c.InvoiceID,
+		&c.InvoiceNumber,
+		&c.RefundID,
+		&c.Year,
+		&c.Sequence,
+		&c.Number,
+		&c.IssuedAt,
+		&c.Currency,
+		&c.Amount,
+		&c.Reason,
+		&c.StorageLocation,
+		&sentAt,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if sentAt.Valid {
+		c.SentAt = sentAt.Time
+	}
+	return c, err
+}
+
+//IssueCreditNote emite a nota de credito do refund contra a invoice, com o proximo numero
+//da serie no ano. A invoice fica travada ate o fim, a soma das notas nunca passa do total
+//e quando chega no total a invoice vai para credited. Se o refund ja tem nota ela é retornada
+func (m *DbModel) IssueCreditNote(note CreditNote) (CreditNote, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		var total int
+		var status string
+		row := tx.DB.QueryRowContext(ctx, `select number, total, status from invoices where id = ? for update`, note.InvoiceID)
+		err := row.Scan(&note.InvoiceNumber, &total, &status)
+		if err != nil {
+			return err
+		}
+
+		existing, err := scanCreditNote(tx.DB.QueryRowContext(ctx, `
+			select `+creditNoteColumns+` from credit_notes c
+			left join invoices i on (c.invoice_id = i.id)
+			where c.refund_id = ?`, note.RefundID))
+		if err == nil {
+			note = existing
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if status == InvoiceVoided {
+			return ErrInvoiceStatus
+		}
+
+		var credited int
+		row = tx.DB.QueryRowContext(ctx, `select coalesce(sum(amount), 0) from credit_notes where invoice_id = ?`, note.InvoiceID)
+		err = row.Scan(&credited)
+		if err != nil {
+			return err
+		}
+		if note.Amount <= 0 || credited + note.Amount > total {
+			return &CreditTooLargeError{Requested: note.Amount, Creditable: total - credited}
+		}
+
+		if note.IssuedAt.IsZero() {
+			note.IssuedAt = time.Now()
+		}
+		note.Year = note.IssuedAt.Year()
+		note.Sequence, err = tx.nextSequenceNumber(ctx, CreditNoteSeries, note.Year)
+		if err != nil {
+			return err
+		}
+		note.Number = FormatInvoiceNumber(CreditNoteSeries, note.Year, note.Sequence)
+
+		result,err := tx.DB.ExecContext(ctx, `
+			insert into credit_notes (invoice_id, refund_id, year, sequence, number, issued_at, currency, amount, reason,
+				created_at, updated_at)
+			values(?,?,?,?,?,?,?,?,?,?,?)`,
+			note.InvoiceID, note.RefundID, note.Year, note.Sequence, note.Number, note.IssuedAt, note.Currency,
+			note.Amount, note.Reason, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+		id,err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		note.ID = int(id)
+
+		if credited + note.Amount == total {
+			return tx.SetInvoiceStatus(note.InvoiceID, InvoiceCredited)
+		}
+		return nil
+	})
+	if err != nil {
+		return CreditNote{}, err
+	}
+	return note, nil
+}
+
+func (m *DbModel) GetCreditNote(id int) (CreditNote, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	return scanCreditNote(m.DB.QueryRowContext(ctx, `
+		select `+creditNoteColumns+` from credit_notes c
+		left join invoices i on (c.invoice_id = i.id)
+		where c.id = ?`, id))
+}
+
+//GetCreditNotesForOrder lista as notas de credito das invoices da order
+func (m *DbModel) GetCreditNotesForOrder(orderID int) ([]CreditNote, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	notes := []CreditNote{}
+
+	rows,err := m.DB.QueryContext(ctx, `
+		select `+creditNoteColumns+` from credit_notes c
+		left join invoices i on (c.invoice_id = i.id)
+		where i.order_id = ?
+		order by c.issued_at, c.id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanCreditNote(rows)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func (m *DbModel) SetCreditNoteStorage(id int, location string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `update credit_notes set storage_location = ?, updated_at = ? where id = ?`,
+		location, time.Now(), id)
+	return err
+}
+
+func (m *DbModel) MarkCreditNoteSent(id int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `update credit_notes set sent_at = ?, updated_at = ? where id = ?`,
+		time.Now(), time.Now(), id)
+	return err
+}
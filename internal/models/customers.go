@@ -0,0 +1,311 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+//emails sao comparados sem diferenca de maiusculas e espacos
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+//GetCustomerByEmail retorna o customer mais antigo com o email
+func (m *DbModel) GetCustomerByEmail(email string) (Customer, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var c Customer
+
+	query := `
+		select id, first_name, last_name, email, stripe_customer_id, created_at, updated_at
+		from customers where email = ? order by id limit 1
+	`
+	row := m.DB.QueryRowContext(ctx, query, normalizeEmail(email))
+	err := row.Scan(
+		&c.ID,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.StripeCustomerID,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func (m *DbModel) GetCustomer(id int) (Customer, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var c Customer
+
+	query := `
+		select id, first_name, last_name, email, stripe_customer_id, created_at, updated_at
+		from customers where id = ?
+	`
+	row := m.DB.QueryRowContext(ctx, query, id)
+	err := row.Scan(
+		&c.ID,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.StripeCustomerID,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+//SaveCustomer reutiliza o customer com o mesmo email ou cria um novo. Nome e stripe customer id
+//informados atualizam o registro existente. Retorna o id do customer
+func (m *DbModel) SaveCustomer(customer Customer) (int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	//o indice unico do email decide entre insert e update em um so comando, duas compras ao mesmo
+	//tempo nao criam dois customers. last_insert_id(id) devolve o id do customer que ja existia
+	stmt := `
+		insert into customers (first_name, last_name, email, stripe_customer_id, created_at, updated_at)
+		values(?,?,?,?,?,?)
+		on duplicate key update
+			id = last_insert_id(id),
+			first_name = if(values(first_name) <> '', values(first_name), first_name),
+			last_name = if(values(last_name) <> '', values(last_name), last_name),
+			stripe_customer_id = if(values(stripe_customer_id) <> '', values(stripe_customer_id), stripe_customer_id),
+			updated_at = values(updated_at)
+	`
+	result,err := m.DB.ExecContext(ctx, stmt,
+		customer.FirstName,
+		customer.LastName,
+		normalizeEmail(customer.Email),
+		customer.StripeCustomerID,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	id,err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+//guarda o id do customer no stripe para reutilizar nas proximas subscriptions
+func (m *DbModel) SetStripeCustomerID(customerID int, stripeCustomerID string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `update customers set stripe_customer_id = ?, updated_at = ? where id = ?`
+	_,err := m.DB.ExecContext(ctx, stmt, stripeCustomerID, time.Now(), customerID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//resultado da juncao dos customers de um email
+type CustomerMerge struct {
+	Email string
+	KeptID int
+	MergedIDs []int
+}
+
+//MergeDuplicateCustomers junta os customers com o mesmo email no mais antigo, as orders e
+//subscriptions dos duplicados passam para ele. O stripe customer id do mais recente é mantido se o mais antigo nao tiver.
+//Com dryRun apenas lista o que seria feito
+func (m *DbModel) MergeDuplicateCustomers(dryRun bool) ([]CustomerMerge, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 60 * time.Second)
+	defer cancel()
+
+	rows,err := m.DB.QueryContext(ctx, `
+		select lower(trim(email)) from customers
+		group by lower(trim(email))
+		having count(*) > 1`)
+	if err != nil {
+		return nil, err
+	}
+	var emails []string
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var merges []CustomerMerge
+	for _, email := range emails {
+		var merge CustomerMerge
+
+		//cada email em sua propria transacao, um erro nao desfaz os emails ja juntados
+		err = m.WithTx(ctx, func(tx *DbModel) error {
+			merge, err = tx.mergeCustomersWithEmail(ctx, email, dryRun)
+			return err
+		})
+		if err != nil {
+			return merges, err
+		}
+		merges = append(merges, merge)
+	}
+
+	return merges, nil
+}
+
+func (m *DbModel) mergeCustomersWithEmail(ctx context.Context, email string, dryRun bool) (CustomerMerge, error) {
+	merge := CustomerMerge{Email: email}
+
+	rows,err := m.DB.QueryContext(ctx, `
+		select id, stripe_customer_id from customers
+		where lower(trim(email)) = ?
+		order by id
+		for update`, email)
+	if err != nil {
+		return merge, err
+	}
+
+	stripeCustomerID := ""
+	for rows.Next() {
+		var id int
+		var stripeID string
+		err = rows.Scan(&id, &stripeID)
+		if err != nil {
+			rows.Close()
+			return merge, err
+		}
+		if merge.KeptID == 0 {
+			merge.KeptID = id
+		} else {
+			merge.MergedIDs = append(merge.MergedIDs, id)
+		}
+		//o mais recente é o que o stripe usou por ultimo
+		if stripeID != "" {
+			stripeCustomerID = stripeID
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return merge, err
+	}
+
+	if dryRun {
+		return merge, nil
+	}
+
+	for _, id := range merge.MergedIDs {
+		_,err = m.DB.ExecContext(ctx, `update orders set customer_id = ?, updated_at = ? where customer_id = ?`,
+			merge.KeptID, time.Now(), id)
+		if err != nil {
+			return merge, err
+		}
+		//a fk das subscriptions apaga em cascata, elas precisam sair do duplicado antes do delete
+		_,err = m.DB.ExecContext(ctx, `update subscriptions set customer_id = ?, updated_at = ? where customer_id = ?`,
+			merge.KeptID, time.Now(), id)
+		if err != nil {
+			return merge, err
+		}
+		_,err = m.DB.ExecContext(ctx, `delete from customers where id = ?`, id)
+		if err != nil {
+			return merge, err
+		}
+	}
+
+	_,err = m.DB.ExecContext(ctx, `
+		update customers set email = ?, stripe_customer_id = if(stripe_customer_id <> '', stripe_customer_id, ?), updated_at = ?
+		where id = ?`,
+		email, stripeCustomerID, time.Now(), merge.KeptID)
+	if err != nil {
+		return merge, err
+	}
+
+	return merge, nil
+}
+
+//GetOrdersForCustomer lista as compras (recurring false) ou as subscriptions (recurring true) do customer
+func (m *DbModel) GetOrdersForCustomer(customerID int, recurring bool) ([]*Order, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var orders []*Order
+
+	query := `
+		select
+			o.id, o.widget_id, o.transaction_id, o.customer_id,
+			o.status_id, o.quantity, o.amount, o.created_at,
+			o.updated_at, w.id, w.name, w.is_recurring, t.id, t.amount, t.currency,
+			t.last_four, t.expiry_month, t.expiry_year, t.payment_intent,
+			t.bank_return_code
+		from
+			orders o
+			left join widgets w on (o.widget_id = w.id)
+			left join transactions t on (o.transaction_id = t.id)
+		where
+			o.customer_id = ? and w.is_recurring = ?
+		order by
+			o.created_at desc
+	`
+
+	rows,err := m.DB.QueryContext(ctx, query, customerID, recurring)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Order
+		err = rows.Scan(
+			&o.ID,
+			&o.WidgetID,
+			&o.TransactionID,
+			&o.CustomerID,
+			&o.StatusID,
+			&o.Quantity,
+			&o.Amount,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+			&o.Widget.ID,
+			&o.Widget.Name,
+			&o.Widget.IsRecurring,
+			&o.Transaction.ID,
+			&o.Transaction.Amount,
+			&o.Transaction.Currency,
+			&o.Transaction.LastFour,
+			&o.Transaction.ExpiryMonth,
+			&o.Transaction.ExpiryYear,
+			&o.Transaction.PaymentIntent,
+			&o.Transaction.BankReturnCode,
+		)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, &o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, o := range orders {
+		o.Items, err = m.GetOrderItems(o.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return orders, nil
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//resposta salva de uma request com Idempotency-Key
+type IdempotencyRecord struct {
+	ID int `json:"id"`
+	Caller string `json:"caller"` //usuario, api key ou ip que enviou a key
+	Key string `json:"idempotency_key"`
+	RequestPath string `json:"request_path"`
+	RequestHash string `json:"request_hash"`
+	StatusCode int `json:"status_code"`
+	ResponseBody string `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+//a request ainda esta sendo processada quando o status é 0
+func (r IdempotencyRecord) Completed() bool {
+	return r.StatusCode != 0
+}
+
+//codigo de erro do mysql para chave unica duplicada
+const mysqlDuplicateEntry = 1062
+
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+//ReserveIdempotencyKey registra a key do caller antes de executar a request. Retorna true se a key é nova,
+//senao retorna o registro existente para a resposta ser repetida. A mesma key de outro caller é outra key
+func (m *DbModel) ReserveIdempotencyKey(caller, key, path, hash string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var rec IdempotencyRecord
+
+	//keys expiradas podem ser reutilizadas
+	_,err := m.DB.ExecContext(ctx, `delete from idempotency_keys where expires_at <= ?`, time.Now())
+	if err != nil {
+		return rec, false, err
+	}
+
+	stmt := `
+		insert into idempotency_keys (caller, idempotency_key, request_path, request_hash, status_code, expires_at,
+			created_at, updated_at)
+		values(?,?,?,?,0,?,?,?)
+	`
+	_,err = m.DB.ExecContext(ctx, stmt, caller, key, path, hash, time.Now().Add(ttl), time.Now(), time.Now())
+	if err == nil {
+		return rec, true, nil
+	}
+	if !isDuplicateEntry(err) {
+		return rec, false, err
+	}
+
+	query := `
+		select id, caller, idempotency_key, request_path, request_hash, status_code, coalesce(response_body, ''),
+			expires_at, created_at, updated_at
+		from idempotency_keys
+		where caller = ? and idempotency_key = ? and request_path = ?
+	`
+	row := m.DB.QueryRowContext(ctx, query, caller, key, path)
+	err = row.Scan(
+		&rec.ID,
+		&rec.Caller,
+		&rec.Key,
+		&rec.RequestPath,
+		&rec.RequestHash,
+		&rec.StatusCode,
+		&rec.ResponseBody,
+		&rec.ExpiresAt,
+		&rec.CreatedAt,
+		&rec.UpdatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		//removida entre o insert e o select, a request pode seguir
+		return rec, false, errors.New("idempotency key expired, retry the request")
+	} else if err != nil {
+		return rec, false, err
+	}
+
+	return rec, false, nil
+}
+
+//salva a resposta da request para ser repetida nas proximas tentativas
+func (m *DbModel) SaveIdempotentResponse(caller, key, path string, statusCode int, body []byte) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `
+		update idempotency_keys set status_code = ?, response_body = ?, updated_at = ?
+		where caller = ? and idempotency_key = ? and request_path = ?
+	`
+	_,err := m.DB.ExecContext(ctx, stmt, statusCode, string(body), time.Now(), caller, key, path)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//libera a key quando a request falhou no servidor, permitindo uma nova tentativa
+func (m *DbModel) ReleaseIdempotencyKey(caller, key, path string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `delete from idempotency_keys where caller = ? and idempotency_key = ? and request_path = ?`,
+		caller, key, path)
+	if err != nil {
+		return err
+	}
+	return nil
+}
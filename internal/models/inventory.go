@@ -0,0 +1,354 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//status de uma reserva de estoque
+const (
+	ReservationReserved = "reserved"
+	ReservationCommitted = "committed"
+	ReservationReleased = "released"
+	//pago depois da reserva vencer sem estoque livre para cobrir, a baixa foi so do que havia
+	ReservationBackordered = "backordered"
+)
+
+//ErrTooManyReservations é retornado quando o cliente ja tem o maximo de reservas em aberto,
+//sem o limite um cliente anonimo conseguiria prender todo o estoque
+var ErrTooManyReservations = errors.New("too many pending checkouts, please finish or wait for one of them to expire")
+
+//OutOfStockError é retornado quando nao ha estoque livre para reservar um widget
+type OutOfStockError struct {
+	WidgetID int
+	Name string
+	Available int
+}
+
+func (e *OutOfStockError) Error() string {
+	if e.Available > 0 {
+		return fmt.Sprintf("Sorry, only %d of %s left in stock", e.Available, e.Name)
+	}
+	return fmt.Sprintf("Sorry, %s is out of stock", e.Name)
+}
+
+//ReserveInventory separa o estoque dos itens antes do payment intent ser criado.
+//As linhas dos widgets ficam travadas ate o commit, duas compras da ultima unidade
+//ao mesmo tempo nao conseguem reservar a mesma unidade. O ip pode ter no maximo maxActive
+//reservas em aberto. Retorna a chave da reserva
+func (m *DbModel) ReserveInventory(items []OrderItem, clientIP string, maxActive int, ttl time.Duration) (string, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	b := make([]byte, 16)
+	_,err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+
+	//reservas vencidas voltam para o estoque livre
+	_,err = m.DB.ExecContext(ctx, `
+		update inventory_reservations set status = ?, updated_at = ?
+		where status = ? and expires_at <= ?`,
+		ReservationReleased, time.Now(), ReservationReserved, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	var active int
+	row := m.DB.QueryRowContext(ctx, `
+		select count(distinct reservation_key) from inventory_reservations
+		where client_ip = ? and status = ? and expires_at > ?`,
+		clientIP, ReservationReserved, time.Now())
+	err = row.Scan(&active)
+	if err != nil {
+		return "", err
+	}
+	if active >= maxActive {
+		return "", ErrTooManyReservations
+	}
+
+	//travar os widgets sempre na mesma ordem para evitar deadlock
+	sorted := make([]OrderItem, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].WidgetID < sorted[j].WidgetID })
+
+	err = m.WithTx(ctx, func(tx *DbModel) error {
+		for _, item := range sorted {
+			var name string
+			var level, reserved int
+
+			row := tx.DB.QueryRowContext(ctx, `select name, inventory_level from widgets where id = ? for update`, item.WidgetID)
+			err := row.Scan(&name, &level)
+			if err != nil {
+				return err
+			}
+
+			row = tx.DB.QueryRowContext(ctx, `
+				select coalesce(sum(quantity), 0) from inventory_reservations
+				where widget_id = ? and status = ? and expires_at > ?`,
+				item.WidgetID, ReservationReserved, time.Now())
+			err = row.Scan(&reserved)
+			if err != nil {
+				return err
+			}
+
+			available := level - reserved
+			if available < item.Quantity {
+				if available < 0 {
+					available = 0
+				}
+				return &OutOfStockError{WidgetID: item.WidgetID, Name: name, Available: available}
+			}
+
+			_,err = tx.DB.ExecContext(ctx, `
+				insert into inventory_reservations (reservation_key, client_ip, widget_id, quantity, status, expires_at, created_at, updated_at)
+				values(?,?,?,?,?,?,?,?)`,
+				key, clientIP, item.WidgetID, item.Quantity, ReservationReserved, time.Now().Add(ttl), time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+//liga a reserva ao payment intent criado para ela
+func (m *DbModel) AttachReservation(key, paymentIntent string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `update inventory_reservations set payment_intent = ?, updated_at = ? where reservation_key = ?`
+	_,err := m.DB.ExecContext(ctx, stmt, paymentIntent, time.Now(), key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//devolve ao estoque livre uma reserva que nao chegou a ter payment intent
+func (m *DbModel) ReleaseReservation(key string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `update inventory_reservations set status = ?, updated_at = ? where reservation_key = ? and status = ?`
+	_,err := m.DB.ExecContext(ctx, stmt, ReservationReleased, time.Now(), key, ReservationReserved)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//pagamento falhou ou foi cancelado, a reserva volta para o estoque livre
+func (m *DbModel) ReleaseReservationsForPaymentIntent(paymentIntent string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `update inventory_reservations set status = ?, updated_at = ? where payment_intent = ? and status = ?`
+	_,err := m.DB.ExecContext(ctx, stmt, ReservationReleased, time.Now(), paymentIntent, ReservationReserved)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//CommitReservations baixa do estoque as reservas do payment intent, é chamado por InsertOrder
+//dentro da transacao da order. O pagamento ja foi feito, entao a order nunca é recusada aqui:
+//uma reserva vencida so baixa o estoque que ainda esta livre e o que faltar fica como backordered.
+//O estoque nunca fica negativo. O que foi baixado fica em order_items.stock_quantity da order,
+//o refund devolve so isso
+func (m *DbModel) CommitReservations(orderID int, paymentIntent string) error {
+	if paymentIntent == "" {
+		return nil
+	}
+
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	rows,err := m.DB.QueryContext(ctx, `
+		select id, widget_id, quantity, status, expires_at from inventory_reservations
+		where payment_intent = ? and status in (?, ?)
+		order by widget_id
+		for update`,
+		paymentIntent, ReservationReserved, ReservationReleased)
+	if err != nil {
+		return err
+	}
+
+	type reservation struct {
+		id, widgetID, quantity int
+		status string
+		expiresAt time.Time
+	}
+	var reservations []reservation
+	for rows.Next() {
+		var r reservation
+		err = rows.Scan(&r.id, &r.widgetID, &r.quantity, &r.status, &r.expiresAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		reservations = append(reservations, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range reservations {
+		var level int
+		row := m.DB.QueryRowContext(ctx, `select inventory_level from widgets where id = ? for update`, r.widgetID)
+		err = row.Scan(&level)
+		if err != nil {
+			return err
+		}
+
+		//a reserva em dia ja tem o estoque separado, a vencida disputa o estoque livre
+		//com as reservas em aberto dos outros clientes
+		free := level
+		if r.status != ReservationReserved || !r.expiresAt.After(time.Now()) {
+			var reserved int
+			row = m.DB.QueryRowContext(ctx, `
+				select coalesce(sum(quantity), 0) from inventory_reservations
+				where widget_id = ? and status = ? and expires_at > ? and id <> ?`,
+				r.widgetID, ReservationReserved, time.Now(), r.id)
+			err = row.Scan(&reserved)
+			if err != nil {
+				return err
+			}
+			free = level - reserved
+		}
+
+		taken := r.quantity
+		status := ReservationCommitted
+		if free < taken {
+			taken = free
+			if taken < 0 {
+				taken = 0
+			}
+			status = ReservationBackordered
+		}
+
+		_,err = m.DB.ExecContext(ctx, `update widgets set inventory_level = inventory_level - ?, updated_at = ? where id = ?`,
+			taken, time.Now(), r.widgetID)
+		if err != nil {
+			return err
+		}
+		_,err = m.DB.ExecContext(ctx, `update inventory_reservations set status = ?, updated_at = ? where id = ?`,
+			status, time.Now(), r.id)
+		if err != nil {
+			return err
+		}
+		_,err = m.DB.ExecContext(ctx, `
+			update order_items set stock_quantity = stock_quantity + ?, updated_at = ? where order_id = ? and widget_id = ?`,
+			taken, time.Now(), orderID, r.widgetID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//RefundOrder marca a order como refunded e devolve ao estoque o que a order baixou dele,
+//uma order ja refunded nao é devolvida de novo
+func (m *DbModel) RefundOrder(orderID int) error {
+	return m.refundOrders(`select id from orders where id = ? and status_id <> 2 for update`, orderID)
+}
+
+//RefundOrdersByTransactionID faz o refund das orders pagas pela transaction
+func (m *DbModel) RefundOrdersByTransactionID(transactionID int) error {
+	return m.refundOrders(`select id from orders where transaction_id = ? and status_id <> 2 for update`, transactionID)
+}
+
+func (m *DbModel) refundOrders(query string, arg int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DbModel) error {
+		rows,err := tx.DB.QueryContext(ctx, query, arg)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			//status 2 refunded
+			_,err = tx.DB.ExecContext(ctx, `update orders set status_id = 2, updated_at = ? where id = ?`, time.Now(), id)
+			if err != nil {
+				return err
+			}
+
+			err = tx.restockOrder(ctx, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//restockOrder devolve ao estoque o stock_quantity dos itens da order, a quantidade que
+//CommitReservations baixou. Um item backordered baixou menos que a quantidade vendida
+func (m *DbModel) restockOrder(ctx context.Context, orderID int) error {
+	rows,err := m.DB.QueryContext(ctx, `
+		select id, widget_id, stock_quantity from order_items where order_id = ? and stock_quantity > 0`, orderID)
+	if err != nil {
+		return err
+	}
+
+	type item struct {
+		id, widgetID, quantity int
+	}
+	var items []item
+	for rows.Next() {
+		var i item
+		err = rows.Scan(&i.id, &i.widgetID, &i.quantity)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, i)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, i := range items {
+		_,err = m.DB.ExecContext(ctx, `update widgets set inventory_level = inventory_level + ?, updated_at = ? where id = ?`,
+			i.quantity, time.Now(), i.widgetID)
+		if err != nil {
+			return err
+		}
+		_,err = m.DB.ExecContext(ctx, `update order_items set stock_quantity = 0, updated_at = ? where id = ?`, time.Now(), i.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newMockModel(t *testing.T) (*DbModel, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &DbModel{DB: db}, mock
+}
+
+func q(query string) string {
+	return regexp.QuoteMeta(query)
+}
+
+//reserva vencida paga quando so resta uma unidade livre das tres vendidas
+func TestCommitReservationsBackordered(t *testing.T) {
+	m, mock := newMockModel(t)
+
+	mock.ExpectQuery(q(`select id, widget_id, quantity, status, expires_at from inventory_reservations`)).
+		WithArgs("pi_late", ReservationReserved, ReservationReleased).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "widget_id", "quantity", "status", "expires_at"}).
+			AddRow(5, 1, 3, ReservationReleased, time.Now().Add(-time.Minute)))
+	mock.ExpectQuery(q(`select inventory_level from widgets where id = ? for update`)).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"inventory_level"}).AddRow(3))
+	//duas unidades estao reservadas por outro cliente
+	mock.ExpectQuery(q(`select coalesce(sum(quantity), 0) from inventory_reservations`)).
+		WithArgs(1, ReservationReserved, sqlmock.AnyArg(), 5).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(2))
+	mock.ExpectExec(q(`update widgets set inventory_level = inventory_level - ?`)).
+		WithArgs(1, sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`update inventory_reservations set status = ?`)).
+		WithArgs(ReservationBackordered, sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`update order_items set stock_quantity = stock_quantity + ?`)).
+		WithArgs(1, sqlmock.AnyArg(), 42, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := m.CommitReservations(42, "pi_late"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCommitReservationsInTime(t *testing.T) {
+	m, mock := newMockModel(t)
+
+	mock.ExpectQuery(q(`select id, widget_id, quantity, status, expires_at from inventory_reservations`)).
+		WithArgs("pi_ok", ReservationReserved, ReservationReleased).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "widget_id", "quantity", "status", "expires_at"}).
+			AddRow(6, 2, 2, ReservationReserved, time.Now().Add(time.Minute)))
+	mock.ExpectQuery(q(`select inventory_level from widgets where id = ? for update`)).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"inventory_level"}).AddRow(2))
+	mock.ExpectExec(q(`update widgets set inventory_level = inventory_level - ?`)).
+		WithArgs(2, sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`update inventory_reservations set status = ?`)).
+		WithArgs(ReservationCommitted, sqlmock.AnyArg(), 6).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`update order_items set stock_quantity = stock_quantity + ?`)).
+		WithArgs(2, sqlmock.AnyArg(), 43, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := m.CommitReservations(43, "pi_ok"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+//o refund da order backordered devolve a unidade baixada, nao as tres vendidas
+func TestRefundBackorderedOrder(t *testing.T) {
+	m, mock := newMockModel(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(q(`select id from orders where id = ? and status_id <> 2 for update`)).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+	mock.ExpectExec(q(`update orders set status_id = 2`)).
+		WithArgs(sqlmock.AnyArg(), 42).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(q(`select id, widget_id, stock_quantity from order_items where order_id = ? and stock_quantity > 0`)).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "widget_id", "stock_quantity"}).AddRow(77, 1, 1))
+	mock.ExpectExec(q(`update widgets set inventory_level = inventory_level + ?`)).
+		WithArgs(1, sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`update order_items set stock_quantity = 0`)).
+		WithArgs(sqlmock.AnyArg(), 77).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := m.RefundOrder(42); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+//order sem nada baixado do estoque, como a de um plano, nao devolve nada
+func TestRefundOrderWithoutStock(t *testing.T) {
+	m, mock := newMockModel(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(q(`select id from orders where id = ? and status_id <> 2 for update`)).
+		WithArgs(50).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(50))
+	mock.ExpectExec(q(`update orders set status_id = 2`)).
+		WithArgs(sqlmock.AnyArg(), 50).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(q(`select id, widget_id, stock_quantity from order_items`)).
+		WithArgs(50).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "widget_id", "stock_quantity"}))
+	mock.ExpectCommit()
+
+	if err := m.RefundOrder(50); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
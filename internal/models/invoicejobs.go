@@ -0,0 +1,222 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+//status dos jobs de invoice. pending espera a entrega, dead esgotou as tentativas e
+//so volta com o re-drive do admin
+const (
+	InvoiceJobPending = "pending"
+	InvoiceJobDelivered = "delivered"
+	InvoiceJobDead = "dead"
+)
+
+//tentativas de entrega antes do job ir para dead, a espera dobra a cada falha
+const (
+	InvoiceJobMaxAttempts = 8
+	invoiceJobBaseDelay = 30 * time.Second
+	invoiceJobMaxDelay = time.Hour
+)
+
+type InvoiceJob struct {
+	ID int `json:"id"`
+	OrderID int `json:"order_id"`
+	RefundID int `json:"refund_id"` //jobs de nota de credito, 0 nos jobs de invoice
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError string `json:"last_error"`
+	DeliveredAt time.Time `json:"delivered_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+//InvoiceJobBackoff é a espera depois de attempts falhas
+func InvoiceJobBackoff(attempts int) time.Duration {
+	delay := invoiceJobBaseDelay
+	for i := 1; i < attempts && delay < invoiceJobMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > invoiceJobMaxDelay {
+		delay = invoiceJobMaxDelay
+	}
+	return delay
+}
+
+//EnqueueInvoice grava o job de invoice da order. Deve ser chamado no tx que grava a order,
+//assim a order nunca fica sem invoice. Um segundo job para a mesma order é ignorado
+func (m *DbModel) EnqueueInvoice(orderID int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `
+		insert into invoice_jobs (order_id, status, attempts, next_attempt_at, created_at, updated_at) values(?,?,0,?,?,?)
+		on duplicate key update order_id = order_id`,
+		orderID, InvoiceJobPending, time.Now(), time.Now(), time.Now())
+	return err
+}
+
+//EnqueueCreditNote grava o job da nota de credito do refund, no tx que grava o refund
+func (m *DbModel) EnqueueCreditNote(orderID, refundID int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `
+		insert into invoice_jobs (order_id, refund_id, status, attempts, next_attempt_at, created_at, updated_at) values(?,?,?,0,?,?,?)
+		on duplicate key update order_id = order_id`,
+		orderID, refundID, InvoiceJobPending, time.Now(), time.Now(), time.Now())
+	return err
+}
+
+//ClaimInvoiceJobs pega os jobs prontos para entrega e empurra a proxima tentativa por lease,
+//outro dispatcher nao pega os mesmos jobs e se este cair os jobs voltam depois do lease
+func (m *DbModel) ClaimInvoiceJobs(limit int, lease time.Duration) ([]*InvoiceJob, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	jobs := []*InvoiceJob{}
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		rows,err := tx.DB.QueryContext(ctx, `
+			select id, order_id, refund_id, status, attempts, next_attempt_at, coalesce(last_error, ''), created_at
+			from invoice_jobs
+			where status = ? and next_attempt_at <= ?
+			order by next_attempt_at
+			limit ?
+			for update skip locked`, InvoiceJobPending, time.Now(), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var j InvoiceJob
+			err = rows.Scan(&j.ID, &j.OrderID, &j.RefundID, &j.Status, &j.Attempts, &j.NextAttemptAt, &j.LastError, &j.CreatedAt)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, &j)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, j := range jobs {
+			_,err = tx.DB.ExecContext(ctx, `update invoice_jobs set next_attempt_at = ?, updated_at = ? where id = ?`,
+				time.Now().Add(lease), time.Now(), j.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (m *DbModel) MarkInvoiceJobDelivered(id int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `
+		update invoice_jobs set status = ?, attempts = attempts + 1, last_error = null, delivered_at = ?, updated_at = ? where id = ?`,
+		InvoiceJobDelivered, time.Now(), time.Now(), id)
+	return err
+}
+
+//MarkInvoiceJobFailed grava a falha e agenda a proxima tentativa, ou manda o job para dead.
+//Retorna true quando o job foi para dead
+func (m *DbModel) MarkInvoiceJobFailed(job *InvoiceJob, failure error) (bool, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	attempts := job.Attempts + 1
+	status := InvoiceJobPending
+	if attempts >= InvoiceJobMaxAttempts {
+		status = InvoiceJobDead
+	}
+
+	msg := failure.Error()
+	if len(msg) > 1000 {
+		msg = msg[:1000]
+	}
+
+	_,err := m.DB.ExecContext(ctx, `
+		update invoice_jobs set status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, updated_at = ? where id = ?`,
+		status, attempts, time.Now().Add(InvoiceJobBackoff(attempts)), msg, time.Now(), job.ID)
+	if err != nil {
+		return false, err
+	}
+	return status == InvoiceJobDead, nil
+}
+
+//RedriveInvoiceJob volta um job dead para a fila com as tentativas zeradas.
+//Retorna sql.ErrNoRows se o job nao existe ou nao esta dead
+func (m *DbModel) RedriveInvoiceJob(id int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	result,err := m.DB.ExecContext(ctx, `
+		update invoice_jobs set status = ?, attempts = 0, next_attempt_at = ?, updated_at = ? where id = ? and status = ?`,
+		InvoiceJobPending, time.Now(), time.Now(), id, InvoiceJobDead)
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+//GetInvoiceJobsPaginated lista os jobs do status, todos quando status é vazio
+func (m *DbModel) GetInvoiceJobsPaginated(status string, pageSize, page int) ([]*InvoiceJob, int, int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	jobs := []*InvoiceJob{}
+
+	rows,err := m.DB.QueryContext(ctx, `
+		select id, order_id, refund_id, status, attempts, next_attempt_at, coalesce(last_error, ''), delivered_at, created_at
+		from invoice_jobs
+		where (? = '' or status = ?)
+		order by created_at desc, id desc
+		limit ? offset ?`, status, status, pageSize, offset)
+	if err != nil {
+		return nil,0,0,err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var j InvoiceJob
+		var deliveredAt sql.NullTime
+		err = rows.Scan(&j.ID, &j.OrderID, &j.RefundID, &j.Status, &j.Attempts, &j.NextAttemptAt, &j.LastError, &deliveredAt, &j.CreatedAt)
+		if err != nil {
+			return nil,0,0,err
+		}
+		if deliveredAt.Valid {
+			j.DeliveredAt = deliveredAt.Time
+		}
+		jobs = append(jobs, &j)
+	}
+	if err = rows.Err(); err != nil {
+		return nil,0,0,err
+	}
+
+	var totalRecords int
+	err = m.DB.QueryRowContext(ctx, `select count(id) from invoice_jobs where (? = '' or status = ?)`, status, status).Scan(&totalRecords)
+	if err != nil {
+		return nil,0,0,err
+	}
+	lastPage := totalRecords / pageSize
+
+	return jobs, lastPage, totalRecords, nil
+}
@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//status das invoices
+const (
+	InvoiceIssued = "issued"
+	InvoiceVoided = "voided"
+	InvoiceCredited = "credited"
+)
+
+//serie das invoices, cada serie tem a sua sequencia por ano
+const InvoiceSeries = "INV"
+
+var ErrInvoiceStatus = errors.New("the invoice status can not be changed")
+
+type Invoice struct {
+	ID int `json:"id"`
+	OrderID int `json:"order_id"`
+	Year int `json:"year"`
+	Sequence int `json:"sequence"`
+	Number string `json:"number"`
+	IssuedAt time.Time `json:"issued_at"`
+	Currency string `json:"currency"`
+	Subtotal int `json:"subtotal"`
+	Discount int `json:"discount"`
+	Tax int `json:"tax"`
+	Total int `json:"total"`
+	Status string `json:"status"`
+	StorageLocation string `json:"storage_location"` //chave do pdf no storage, vazio ate o pdf ser gerado
+	DownloadURL string `json:"download_url,omitempty"` //link assinado, preenchido pela api para o admin
+	SentAt time.Time `json:"sent_at"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+//FormatInvoiceNumber monta o numero impresso no documento, como INV-2023-000042
+func FormatInvoiceNumber(series string, year, sequence int) string {
+	return fmt.Sprintf("%s-%d-%06d", series, year, sequence)
+}
+
+//nextSequenceNumber reserva o proximo numero da serie no ano. Precisa rodar no tx que grava o
+//documento: a linha da sequencia fica travada ate o commit e o rollback devolve o numero,
+//assim dois tx nunca pegam o mesmo numero e a sequencia nao fica com buracos
+func (m *DbModel) nextSequenceNumber(ctx context.Context, series string, year int) (int, error) {
+	if _, ok := m.DB.(*sql.Tx); !ok {
+		return 0, errors.New("models: the sequence number must be reserved inside a transaction")
+	}
+
+	_,err := m.DB.ExecContext(ctx, `
+		insert into invoice_sequences (series, year, last_number, created_at, updated_at) values(?,?,0,?,?)
+		on duplicate key update id = id`,
+		series, year, time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	_,err = m.DB.ExecContext(ctx, `
+		update invoice_sequences set last_number = last_number + 1, updated_at = ? where series = ? and year = ?`,
+		time.Now(), series, year)
+	if err != nil {
+		return 0, err
+	}
+
+	var number int
+	err = m.DB.QueryRowContext(ctx, `
+		select last_number from invoice_sequences where series = ? and year = ?`, series, year).Scan(&number)
+	return number, err
+}
+
+const invoiceColumns = `
+	id, order_id, year, sequence, number, issued_at, currency, subtotal, discount, tax, total,
+	status, coalesce(storage_location, ''), sent_at, created_at, updated_at`
+
+func scanInvoice(row scanner) (Invoice, error) {
+	var i Invoice
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&i.ID,
+		&i.OrderID,
+		&i.Year,
+		&i.Sequence,
+		&i.Number,
+		&i.IssuedAt,
+		&i.Currency,
+		&i.Subtotal,
+		&i.Discount,
+		&i.Tax,
+		&i.Total,
+		&i.Status,
+		&i.StorageLocation,
+		&sentAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	if sentAt.Valid {
+		i.SentAt = sentAt.Time
+	}
+	return i, err
+}
+
+//IssueInvoice emite a invoice da order com o proximo numero do ano. Se a order ja tem uma
+//invoice que nao foi anulada ela é retornada, uma nova entrega da order nao gasta outro numero
+func (m *DbModel) IssueInvoice(inv Invoice) (Invoice, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		existing, err := scanInvoice(tx.DB.QueryRowContext(ctx, `
+			select `+invoiceColumns+` from invoices
+			where order_id = ? and status <> ?
+			order by id desc limit 1
+			for update`, inv.OrderID, InvoiceVoided))
+		if err == nil {
+			inv = existing
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if inv.IssuedAt.IsZero() {
+			inv.IssuedAt = time.Now()
+		}
+		inv.Year = inv.IssuedAt.Year()
+		inv.Sequence, err = tx.nextSequenceNumber(ctx, InvoiceSeries, inv.Year)
+		if err != nil {
+			return err
+		}
+		inv.Number = FormatInvoiceNumber(InvoiceSeries, inv.Year, inv.Sequence)
+		inv.Status = InvoiceIssued
+
+		result,err := tx.DB.ExecContext(ctx, `
+			insert into invoices (order_id, year, sequence, number, issued_at, currency, subtotal, discount, tax, total,
+				status, created_at, updated_at)
+			values(?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+			inv.OrderID, inv.Year, inv.Sequence, inv.Number, inv.IssuedAt, inv.Currency, inv.Subtotal, inv.Discount,
+			inv.Tax, inv.Total, inv.Status, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+		id,err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		inv.ID = int(id)
+		return nil
+	})
+	if err != nil {
+		return Invoice{}, err
+	}
+	return inv, nil
+}
+
+func (m *DbModel) GetInvoice(id int) (Invoice, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	return scanInvoice(m.DB.QueryRowContext(ctx, `select `+invoiceColumns+` from invoices where id = ?`, id))
+}
+
+//GetInvoiceForOrder retorna a invoice da order que nao foi anulada, sql.ErrNoRows se nao tem
+func (m *DbModel) GetInvoiceForOrder(orderID int) (Invoice, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	return scanInvoice(m.DB.QueryRowContext(ctx, `
+		select `+invoiceColumns+` from invoices
+		where order_id = ? and status <> ?
+		order by id desc limit 1`, orderID, InvoiceVoided))
+}
+
+//SetInvoiceStorage grava onde o pdf da invoice foi guardado
+func (m *DbModel) SetInvoiceStorage(id int, location string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `update invoices set storage_location = ?, updated_at = ? where id = ?`,
+		location, time.Now(), id)
+	return err
+}
+
+func (m *DbModel) MarkInvoiceSent(id int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `update invoices set sent_at = ?, updated_at = ? where id = ?`,
+		time.Now(), time.Now(), id)
+	return err
+}
+
+//SetInvoiceStatus anula ou marca como creditada uma invoice emitida. O numero continua
+//usado, a invoice anulada fica no banco para a sequencia nao ter buracos.
+//Retorna ErrInvoiceStatus se a invoice ja foi anulada
+func (m *DbModel) SetInvoiceStatus(id int, status string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	if status != InvoiceVoided && status != InvoiceCredited {
+		return fmt.Errorf("invalid invoice status %q", status)
+	}
+
+	result,err := m.DB.ExecContext(ctx, `
+		update invoices set status = ?, updated_at = ? where id = ? and status in (?, ?)`,
+		status, time.Now(), id, InvoiceIssued, InvoiceCredited)
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvoiceStatus
+	}
+	return nil
+}
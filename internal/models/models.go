@@ -10,9 +10,10 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-//DbModel é o tipo para conexao do database com os valores
+//DbModel é o tipo para conexao do database com os valores,
+//DB é a conexao ou a transacao aberta por WithTx
 type DbModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 //Models é o envolucro de todos models
@@ -36,6 +37,9 @@ type Widget struct {
 	Image string `json:"image"`
 	IsRecurring bool `json:"is_recurring"`
 	PlanID string `json:"plan_id"`
+	Slug string `json:"slug"`
+	Interval string `json:"interval"` //intervalo de cobranca dos planos: day, week, month ou year
+	TrialDays int `json:"trial_days"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
@@ -49,11 +53,68 @@ type Order struct {
 	StatusID int `json:"status_id"`
 	Quantity int `json:"quantity"`
 	Amount int `json:"amount"`
+	Locale string `json:"locale"` //idioma do comprador, formata os valores da invoice
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 	Widget Widget `json:"widget"`
 	Transaction Transaction `json:"transaction"`
 	Customer Customer `json:"customer"`
+	Items []OrderItem `json:"items"`
+	Subscription *Subscription `json:"subscription,omitempty"` //apenas nas orders de planos
+	Refunds []Refund `json:"refunds"`
+	Invoice *Invoice `json:"invoice,omitempty"` //invoice emitida, nil ate o microservico emitir
+	CreditNotes []CreditNote `json:"credit_notes"`
+}
+
+//InsertSale grava transaction, customer e order na mesma transacao do banco. A transaction vai
+//primeiro, um payment intent ja gravado retorna ErrDuplicateTransaction sem gravar nada
+func (m *DbModel) InsertSale(customer Customer, transaction Transaction, order Order) (int, error) {
+	var orderID int
+	err := m.WithTx(context.Background(), func(tx *DbModel) error {
+		transactionID, err := tx.InsertTransaction(transaction)
+		if err != nil {
+			return err
+		}
+
+		customerID, err := tx.SaveCustomer(customer)
+		if err != nil {
+			return err
+		}
+
+		order.TransactionID = transactionID
+		order.CustomerID = customerID
+		orderID, err = tx.InsertOrder(order)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return orderID, nil
+}
+
+//LocaleFromHeader retorna o primeiro idioma do header Accept-Language, como pt-BR.
+//O microservico de invoice usa o locale padrao quando nao conhece o idioma
+func LocaleFromHeader(acceptLanguage string) string {
+	first, _, _ := strings.Cut(acceptLanguage, ",")
+	tag, _, _ := strings.Cut(first, ";")
+	tag = strings.TrimSpace(tag)
+	if tag == "*" || len(tag) > 10 {
+		return ""
+	}
+	return tag
+}
+
+//linha de uma order, o preco do widget é copiado no momento da venda
+type OrderItem struct {
+	ID int `json:"id"`
+	OrderID int `json:"order_id"`
+	WidgetID int `json:"widget_id"`
+	WidgetName string `json:"widget_name"`
+	Quantity int `json:"quantity"`
+	UnitPrice int `json:"unit_price"`
+	Amount int `json:"amount"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
 }
 
 //tabela status
@@ -81,10 +142,13 @@ type Transaction struct {
 
 type User struct {
 	ID int `json:"id"`
-	FirstName string `json:"first_name"`
-	LastName string `json:"last_name"`
-	Email string `json:"email"`
-	Password string `json:"password"`
+	FirstName string `json:"first_name" validate:"required,max=255"`
+	LastName string `json:"last_name" validate:"required,max=255"`
+	Email string `json:"email" validate:"required,email,max=255"`
+	Password string `json:"password" validate:"max=72"` //limite do bcrypt
+	Role string `json:"role" validate:"oneof=viewer support finance admin"` //os papeis de Roles
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+	SessionsRevokedAt time.Time `json:"-"` //sessoes do site criadas antes disso nao valem mais
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
@@ -94,6 +158,7 @@ type Customer struct {
 	FirstName string `json:"first_name"`
 	LastName string `json:"last_name"`
 	Email string `json:"email"`
+	StripeCustomerID string `json:"stripe_customer_id"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
@@ -113,20 +178,9 @@ func (m *DbModel) GetWidget(id int) (Widget, error) {
 	var widget Widget
 
 	row := m.DB.QueryRowContext(ctx, 
-		`select id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id, created_at, updated_at from widgets where id= ?`, id)
+		`select `+widgetColumns+` from widgets where id= ?`, id)
 	
-	err := row.Scan(
-		&widget.ID, 
-		&widget.Name,
-		&widget.Description,
-		&widget.InventoryLevel,
-		&widget.Price,
-		&widget.Image,
-		&widget.IsRecurring,
-		&widget.PlanID,
-		&widget.CreatedAt,
-		&widget.UpdatedAt,
-	)
+	err := scanWidget(row, &widget)
 	if err != nil {
 		return widget, err
 	}
@@ -134,6 +188,10 @@ func (m *DbModel) GetWidget(id int) (Widget, error) {
 	return widget, nil
 }
 
+//ErrDuplicateTransaction é retornado quando o payment intent ja tem transaction, o webhook
+//e o navegador podem tentar gravar a mesma venda ao mesmo tempo
+var ErrDuplicateTransaction = errors.New("there is already a transaction for this payment intent")
+
 func (m *DbModel) InsertTransaction(transaction Transaction) (int, error) {
 	//se demorar mais de 3 segundos algo esta errado no contexto para o db
 	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
@@ -158,6 +216,9 @@ func (m *DbModel) InsertTransaction(transaction Transaction) (int, error) {
 		time.Now(),
 		time.Now(),
 	)
+	if isDuplicateEntry(err) {
+		return 0, ErrDuplicateTransaction
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -169,35 +230,77 @@ func (m *DbModel) InsertTransaction(transaction Transaction) (int, error) {
 	return int(id), err
 }
 
+//InsertOrder grava a order e os itens, baixa do estoque as reservas do payment intent
+//da transaction e coloca a invoice na fila, tudo na mesma transacao do banco
 func (m *DbModel) InsertOrder(order Order) (int, error) {
 	//se demorar mais de 3 segundos algo esta errado no contexto para o db
 	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
 	defer cancel()
 
-	stmt := `
-		insert into orders (widget_id, transaction_id, status_id, quantity, customer_id, amount, created_at, updated_at)
-		values(?,?,?,?,?,?,?,?)
-	`
+	var id int64
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		stmt := `
+			insert into orders (widget_id, transaction_id, status_id, quantity, customer_id, amount, locale, created_at, updated_at)
+			values(?,?,?,?,?,?,?,?,?)
+		`
+
+		result,err := tx.DB.ExecContext(ctx, stmt,
+			order.WidgetID,
+			order.TransactionID,
+			order.StatusID,
+			order.Quantity,
+			order.CustomerID,
+			order.Amount,
+			order.Locale,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+		id,err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
 
-	result,err := m.DB.ExecContext(ctx, stmt,
-		order.WidgetID,
-		order.TransactionID,
-		order.StatusID,
-		order.Quantity,
-		order.CustomerID,
-		order.Amount,
-		time.Now(),
-		time.Now(),
-	)
-	if err != nil {
-		return 0, err
-	}
-	id,err := result.LastInsertId()
+		//order sem itens vende apenas o widget_id da order
+		items := order.Items
+		if len(items) == 0 && order.Quantity > 0 {
+			items = []OrderItem{{
+				WidgetID: order.WidgetID,
+				Quantity: order.Quantity,
+				UnitPrice: order.Amount / order.Quantity,
+				Amount: order.Amount,
+			}}
+		}
+
+		for _, item := range items {
+			item.OrderID = int(id)
+			_,err = tx.InsertOrderItem(item)
+			if err != nil {
+				return err
+			}
+		}
+
+		var paymentIntent string
+		row := tx.DB.QueryRowContext(ctx, `select coalesce(payment_intent, '') from transactions where id = ?`, order.TransactionID)
+		err = row.Scan(&paymentIntent)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		err = tx.CommitReservations(int(id), paymentIntent)
+		if err != nil {
+			return err
+		}
+
+		return tx.EnqueueInvoice(int(id))
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	return int(id), err
+	return int(id), nil
 }
 
 func (m *DbModel) InsertCustomer(customer Customer) (int, error) {
@@ -206,14 +309,15 @@ func (m *DbModel) InsertCustomer(customer Customer) (int, error) {
 	defer cancel()
 
 	stmt := `
-		insert into customers (first_name, last_name, email, created_at, updated_at)
-		values(?,?,?,?,?)
+		insert into customers (first_name, last_name, email, stripe_customer_id, created_at, updated_at)
+		values(?,?,?,?,?,?)
 	`
 
 	result,err := m.DB.ExecContext(ctx, stmt,
 		customer.FirstName,
 		customer.LastName,
-		customer.Email,
+		normalizeEmail(customer.Email),
+		customer.StripeCustomerID,
 		time.Now(),
 		time.Now(),
 	)
@@ -236,7 +340,7 @@ func (m *DbModel) GetUserByEmail(email string) (User, error) {
 	var u User
 
 	row := m.DB.QueryRowContext(ctx, `
-		select id,first_name,last_name,email,password,created_at,updated_at
+		select id,first_name,last_name,email,password,role,two_factor_enabled,created_at,updated_at
 		from users where email=?`, email)
 	
 	err := row.Scan(
@@ -245,6 +349,8 @@ func (m *DbModel) GetUserByEmail(email string) (User, error) {
 		&u.LastName,
 		&u.Email,
 		&u.Password,
+		&u.Role,
+		&u.TwoFactorEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -288,6 +394,12 @@ func(m *DbModel) UpdatePasswordForUser(u User, hashPassword string) error {
 		return err
 	}
 
+	//com a senha trocada os links de reset ja enviados deixam de valer
+	_,err = m.DB.ExecContext(ctx, `update password_resets set used_at = ? where user_id = ? and used_at is null`, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -441,6 +553,13 @@ func (m *DbModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int,
 	}
 	lastPage := totalRecords / pageSize
 
+	for _, o := range orders {
+		o.Items, err = m.GetOrderItems(o.ID)
+		if err != nil {
+			return nil,0,0,err
+		}
+	}
+
 	return orders,lastPage, totalRecords, nil
 }
 
@@ -594,9 +713,29 @@ func (m *DbModel) GetAllSubscriptionsPaginated(page, pageSize int) ([]*Order,int
 	}
 	lastPage := totalRecords / pageSize
 
+	for _, o := range orders {
+		o.Items, err = m.GetOrderItems(o.ID)
+		if err != nil {
+			return nil,0,0,err
+		}
+	}
+
 	return orders,lastPage, totalRecords, nil
 }
 
+//GetOrderByTransactionID retorna a order paga pela transaction, sql.ErrNoRows se nao tem order
+func (m *DbModel) GetOrderByTransactionID(transactionID int) (Order, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var orderID int
+	err := m.DB.QueryRowContext(ctx, `select id from orders where transaction_id = ? order by id limit 1`, transactionID).Scan(&orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	return m.GetOrderByID(orderID)
+}
+
 func (m *DbModel) GetOrderByID(orderID int) (Order, error) {
 	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
 	defer cancel()
@@ -604,7 +743,7 @@ func (m *DbModel) GetOrderByID(orderID int) (Order, error) {
 	query := `
 		select
 			o.id, o.widget_id, o.transaction_id, o.customer_id, 
-			o.status_id, o.quantity, o.amount, o.created_at,
+			o.status_id, o.quantity, o.amount, o.locale, o.created_at,
 			o.updated_at, w.id, w.name, t.id, t.amount, t.currency,
 			t.last_four, t.expiry_month, t.expiry_year, t.payment_intent,
 			t.bank_return_code, c.id, c.first_name, c.last_name, c.email	
@@ -629,6 +768,7 @@ func (m *DbModel) GetOrderByID(orderID int) (Order, error) {
 		&o.StatusID,
 		&o.Quantity,
 		&o.Amount,
+		&o.Locale,
 		&o.CreatedAt,
 		&o.UpdatedAt,
 		&o.Widget.ID,
@@ -650,6 +790,34 @@ func (m *DbModel) GetOrderByID(orderID int) (Order, error) {
 		return o,err
 	}
 
+	o.Items, err = m.GetOrderItems(o.ID)
+	if err != nil {
+		return o, err
+	}
+
+	o.Refunds, err = m.GetRefundsForTransaction(o.TransactionID)
+	if err != nil {
+		return o, err
+	}
+
+	sub, err := m.GetSubscriptionByOrderID(o.ID)
+	if err == nil {
+		o.Subscription = &sub
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return o, err
+	}
+
+	invoice, err := m.GetInvoiceForOrder(o.ID)
+	if err == nil {
+		o.Invoice = &invoice
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return o, err
+	}
+
+	o.CreditNotes, err = m.GetCreditNotesForOrder(o.ID)
+	if err != nil {
+		return o, err
+	}
 	
 	return o, nil
 }
@@ -674,7 +842,7 @@ func (m *DbModel) GetAllUsers() ([]*User, error) {
 	var users []*User
 
 	query := `
-		select id, last_name, first_name, email, created_at, updated_at
+		select id, last_name, first_name, email, role, two_factor_enabled, created_at, updated_at
 		from users
 		order by last_name, first_name
 	`
@@ -692,6 +860,8 @@ func (m *DbModel) GetAllUsers() ([]*User, error) {
 			&u.LastName,
 			&u.FirstName,
 			&u.Email,
+			&u.Role,
+			&u.TwoFactorEnabled,
 			&u.CreatedAt,
 			&u.UpdatedAt,
 		)
@@ -710,24 +880,31 @@ func (m *DbModel) GetUser(id int) (User, error) {
 	var user User
 
 	query := `
-		select id, last_name, first_name, email, created_at, updated_at
+		select id, last_name, first_name, email, role, two_factor_enabled, sessions_revoked_at, created_at, updated_at
 		from users
 		where id=?
 	`
 
 	row := m.DB.QueryRowContext(ctx,query,id)
 
+	var revokedAt sql.NullTime
 	err := row.Scan(
 		&user.ID,
 		&user.LastName,
 		&user.FirstName,
 		&user.Email,
+		&user.Role,
+		&user.TwoFactorEnabled,
+		&revokedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
 	if err != nil {
 		return user, err
 	}
+	if revokedAt.Valid {
+		user.SessionsRevokedAt = revokedAt.Time
+	}
 	return user, nil
 }
 
@@ -736,10 +913,10 @@ func (m *DbModel) EditUser(u User) error {
 	defer cancel()
 
 	stmt := `
-		update users set first_name=? last_name=?, email=?, updated_at=?
+		update users set first_name=?, last_name=?, email=?, role=?, updated_at=?
 		where id=?
 	`
-	_,err := m.DB.ExecContext(ctx,stmt,u.FirstName,u.LastName,u.Email,time.Now(),u.ID)
+	_,err := m.DB.ExecContext(ctx,stmt,u.FirstName,u.LastName,u.Email,u.Role,time.Now(),u.ID)
 	if err != nil {
 		return err
 	}
@@ -751,10 +928,10 @@ func (m *DbModel) AddtUser(u User, hash string) error {
 	defer cancel()
 
 	stmt := `
-		insert into users (first_name,last_name,email,password,created_at,updated_at)
-		values(?,?,?,?,?,?)
+		insert into users (first_name,last_name,email,password,role,created_at,updated_at)
+		values(?,?,?,?,?,?,?)
 	`
-	_,err := m.DB.ExecContext(ctx,stmt,u.FirstName,u.LastName,u.Email,hash,time.Now(),time.Now())
+	_,err := m.DB.ExecContext(ctx,stmt,u.FirstName,u.LastName,u.Email,hash,u.Role,time.Now(),time.Now())
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (m *DbModel) InsertOrderItem(item OrderItem) (int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into order_items (order_id, widget_id, quantity, unit_price, amount, created_at, updated_at)
+		values(?,?,?,?,?,?,?)
+	`
+
+	result,err := m.DB.ExecContext(ctx, stmt,
+		item.OrderID,
+		item.WidgetID,
+		item.Quantity,
+		item.UnitPrice,
+		item.Amount,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	id,err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (m *DbModel) GetOrderItems(orderID int) ([]OrderItem, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	items := []OrderItem{}
+
+	query := `
+		select
+			i.id, i.order_id, i.widget_id, w.name, i.quantity, i.unit_price,
+			i.amount, i.created_at, i.updated_at
+		from
+			order_items i
+			left join widgets w on (i.widget_id = w.id)
+		where
+			i.order_id = ?
+		order by
+			i.id
+	`
+
+	rows,err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i OrderItem
+		err = rows.Scan(
+			&i.ID,
+			&i.OrderID,
+			&i.WidgetID,
+			&i.WidgetName,
+			&i.Quantity,
+			&i.UnitPrice,
+			&i.Amount,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+
+	return items, rows.Err()
+}
+
+//ItemsMetadata codifica os itens como "widget_id:quantidade,..." para o metadata do payment intent,
+//assim o webhook consegue recriar a order do carrinho
+func ItemsMetadata(items []OrderItem) string {
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		parts = append(parts, fmt.Sprintf("%d:%d", item.WidgetID, item.Quantity))
+	}
+	return strings.Join(parts, ",")
+}
+
+//ParseItemsMetadata le os itens gravados por ItemsMetadata
+func ParseItemsMetadata(s string) ([]OrderItem, error) {
+	var items []OrderItem
+	if s == "" {
+		return items, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		widget, quantity, found := strings.Cut(part, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid item metadata %q", part)
+		}
+		widgetID, err := strconv.Atoi(widget)
+		if err != nil {
+			return nil, err
+		}
+		qty, err := strconv.Atoi(quantity)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, OrderItem{WidgetID: widgetID, Quantity: qty})
+	}
+	return items, nil
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrInvalidResetToken = errors.New("the password reset link is invalid or has expired")
+
+//CreatePasswordReset gera o token do link de reset de senha. No banco fica so o hash e os
+//tokens anteriores do usuario que ainda nao foram usados deixam de valer
+func (m *DbModel) CreatePasswordReset(userID int, ttl time.Duration) (string, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	token, err := GenerateToken(userID, ttl, "password-reset")
+	if err != nil {
+		return "", err
+	}
+
+	err = m.WithTx(ctx, func(tx *DbModel) error {
+		_,err := tx.DB.ExecContext(ctx, `delete from password_resets where user_id = ? and used_at is null`, userID)
+		if err != nil {
+			return err
+		}
+
+		_,err = tx.DB.ExecContext(ctx, `
+			insert into password_resets (user_id, token_hash, expiry, created_at, updated_at) values(?,?,?,?,?)`,
+			userID, token.Hash, token.Expiry, time.Now(), time.Now())
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token.PlanText, nil
+}
+
+//GetUserForPasswordReset retorna o dono do token sem usar o token, para mostrar a pagina de reset
+func (m *DbModel) GetUserForPasswordReset(token string) (User, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+	var userID int
+	err := m.DB.QueryRowContext(ctx, `
+		select user_id from password_resets where token_hash = ? and used_at is null and expiry > ?`,
+		tokenHash[:], time.Now()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return User{}, ErrInvalidResetToken
+	} else if err != nil {
+		return User{}, err
+	}
+	return m.GetUser(userID)
+}
+
+//ResetPassword troca a senha pelo token e usa o token. Na mesma transacao as sessoes do site,
+//os tokens e as chaves de api do usuario sao revogados
+func (m *DbModel) ResetPassword(token, hashPassword string) (User, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+	var userID int
+
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		//for update para o mesmo token nao ser usado por dois requests ao mesmo tempo
+		err := tx.DB.QueryRowContext(ctx, `
+			select user_id from password_resets where token_hash = ? and used_at is null and expiry > ? for update`,
+			tokenHash[:], time.Now()).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return ErrInvalidResetToken
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		_,err = tx.DB.ExecContext(ctx, `
+			update users set password = ?, sessions_revoked_at = ?, updated_at = ? where id = ?`,
+			hashPassword, now, now, userID)
+		if err != nil {
+			return err
+		}
+
+		_,err = tx.DB.ExecContext(ctx, `
+			update password_resets set used_at = ?, updated_at = ? where user_id = ? and used_at is null`,
+			now, now, userID)
+		if err != nil {
+			return err
+		}
+
+		_,err = tx.DB.ExecContext(ctx, `delete from tokens where user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+
+		_,err = tx.DB.ExecContext(ctx, `delete from api_keys where user_id = ?`, userID)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return m.GetUser(userID)
+}
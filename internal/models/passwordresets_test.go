@@ -0,0 +1,95 @@
+package models
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+//o reset revoga as sessoes, os tokens e as chaves de api na mesma transacao
+func TestResetPasswordRevokesAPIKeys(t *testing.T) {
+	m, mock := newMockModel(t)
+	tokenHash := sha256.Sum256([]byte("reset-token"))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(q(`select user_id from password_resets where token_hash = ?`)).
+		WithArgs(tokenHash[:], sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(7))
+	mock.ExpectExec(q(`update users set password = ?, sessions_revoked_at = ?`)).
+		WithArgs("new-hash", sqlmock.AnyArg(), sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`update password_resets set used_at = ?`)).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`delete from tokens where user_id = ?`)).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(q(`delete from api_keys where user_id = ?`)).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	now := time.Now()
+	mock.ExpectQuery(q(`from users`)).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "last_name", "first_name", "email", "role", "two_factor_enabled", "sessions_revoked_at", "created_at", "updated_at"}).
+			AddRow(7, "Silva", "Ana", "ana@example.com", "user", false, now, now, now))
+
+	user, err := m.ResetPassword("reset-token", "new-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 7 {
+		t.Errorf("user = %d, want 7", user.ID)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+//falha ao apagar as chaves de api desfaz a troca da senha
+func TestResetPasswordRollsBackWhenAPIKeysFail(t *testing.T) {
+	m, mock := newMockModel(t)
+	tokenHash := sha256.Sum256([]byte("reset-token"))
+	failure := errors.New("api_keys locked")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(q(`select user_id from password_resets where token_hash = ?`)).
+		WithArgs(tokenHash[:], sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(7))
+	mock.ExpectExec(q(`update users set password = ?`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`update password_resets set used_at = ?`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q(`delete from tokens where user_id = ?`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(q(`delete from api_keys where user_id = ?`)).
+		WithArgs(7).
+		WillReturnError(failure)
+	mock.ExpectRollback()
+
+	if _, err := m.ResetPassword("reset-token", "new-hash"); !errors.Is(err, failure) {
+		t.Fatalf("ResetPassword() = %v, want %v", err, failure)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResetPasswordInvalidToken(t *testing.T) {
+	m, mock := newMockModel(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(q(`select user_id from password_resets where token_hash = ?`)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectRollback()
+
+	if _, err := m.ResetPassword("used-token", "new-hash"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("ResetPassword() = %v, want ErrInvalidResetToken", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
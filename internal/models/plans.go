@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//colunas lidas por scanWidget
+const widgetColumns = `id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id,
+	slug, plan_interval, trial_days, created_at, updated_at`
+
+//scanner é implementado por *sql.Row e *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWidget(row scanner, widget *Widget) error {
+	return row.Scan(
+		&widget.ID,
+		&widget.Name,
+		&widget.Description,
+		&widget.InventoryLevel,
+		&widget.Price,
+		&widget.Image,
+		&widget.IsRecurring,
+		&widget.PlanID,
+		&widget.Slug,
+		&widget.Interval,
+		&widget.TrialDays,
+		&widget.CreatedAt,
+		&widget.UpdatedAt,
+	)
+}
+
+//intervalos de cobranca aceitos pelo stripe
+var PlanIntervals = []string{"day", "week", "month", "year"}
+
+var ErrDuplicateSlug = errors.New("there is already a plan with this slug")
+
+//GetPlans retorna o catalogo de planos, os widgets com is_recurring
+func (m *DbModel) GetPlans() ([]*Widget, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var plans []*Widget
+
+	rows,err := m.DB.QueryContext(ctx, `select `+widgetColumns+` from widgets where is_recurring = 1 order by price`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var w Widget
+		err = scanWidget(rows, &w)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, &w)
+	}
+
+	return plans, rows.Err()
+}
+
+func (m *DbModel) GetPlanBySlug(slug string) (Widget, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var plan Widget
+
+	row := m.DB.QueryRowContext(ctx, `select `+widgetColumns+` from widgets where slug = ? and is_recurring = 1`, slug)
+	err := scanWidget(row, &plan)
+	if err != nil {
+		return plan, err
+	}
+	return plan, nil
+}
+
+//SavePlan cria o plano quando o ID é 0, senao atualiza. Retorna o id do plano
+func (m *DbModel) SavePlan(plan Widget) (int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	if plan.ID == 0 {
+		stmt := `
+			insert into widgets (name, description, inventory_level, price, image, is_recurring, plan_id,
+				slug, plan_interval, trial_days, created_at, updated_at)
+			values(?,?,0,?,'',1,?,?,?,?,?,?)
+		`
+		result,err := m.DB.ExecContext(ctx, stmt,
+			plan.Name,
+			plan.Description,
+			plan.Price,
+			plan.PlanID,
+			plan.Slug,
+			plan.Interval,
+			plan.TrialDays,
+			time.Now(),
+			time.Now(),
+		)
+		if isDuplicateEntry(err) {
+			return 0, ErrDuplicateSlug
+		} else if err != nil {
+			return 0, err
+		}
+		id,err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		return int(id), nil
+	}
+
+	stmt := `
+		update widgets set name = ?, description = ?, price = ?, plan_id = ?, slug = ?,
+			plan_interval = ?, trial_days = ?, updated_at = ?
+		where id = ? and is_recurring = 1
+	`
+	_,err := m.DB.ExecContext(ctx, stmt,
+		plan.Name,
+		plan.Description,
+		plan.Price,
+		plan.PlanID,
+		plan.Slug,
+		plan.Interval,
+		plan.TrialDays,
+		time.Now(),
+		plan.ID,
+	)
+	if isDuplicateEntry(err) {
+		return 0, ErrDuplicateSlug
+	} else if err != nil {
+		return 0, err
+	}
+	return plan.ID, nil
+}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//Refund é um lancamento de devolucao de uma transaction, uma transaction pode ter varios refunds parciais
+type Refund struct {
+	ID int `json:"id"`
+	TransactionID int `json:"transaction_id"`
+	Amount int `json:"amount"`
+	Reason string `json:"reason"`
+	UserID int `json:"user_id"` //admin que fez o refund, 0 quando veio do dashboard do stripe
+	UserName string `json:"user_name"`
+	GatewayRefundID string `json:"gateway_refund_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+//RefundTooLargeError é retornado quando o refund passaria do valor capturado
+type RefundTooLargeError struct {
+	Requested int
+	Refundable int
+}
+
+func (e *RefundTooLargeError) Error() string {
+	if e.Refundable <= 0 {
+		return "transaction is already fully refunded"
+	}
+	return fmt.Sprintf("refund of %d is more than the %d left to refund", e.Requested, e.Refundable)
+}
+
+//RefundSummary é o resultado do refund na transaction
+type RefundSummary struct {
+	Captured int `json:"captured"`
+	Refunded int `json:"refunded"`
+	Refundable int `json:"refundable"`
+	FullyRefunded bool `json:"fully_refunded"`
+}
+
+func (m *DbModel) GetRefundsForTransaction(transactionID int) ([]Refund, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	refunds := []Refund{}
+
+	query := `
+		select
+			r.id, r.transaction_id, r.amount, r.reason, coalesce(r.user_id, 0),
+			coalesce(concat(u.first_name, ' ', u.last_name), ''), r.gateway_refund_id,
+			r.created_at, r.updated_at
+		from
+			refunds r
+			left join users u on (r.user_id = u.id)
+		where
+			r.transaction_id = ?
+		order by
+			r.created_at, r.id
+	`
+	rows,err := m.DB.QueryContext(ctx, query, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Refund
+		err = rows.Scan(
+			&r.ID,
+			&r.TransactionID,
+			&r.Amount,
+			&r.Reason,
+			&r.UserID,
+			&r.UserName,
+			&r.GatewayRefundID,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, r)
+	}
+
+	return refunds, rows.Err()
+}
+
+//GetRefund retorna o refund pelo id, sql.ErrNoRows se nao existe
+func (m *DbModel) GetRefund(id int) (Refund, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	query := `
+		select
+			r.id, r.transaction_id, r.amount, r.reason, coalesce(r.user_id, 0),
+			coalesce(concat(u.first_name, ' ', u.last_name), ''), r.gateway_refund_id,
+			r.created_at, r.updated_at
+		from
+			refunds r
+			left join users u on (r.user_id = u.id)
+		where
+			r.id = ?
+	`
+
+	var r Refund
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&r.ID,
+		&r.TransactionID,
+		&r.Amount,
+		&r.Reason,
+		&r.UserID,
+		&r.UserName,
+		&r.GatewayRefundID,
+		&r.CreatedAt,
+		&r.UpdatedAt,
+	)
+	return r, err
+}
+
+//RefundableAmount retorna quanto da transaction ainda pode ser devolvido
+func (m *DbModel) RefundableAmount(transactionID int) (int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var captured, refunded int
+	row := m.DB.QueryRowContext(ctx, `
+		select t.amount, coalesce((select sum(r.amount) from refunds r where r.transaction_id = t.id), 0)
+		from transactions t where t.id = ?`, transactionID)
+	err := row.Scan(&captured, &refunded)
+	if err != nil {
+		return 0, err
+	}
+	return captured - refunded, nil
+}
+
+//RecordRefund grava o refund feito no gateway. A transaction fica travada ate o fim, a soma dos
+//refunds nunca passa do valor capturado. O mesmo refund do gateway gravado de novo (pela api e
+//pelo webhook) nao conta duas vezes. O status da transaction e das orders vem do total devolvido:
+//transaction 4 refunded ou 5 partially refunded, order 2 refunded ou 4 partially refunded.
+//Cada refund novo de uma order gera o job da nota de credito no mesmo tx
+func (m *DbModel) RecordRefund(refund Refund) (RefundSummary, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var summary RefundSummary
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		row := tx.DB.QueryRowContext(ctx, `select amount from transactions where id = ? for update`, refund.TransactionID)
+		err := row.Scan(&summary.Captured)
+		if err != nil {
+			return err
+		}
+
+		row = tx.DB.QueryRowContext(ctx, `select coalesce(sum(amount), 0) from refunds where transaction_id = ?`, refund.TransactionID)
+		err = row.Scan(&summary.Refunded)
+		if err != nil {
+			return err
+		}
+
+		var existing int
+		row = tx.DB.QueryRowContext(ctx, `select id from refunds where gateway_refund_id = ?`, refund.GatewayRefundID)
+		err = row.Scan(&existing)
+		if err == sql.ErrNoRows {
+			if refund.Amount <= 0 || summary.Refunded + refund.Amount > summary.Captured {
+				return &RefundTooLargeError{Requested: refund.Amount, Refundable: summary.Captured - summary.Refunded}
+			}
+
+			var userID sql.NullInt64
+			if refund.UserID > 0 {
+				userID = sql.NullInt64{Int64: int64(refund.UserID), Valid: true}
+			}
+
+			result,err := tx.DB.ExecContext(ctx, `
+				insert into refunds (transaction_id, amount, reason, user_id, gateway_refund_id, created_at, updated_at)
+				values(?,?,?,?,?,?,?)`,
+				refund.TransactionID, refund.Amount, refund.Reason, userID, refund.GatewayRefundID, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+			summary.Refunded += refund.Amount
+
+			refundID,err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+			//a nota de credito sai pela mesma fila das invoices, as cobrancas do terminal nao tem order
+			var orderID int
+			row = tx.DB.QueryRowContext(ctx, `select id from orders where transaction_id = ? order by id limit 1`, refund.TransactionID)
+			err = row.Scan(&orderID)
+			if err == nil {
+				err = tx.EnqueueCreditNote(orderID, int(refundID))
+			}
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		summary.Refundable = summary.Captured - summary.Refunded
+		summary.FullyRefunded = summary.Refundable <= 0
+
+		if summary.FullyRefunded {
+			err = tx.UpdateTransactionStatus(refund.TransactionID, 4)
+			if err != nil {
+				return err
+			}
+			//order status 2 refunded, os itens voltam ao estoque
+			return tx.RefundOrdersByTransactionID(refund.TransactionID)
+		}
+
+		err = tx.UpdateTransactionStatus(refund.TransactionID, 5)
+		if err != nil {
+			return err
+		}
+		_,err = tx.DB.ExecContext(ctx, `update orders set status_id = 4, updated_at = ? where transaction_id = ? and status_id = 1`,
+			time.Now(), refund.TransactionID)
+		return err
+	})
+	if err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
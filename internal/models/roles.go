@@ -0,0 +1,60 @@
+package models
+
+//papeis dos usuarios do admin, guardados em users.role
+const (
+	RoleViewer = "viewer"
+	RoleSupport = "support"
+	RoleFinance = "finance"
+	RoleAdmin = "admin"
+)
+
+//permissoes checadas nas rotas do admin
+const (
+	PermSalesRead = "sales:read"
+	PermRefundCreate = "refund:create"
+	PermSubscriptionsManage = "subscriptions:manage"
+	PermTerminalCharge = "terminal:charge"
+	PermPlansRead = "plans:read"
+	PermPlansWrite = "plans:write"
+	PermUsersRead = "users:read"
+	PermUsersWrite = "users:write"
+	PermUsersDelete = "users:delete"
+	PermAPIKeysManage = "api-keys:manage"
+	PermInvoicesManage = "invoices:manage"
+)
+
+var Roles = []string{RoleViewer, RoleSupport, RoleFinance, RoleAdmin}
+
+var rolePermissions = map[string][]string{
+	RoleViewer: {PermSalesRead, PermPlansRead},
+	RoleSupport: {PermSalesRead, PermPlansRead, PermSubscriptionsManage, PermUsersRead},
+	RoleFinance: {PermSalesRead, PermPlansRead, PermRefundCreate, PermSubscriptionsManage, PermTerminalCharge, PermInvoicesManage},
+	RoleAdmin: {
+		PermSalesRead, PermPlansRead, PermRefundCreate, PermSubscriptionsManage, PermTerminalCharge,
+		PermPlansWrite, PermUsersRead, PermUsersWrite, PermUsersDelete, PermAPIKeysManage, PermInvoicesManage,
+	},
+}
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+//Permissions retorna as permissoes do papel, usado pelas templates para esconder as acoes
+func Permissions(role string) map[string]bool {
+	perms := make(map[string]bool)
+	for _, p := range rolePermissions[role] {
+		perms[p] = true
+	}
+	return perms
+}
+
+//Can informa se o papel do usuario tem a permissao
+func (u *User) Can(permission string) bool {
+	for _, p := range rolePermissions[u.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//colunas gravadas criptografadas com o key ring do pacote encryption
+var encryptedColumns = []struct {
+	table string
+	column string
+}{
+	{"users", "totp_secret"},
+}
+
+//RotateEncryptedValues passa os valores criptografados por rotate e grava os que mudaram,
+//usado para mover os dados para a chave primaria. Retorna quantos valores foram gravados
+func (m *DbModel) RotateEncryptedValues(rotate func(string) (string, bool, error)) (int, error) {
+	rotated := 0
+	for _, c := range encryptedColumns {
+		n, err := m.rotateColumn(c.table, c.column, rotate)
+		rotated += n
+		if err != nil {
+			return rotated, fmt.Errorf("%s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return rotated, nil
+}
+
+func (m *DbModel) rotateColumn(table, column string, rotate func(string) (string, bool, error)) (int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+	defer cancel()
+
+	type value struct {
+		id int
+		text string
+	}
+	var values []value
+
+	rows,err := m.DB.QueryContext(ctx, fmt.Sprintf(`select id, %s from %s where %s is not null and %s <> ''`, column, table, column, column))
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var v value
+		if err := rows.Scan(&v.id, &v.text); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		values = append(values, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, v := range values {
+		text, changed, err := rotate(v.text)
+		if err != nil {
+			return rotated, fmt.Errorf("id %d: %w", v.id, err)
+		}
+		if !changed {
+			continue
+		}
+		//o valor so é trocado se nao mudou desde a leitura
+		_,err = m.DB.ExecContext(ctx, fmt.Sprintf(`update %s set %s = ? where id = ? and %s = ?`, table, column, column), text, v.id, v.text)
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
@@ -0,0 +1,290 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//estados da subscription. canceled é o cancelamento agendado para o fim do periodo,
+//a subscription continua valendo ate current_period_end. ended é a subscription encerrada
+const (
+	SubscriptionTrialing = "trialing"
+	SubscriptionActive = "active"
+	SubscriptionPastDue = "past_due"
+	SubscriptionCanceled = "canceled"
+	SubscriptionEnded = "ended"
+)
+
+//transicoes permitidas, qualquer outra é recusada
+var subscriptionTransitions = map[string][]string{
+	SubscriptionTrialing: {SubscriptionActive, SubscriptionPastDue, SubscriptionCanceled, SubscriptionEnded},
+	SubscriptionActive: {SubscriptionPastDue, SubscriptionCanceled, SubscriptionEnded},
+	SubscriptionPastDue: {SubscriptionActive, SubscriptionCanceled, SubscriptionEnded},
+	//reativar antes do fim do periodo volta para trialing ou active
+	SubscriptionCanceled: {SubscriptionTrialing, SubscriptionActive, SubscriptionEnded},
+	SubscriptionEnded: {},
+}
+
+//InvalidTransitionError é retornado quando a operacao nao é permitida no estado atual
+type InvalidTransitionError struct {
+	From string
+	To string
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("subscription cannot go from %s to %s", e.From, e.To)
+}
+
+var ErrSamePlan = errors.New("subscription is already on this plan")
+
+//CanTransition informa se a maquina de estados permite ir de from para to
+func CanTransition(from, to string) bool {
+	for _, s := range subscriptionTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+type Subscription struct {
+	ID int `json:"id"`
+	OrderID int `json:"order_id"`
+	CustomerID int `json:"customer_id"`
+	WidgetID int `json:"widget_id"`
+	StripeSubscriptionID string `json:"stripe_subscription_id"`
+	Status string `json:"status"`
+	CurrentPeriodStart time.Time `json:"current_period_start"`
+	CurrentPeriodEnd time.Time `json:"current_period_end"`
+	TrialEnd time.Time `json:"trial_end"` //zero sem periodo de teste
+	Paused bool `json:"paused"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Plan Widget `json:"plan"`
+}
+
+//live é a subscription ainda cobrada, sem cancelamento agendado
+func (s *Subscription) live() bool {
+	return s.Status == SubscriptionTrialing || s.Status == SubscriptionActive || s.Status == SubscriptionPastDue
+}
+
+//SetStatus muda o estado respeitando a maquina de estados
+func (s *Subscription) SetStatus(to string) error {
+	if s.Status == to {
+		return nil
+	}
+	if !CanTransition(s.Status, to) {
+		return &InvalidTransitionError{From: s.Status, To: to}
+	}
+	s.Status = to
+	return nil
+}
+
+//Cancel agenda o cancelamento para o fim do periodo
+func (s *Subscription) Cancel() error {
+	if s.Status == SubscriptionCanceled {
+		return &InvalidTransitionError{From: s.Status, To: SubscriptionCanceled}
+	}
+	return s.SetStatus(SubscriptionCanceled)
+}
+
+//Reactivate desfaz o cancelamento agendado, volta para trialing se o teste ainda nao acabou
+func (s *Subscription) Reactivate(now time.Time) error {
+	if s.Status != SubscriptionCanceled || !now.Before(s.CurrentPeriodEnd) {
+		return &InvalidTransitionError{From: s.Status, To: SubscriptionActive}
+	}
+	if now.Before(s.TrialEnd) {
+		return s.SetStatus(SubscriptionTrialing)
+	}
+	return s.SetStatus(SubscriptionActive)
+}
+
+//Pause suspende a cobranca, o estado nao muda
+func (s *Subscription) Pause() error {
+	if s.Paused || !s.live() {
+		return &InvalidTransitionError{From: s.Status, To: "paused"}
+	}
+	s.Paused = true
+	return nil
+}
+
+func (s *Subscription) Resume() error {
+	if !s.Paused || s.Status == SubscriptionEnded {
+		return &InvalidTransitionError{From: s.Status, To: "resumed"}
+	}
+	s.Paused = false
+	return nil
+}
+
+//ChangePlan troca o plano da subscription, apenas com a subscription sendo cobrada
+func (s *Subscription) ChangePlan(plan Widget) error {
+	if !s.live() || !plan.IsRecurring {
+		return &InvalidTransitionError{From: s.Status, To: "plan change"}
+	}
+	if plan.ID == s.WidgetID {
+		return ErrSamePlan
+	}
+	s.WidgetID = plan.ID
+	s.Plan = plan
+	return nil
+}
+
+const subscriptionColumns = `s.id, s.order_id, s.customer_id, s.widget_id, s.stripe_subscription_id, s.status,
+	s.current_period_start, s.current_period_end, s.trial_end, s.paused, s.created_at, s.updated_at,
+	w.id, w.name, w.price, w.plan_id, w.slug, w.plan_interval`
+
+func scanSubscription(row scanner, s *Subscription) error {
+	var trialEnd sql.NullTime
+	err := row.Scan(
+		&s.ID,
+		&s.OrderID,
+		&s.CustomerID,
+		&s.WidgetID,
+		&s.StripeSubscriptionID,
+		&s.Status,
+		&s.CurrentPeriodStart,
+		&s.CurrentPeriodEnd,
+		&trialEnd,
+		&s.Paused,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+		&s.Plan.ID,
+		&s.Plan.Name,
+		&s.Plan.Price,
+		&s.Plan.PlanID,
+		&s.Plan.Slug,
+		&s.Plan.Interval,
+	)
+	if err != nil {
+		return err
+	}
+	s.Plan.IsRecurring = true
+	if trialEnd.Valid {
+		s.TrialEnd = trialEnd.Time
+	}
+	return nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+//InsertSubscription grava a subscription criada no gateway para a order
+func (m *DbModel) InsertSubscription(s Subscription) (int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	if _, ok := subscriptionTransitions[s.Status]; !ok {
+		return 0, fmt.Errorf("invalid subscription status %q", s.Status)
+	}
+
+	stmt := `
+		insert into subscriptions (order_id, customer_id, widget_id, stripe_subscription_id, status,
+			current_period_start, current_period_end, trial_end, paused, created_at, updated_at)
+		values(?,?,?,?,?,?,?,?,?,?,?)
+	`
+	result,err := m.DB.ExecContext(ctx, stmt,
+		s.OrderID,
+		s.CustomerID,
+		s.WidgetID,
+		s.StripeSubscriptionID,
+		s.Status,
+		s.CurrentPeriodStart,
+		s.CurrentPeriodEnd,
+		nullTime(s.TrialEnd),
+		s.Paused,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id,err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+func (m *DbModel) getSubscription(where string, arg interface{}) (Subscription, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var s Subscription
+
+	query := `select ` + subscriptionColumns + ` from subscriptions s left join widgets w on (s.widget_id = w.id) where ` + where
+	row := m.DB.QueryRowContext(ctx, query, arg)
+	err := scanSubscription(row, &s)
+	if err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func (m *DbModel) GetSubscription(id int) (Subscription, error) {
+	return m.getSubscription(`s.id = ?`, id)
+}
+
+func (m *DbModel) GetSubscriptionByOrderID(orderID int) (Subscription, error) {
+	return m.getSubscription(`s.order_id = ?`, orderID)
+}
+
+func (m *DbModel) GetSubscriptionByStripeID(stripeID string) (Subscription, error) {
+	return m.getSubscription(`s.stripe_subscription_id = ?`, stripeID)
+}
+
+//UpdateSubscription trava a subscription, aplica fn e grava o resultado. fn recebe o estado
+//atual do banco e usa os metodos de Subscription, que recusam as transicoes invalidas.
+//O status da order acompanha a subscription: 3 cancelada ou encerrada, 1 nos demais
+func (m *DbModel) UpdateSubscription(id int, fn func(s *Subscription) error) (Subscription, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var s Subscription
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		query := `select ` + subscriptionColumns + ` from subscriptions s left join widgets w on (s.widget_id = w.id)
+			where s.id = ? for update`
+		err := scanSubscription(tx.DB.QueryRowContext(ctx, query, id), &s)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&s)
+		if err != nil {
+			return err
+		}
+
+		_,err = tx.DB.ExecContext(ctx, `
+			update subscriptions set widget_id = ?, status = ?, current_period_start = ?, current_period_end = ?,
+				trial_end = ?, paused = ?, updated_at = ?
+			where id = ?`,
+			s.WidgetID,
+			s.Status,
+			s.CurrentPeriodStart,
+			s.CurrentPeriodEnd,
+			nullTime(s.TrialEnd),
+			s.Paused,
+			time.Now(),
+			s.ID,
+		)
+		if err != nil {
+			return err
+		}
+
+		orderStatus := 1
+		if s.Status == SubscriptionCanceled || s.Status == SubscriptionEnded {
+			orderStatus = 3
+		}
+		_,err = tx.DB.ExecContext(ctx, `update orders set status_id = ?, updated_at = ? where id = ?`,
+			orderStatus, time.Now(), s.OrderID)
+		return err
+	})
+	if err != nil {
+		return s, err
+	}
+	return s, nil
+}
@@ -0,0 +1,323 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//motivos gravados na auditoria das falhas de autenticacao
+const (
+	AuthFailurePassword = "password"
+	AuthFailureUnknownEmail = "unknown-email"
+	AuthFailureTwoFactor = "two-factor"
+	AuthFailureBlocked = "blocked"
+	AuthFailureToken = "token"
+	AuthFailureAPIKey = "api-key"
+)
+
+//ThrottlePolicy define a espera depois das falhas de login. As primeiras FreeAttempts falhas nao
+//esperam, as seguintes dobram a espera a partir de BaseDelay ate MaxDelay e com LockoutAfter falhas
+//o login fica bloqueado por LockoutFor. Falhas mais antigas que Window sao esquecidas
+type ThrottlePolicy struct {
+	FreeAttempts int
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+	LockoutAfter int
+	LockoutFor time.Duration
+	Window time.Duration
+}
+
+var (
+	//por email, mesmo os que nao estao cadastrados, a resposta nao mostra se o email existe
+	AccountThrottle = ThrottlePolicy{
+		FreeAttempts: 3,
+		BaseDelay: 2 * time.Second,
+		MaxDelay: 5 * time.Minute,
+		LockoutAfter: 10,
+		LockoutFor: time.Hour,
+		Window: 24 * time.Hour,
+	}
+	//por ip, mais tolerante porque varios usuarios podem sair pelo mesmo ip
+	IPThrottle = ThrottlePolicy{
+		FreeAttempts: 10,
+		BaseDelay: time.Second,
+		MaxDelay: 5 * time.Minute,
+		LockoutAfter: 100,
+		LockoutFor: time.Hour,
+		Window: time.Hour,
+	}
+)
+
+//Delay é a espera depois de failures falhas seguidas
+func (p ThrottlePolicy) Delay(failures int) time.Duration {
+	if failures >= p.LockoutAfter {
+		return p.LockoutFor
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+func AccountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+type Throttle struct {
+	Key string `json:"key"`
+	Subject string `json:"subject"` //email ou ip do throttle_key
+	Failures int `json:"failures"`
+	BlockedUntil time.Time `json:"blocked_until"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	Locked bool `json:"locked"` //bloqueio longo, desfeito pelo email de desbloqueio ou por um admin
+}
+
+//LoginBlockedError é retornado enquanto o email ou o ip estao esperando depois das falhas
+type LoginBlockedError struct {
+	Until time.Time
+	Locked bool
+}
+
+func (e *LoginBlockedError) Error() string {
+	if e.Locked {
+		return "too many failed attempts, the login is locked, check your email to unlock it"
+	}
+	return fmt.Sprintf("too many failed attempts, try again in %s", time.Until(e.Until).Round(time.Second))
+}
+
+//RetryAfter é o tempo em segundos para o header Retry-After
+func (e *LoginBlockedError) RetryAfter() int {
+	seconds := int(time.Until(e.Until).Seconds()) + 1
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+type AuthFailure struct {
+	ID int `json:"id"`
+	UserID int `json:"user_id"` //0 quando o email nao esta cadastrado
+	Email string `json:"email"`
+	IP string `json:"ip"`
+	Reason string `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (m *DbModel) GetThrottle(key string) (Throttle, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	t := Throttle{Key: key}
+	var blockedUntil sql.NullTime
+	row := m.DB.QueryRowContext(ctx, `select failures, blocked_until, last_failure_at from login_throttles where throttle_key = ?`, key)
+	err := row.Scan(&t.Failures, &blockedUntil, &t.LastFailureAt)
+	if err == sql.ErrNoRows {
+		return t, nil
+	} else if err != nil {
+		return t, err
+	}
+	if blockedUntil.Valid {
+		t.BlockedUntil = blockedUntil.Time
+	}
+	return t, nil
+}
+
+//CheckLogin retorna LoginBlockedError se o email ou o ip ainda estao esperando
+func (m *DbModel) CheckLogin(email, ip string) error {
+	account, err := m.GetThrottle(AccountThrottleKey(email))
+	if err != nil {
+		return err
+	}
+	address, err := m.GetThrottle(IPThrottleKey(ip))
+	if err != nil {
+		return err
+	}
+
+	blocked := &LoginBlockedError{}
+	if time.Now().Before(account.BlockedUntil) {
+		blocked.Until = account.BlockedUntil
+		blocked.Locked = account.Failures >= AccountThrottle.LockoutAfter
+	}
+	if time.Now().Before(address.BlockedUntil) && address.BlockedUntil.After(blocked.Until) {
+		blocked.Until = address.BlockedUntil
+	}
+	if blocked.Until.IsZero() {
+		return nil
+	}
+	return blocked
+}
+
+//recordThrottleFailure soma a falha e calcula ate quando o login espera
+func (m *DbModel) recordThrottleFailure(ctx context.Context, key string, policy ThrottlePolicy) (Throttle, error) {
+	t := Throttle{Key: key}
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		now := time.Now()
+		_,err := tx.DB.ExecContext(ctx, `
+			insert into login_throttles (throttle_key, failures, last_failure_at, created_at, updated_at) values(?,0,?,?,?)
+			on duplicate key update throttle_key = throttle_key`, key, now, now, now)
+		if err != nil {
+			return err
+		}
+
+		row := tx.DB.QueryRowContext(ctx, `select failures, last_failure_at from login_throttles where throttle_key = ? for update`, key)
+		err = row.Scan(&t.Failures, &t.LastFailureAt)
+		if err != nil {
+			return err
+		}
+
+		if now.Sub(t.LastFailureAt) > policy.Window {
+			t.Failures = 0
+		}
+		t.Failures++
+		t.LastFailureAt = now
+		t.BlockedUntil = now.Add(policy.Delay(t.Failures))
+		t.Locked = t.Failures >= policy.LockoutAfter
+
+		_,err = tx.DB.ExecContext(ctx, `
+			update login_throttles set failures = ?, blocked_until = ?, last_failure_at = ?, updated_at = ? where throttle_key = ?`,
+			t.Failures, t.BlockedUntil, now, now, key)
+		return err
+	})
+	return t, err
+}
+
+//RecordLoginFailure grava a falha na auditoria e soma nos throttles do email e do ip.
+//Retorna true quando esta falha bloqueou o email, para enviar o email de desbloqueio uma vez
+func (m *DbModel) RecordLoginFailure(f AuthFailure) (bool, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	err := m.InsertAuthFailure(f)
+	if err != nil {
+		return false, err
+	}
+
+	_,err = m.recordThrottleFailure(ctx, IPThrottleKey(f.IP), IPThrottle)
+	if err != nil {
+		return false, err
+	}
+	if f.Email == "" {
+		return false, nil
+	}
+	account, err := m.recordThrottleFailure(ctx, AccountThrottleKey(f.Email), AccountThrottle)
+	if err != nil {
+		return false, err
+	}
+	return account.Failures == AccountThrottle.LockoutAfter, nil
+}
+
+//ResetThrottle apaga as falhas, usado no login certo e no desbloqueio
+func (m *DbModel) ResetThrottle(key string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `delete from login_throttles where throttle_key = ?`, key)
+	return err
+}
+
+//UnlockAccount desfaz o bloqueio do email, pelo link enviado por email ou por um admin
+func (m *DbModel) UnlockAccount(email string) error {
+	return m.ResetThrottle(AccountThrottleKey(email))
+}
+
+//GetBlockedAccounts lista os emails esperando ou bloqueados
+func (m *DbModel) GetBlockedAccounts() ([]*Throttle, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	throttles := []*Throttle{}
+
+	rows,err := m.DB.QueryContext(ctx, `
+		select throttle_key, failures, blocked_until, last_failure_at from login_throttles
+		where throttle_key like 'account:%' and blocked_until > ?
+		order by blocked_until desc`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Throttle
+		err = rows.Scan(&t.Key, &t.Failures, &t.BlockedUntil, &t.LastFailureAt)
+		if err != nil {
+			return nil, err
+		}
+		t.Subject = strings.TrimPrefix(t.Key, "account:")
+		t.Locked = t.Failures >= AccountThrottle.LockoutAfter
+		throttles = append(throttles, &t)
+	}
+	return throttles, rows.Err()
+}
+
+func (m *DbModel) InsertAuthFailure(f AuthFailure) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var userID sql.NullInt64
+	if f.UserID > 0 {
+		userID = sql.NullInt64{Int64: int64(f.UserID), Valid: true}
+	}
+	email := f.Email
+	if len(email) > 255 {
+		email = email[:255]
+	}
+
+	_,err := m.DB.ExecContext(ctx, `
+		insert into auth_failures (user_id, email, ip, reason, created_at, updated_at) values(?,?,?,?,?,?)`,
+		userID, email, f.IP, f.Reason, time.Now(), time.Now())
+	return err
+}
+
+func (m *DbModel) GetAuthFailuresPaginated(pageSize, page int) ([]*AuthFailure, int, int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	failures := []*AuthFailure{}
+
+	rows,err := m.DB.QueryContext(ctx, `
+		select id, coalesce(user_id, 0), email, ip, reason, created_at
+		from auth_failures
+		order by created_at desc, id desc
+		limit ? offset ?`, pageSize, offset)
+	if err != nil {
+		return nil,0,0,err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f AuthFailure
+		err = rows.Scan(&f.ID, &f.UserID, &f.Email, &f.IP, &f.Reason, &f.CreatedAt)
+		if err != nil {
+			return nil,0,0,err
+		}
+		failures = append(failures, &f)
+	}
+	if err = rows.Err(); err != nil {
+		return nil,0,0,err
+	}
+
+	var totalRecords int
+	err = m.DB.QueryRowContext(ctx, `select count(id) from auth_failures`).Scan(&totalRecords)
+	if err != nil {
+		return nil,0,0,err
+	}
+	lastPage := totalRecords / pageSize
+
+	return failures, lastPage, totalRecords, nil
+}
@@ -4,21 +4,49 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base32"
-	"log"
 	"time"
 )
 
+//scopes dos tokens. authentication tem o acesso do papel do usuario,
+//read-only apenas as permissoes de leitura do papel. two-factor é o token entre a senha e
+//o codigo do 2FA e two-factor-setup permite apenas cadastrar o 2FA exigido pelo papel
 const (
 	ScopeAuthentication = "authentication"
+	ScopeReadOnly = "read-only"
+	ScopeTwoFactor = "two-factor"
+	ScopeTwoFactorSetup = "two-factor-setup"
 )
 
+var Scopes = []string{ScopeAuthentication, ScopeReadOnly}
+
+func ValidScope(scope string) bool {
+	return scope == ScopeAuthentication || scope == ScopeReadOnly
+}
+
+//ScopeAllows informa se o scope do token permite usar a permissao
+func ScopeAllows(scope, permission string) bool {
+	switch scope {
+	case ScopeAuthentication:
+		return true
+	case ScopeReadOnly:
+		return permission == PermSalesRead || permission == PermPlansRead || permission == PermUsersRead
+	}
+	return false
+}
+
 type Token struct {
-	PlanText string `json:"token"`
+	ID int `json:"id"`
+	Name string `json:"name"`
+	PlanText string `json:"token,omitempty"` //apenas na criacao, no banco fica so o hash
 	UserID int64 `json:"-"`
 	Hash []byte `json:"-"`
 	Expiry time.Time `json:"expiry"`
-	Scope string `json:"-"`
+	Scope string `json:"scope"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	CreatedAt time.Time `json:"created_at"`
+	Current bool `json:"current"` //token usado no request que listou os tokens
 }
 
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
@@ -40,25 +68,31 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	return token, nil
 }
 
+//InsertToken salva mais um token do usuario, os tokens ja existentes continuam validos
 func (m *DbModel) InsertToken(t *Token, user User) error {
 	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
 	defer cancel()
 
-	//verificar se usuario ja tem token registrado e deletar o token existente
-	stmt := `delete from tokens where user_id=?`
-	_, err := m.DB.ExecContext(ctx,stmt, user.ID)
+	//limpar os tokens vencidos do usuario
+	stmt := `delete from tokens where user_id = ? and expiry <= ?`
+	_, err := m.DB.ExecContext(ctx,stmt, user.ID, time.Now())
 	if err != nil {
 		return err
 	}
 
-	stmt = `insert into tokens (user_id, name, email, token_hash, expiry, created_at, updated_at)
-		values(?,?,?,?,?,?,?)`
+	if t.Name == "" {
+		t.Name = "Token"
+	}
+
+	stmt = `insert into tokens (user_id, name, email, token_hash, scope, expiry, created_at, updated_at)
+		values(?,?,?,?,?,?,?,?)`
 	
-	_,err = m.DB.ExecContext(ctx, stmt,
+	result,err := m.DB.ExecContext(ctx, stmt,
 		user.ID,
-		user.LastName,
+		t.Name,
 		user.Email,
 		t.Hash,
+		t.Scope,
 		t.Expiry,
 		time.Now(),
 		time.Now(),
@@ -66,30 +100,143 @@ func (m *DbModel) InsertToken(t *Token, user User) error {
 	if err != nil {
 		return err
 	}
+
+	id,err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	t.ID = int(id)
+	t.CreatedAt = time.Now()
 	return nil
 }
 
-func (m *DbModel) GetUserForToken(token string) (*User, error) {
+//GetUserForToken retorna o dono do token valido com o scope pedido e registra o uso do token
+func (m *DbModel) GetUserForToken(token, scope string) (*User, error) {
 	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
 	defer cancel()
 
 	tokenHash := sha256.Sum256([]byte(token))
 	var user User
+	var tokenID int
 
 	query := `
-		select u.id, u.first_name, u.last_name, u.email from users u inner join tokens t on (u.id = t.user_id)
-		where t.token_hash = ? and t.expiry > ?
+		select t.id, u.id, u.first_name, u.last_name, u.email, u.role from users u inner join tokens t on (u.id = t.user_id)
+		where t.token_hash = ? and t.scope = ? and t.expiry > ?
 	`
-	err := m.DB.QueryRowContext(ctx,query,tokenHash[:], time.Now()).Scan(
+	err := m.DB.QueryRowContext(ctx,query,tokenHash[:], scope, time.Now()).Scan(
+		&tokenID,
 		&user.ID,
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&user.Role,
 	)
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+
+	//last_used_at gravado no maximo uma vez por minuto para nao escrever a cada request
+	_,err = m.DB.ExecContext(ctx, `
+		update tokens set last_used_at = ? where id = ? and (last_used_at is null or last_used_at < ?)`,
+		time.Now(), tokenID, time.Now().Add(-time.Minute))
+	if err != nil {
 		return nil, err
 	}
 
 	return &user,nil
-}
\ No newline at end of file
+}
+
+//GetTokensForUser lista os tokens validos do usuario, sem o texto do token. Os tokens
+//intermediarios do login com 2FA nao aparecem
+func (m *DbModel) GetTokensForUser(userID int) ([]*Token, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	tokens := []*Token{}
+
+	query := `
+		select id, user_id, name, token_hash, scope, expiry, last_used_at, created_at
+		from tokens
+		where user_id = ? and expiry > ? and scope not in (?, ?)
+		order by created_at desc
+	`
+	rows,err := m.DB.QueryContext(ctx, query, userID, time.Now(), ScopeTwoFactor, ScopeTwoFactorSetup)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Token
+		var lastUsed sql.NullTime
+		err = rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Name,
+			&t.Hash,
+			&t.Scope,
+			&t.Expiry,
+			&lastUsed,
+			&t.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = lastUsed.Time
+		}
+		tokens = append(tokens, &t)
+	}
+
+	return tokens, rows.Err()
+}
+
+//DeleteTokenForUser revoga um token do usuario, retorna sql.ErrNoRows se o token nao é dele
+func (m *DbModel) DeleteTokenForUser(id, userID int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	result,err := m.DB.ExecContext(ctx, `delete from tokens where id = ? and user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+//DeleteToken revoga o token pelo texto, usado no logout
+func (m *DbModel) DeleteToken(token string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+	_,err := m.DB.ExecContext(ctx, `delete from tokens where token_hash = ?`, tokenHash[:])
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//DeleteTokensForUser revoga todos os tokens do usuario, o logout em todos os lugares. Na mesma
+//transacao as sessoes do site criadas antes sao revogadas, como no reset de senha
+func (m *DbModel) DeleteTokensForUser(userID int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DbModel) error {
+		now := time.Now()
+		_,err := tx.DB.ExecContext(ctx, `update users set sessions_revoked_at = ?, updated_at = ? where id = ?`, now, now, userID)
+		if err != nil {
+			return err
+		}
+
+		_,err = tx.DB.ExecContext(ctx, `delete from tokens where user_id = ?`, userID)
+		return err
+	})
+}
@@ -0,0 +1,287 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPCodeUsed = errors.New("this code was already used")
+	ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+)
+
+//RecoveryCodeCount é quantos codigos de recuperacao o usuario recebe ao ativar o 2FA
+const RecoveryCodeCount = 10
+
+//TOTP é o segredo do 2FA do usuario, Secret fica criptografado no banco
+type TOTP struct {
+	Secret string
+	Enabled bool
+	LastCounter int64
+}
+
+//GenerateRecoveryCodes cria os codigos de uso unico no formato xxxxx-xxxxx
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		code, err := randomString(7)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:10]
+	}
+	return codes, nil
+}
+
+//o codigo é conferido sem o traco e sem diferenciar maiusculas
+func recoveryCodeHash(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+func (m *DbModel) GetTOTP(userID int) (TOTP, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var t TOTP
+	var secret sql.NullString
+	row := m.DB.QueryRowContext(ctx, `select totp_secret, two_factor_enabled, totp_last_counter from users where id = ?`, userID)
+	err := row.Scan(&secret, &t.Enabled, &t.LastCounter)
+	if err != nil {
+		return t, err
+	}
+	t.Secret = secret.String
+	return t, nil
+}
+
+//SaveTOTPSecret guarda o segredo do cadastro, o 2FA so fica ativo depois de ConfirmTwoFactor
+func (m *DbModel) SaveTOTPSecret(userID int, secret string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	result,err := m.DB.ExecContext(ctx, `
+		update users set totp_secret = ?, totp_last_counter = 0, updated_at = ? where id = ? and two_factor_enabled = false`,
+		secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+//UseTOTPCounter registra o intervalo do codigo aceito, o mesmo codigo nao é aceito de novo
+func (m *DbModel) UseTOTPCounter(userID int, counter int64) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	result,err := m.DB.ExecContext(ctx, `update users set totp_last_counter = ? where id = ? and totp_last_counter < ?`,
+		counter, userID, counter)
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+//ConfirmTwoFactor ativa o 2FA depois do primeiro codigo valido e grava os codigos de recuperacao
+func (m *DbModel) ConfirmTwoFactor(userID int, counter int64, recoveryCodes []string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DbModel) error {
+		result,err := tx.DB.ExecContext(ctx, `
+			update users set two_factor_enabled = true, totp_last_counter = ?, updated_at = ?
+			where id = ? and two_factor_enabled = false and totp_secret is not null`,
+			counter, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+		n,err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrTwoFactorEnabled
+		}
+		return tx.ReplaceRecoveryCodes(userID, recoveryCodes)
+	})
+}
+
+//DisableTwoFactor apaga o segredo e os codigos de recuperacao
+func (m *DbModel) DisableTwoFactor(userID int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DbModel) error {
+		_,err := tx.DB.ExecContext(ctx, `
+			update users set totp_secret = null, two_factor_enabled = false, totp_last_counter = 0, updated_at = ?
+			where id = ?`, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+		_,err = tx.DB.ExecContext(ctx, `delete from recovery_codes where user_id = ?`, userID)
+		return err
+	})
+}
+
+//ReplaceRecoveryCodes troca os codigos de recuperacao, os antigos deixam de valer
+func (m *DbModel) ReplaceRecoveryCodes(userID int, codes []string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DbModel) error {
+		_,err := tx.DB.ExecContext(ctx, `delete from recovery_codes where user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			_,err = tx.DB.ExecContext(ctx, `
+				insert into recovery_codes (user_id, code_hash, created_at, updated_at) values(?,?,?,?)`,
+				userID, recoveryCodeHash(code), time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//UseRecoveryCode gasta um codigo de recuperacao, cada codigo vale uma vez
+func (m *DbModel) UseRecoveryCode(userID int, code string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	result,err := m.DB.ExecContext(ctx, `
+		update recovery_codes set used_at = ?, updated_at = ? where user_id = ? and code_hash = ? and used_at is null`,
+		time.Now(), time.Now(), userID, recoveryCodeHash(code))
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidRecoveryCode
+	}
+	return nil
+}
+
+//RecoveryCodesLeft conta os codigos de recuperacao ainda nao usados
+func (m *DbModel) RecoveryCodesLeft(userID int) (int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var count int
+	row := m.DB.QueryRowContext(ctx, `select count(id) from recovery_codes where user_id = ? and used_at is null`, userID)
+	err := row.Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+//GetTwoFactorRoles retorna quais papeis exigem 2FA
+func (m *DbModel) GetTwoFactorRoles() (map[string]bool, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	roles := make(map[string]bool)
+	for _, role := range Roles {
+		roles[role] = false
+	}
+
+	rows,err := m.DB.QueryContext(ctx, `select role, require_two_factor from role_settings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role string
+		var required bool
+		err = rows.Scan(&role, &required)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := roles[role]; ok {
+			roles[role] = required
+		}
+	}
+	return roles, rows.Err()
+}
+
+//RoleRequiresTwoFactor informa se o papel exige 2FA no login
+func (m *DbModel) RoleRequiresTwoFactor(role string) (bool, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var required bool
+	row := m.DB.QueryRowContext(ctx, `select require_two_factor from role_settings where role = ?`, role)
+	err := row.Scan(&required)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return required, nil
+}
+
+//SetRoleRequiresTwoFactor liga ou desliga a exigencia de 2FA no papel. Ao ligar, os tokens e as
+//sessoes do site dos usuarios do papel sem 2FA sao revogados na mesma transacao, inclusive os
+//tokens de CreateToken que valem ate um ano. Retorna quantos usuarios tiveram o acesso revogado
+func (m *DbModel) SetRoleRequiresTwoFactor(role string, required bool) (int, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var revoked int
+	err := m.WithTx(ctx, func(tx *DbModel) error {
+		now := time.Now()
+		_,err := tx.DB.ExecContext(ctx, `
+			insert into role_settings (role, require_two_factor, created_at, updated_at) values(?,?,?,?)
+			on duplicate key update require_two_factor = values(require_two_factor), updated_at = values(updated_at)`,
+			role, required, now, now)
+		if err != nil || !required {
+			return err
+		}
+
+		result,err := tx.DB.ExecContext(ctx, `
+			update users set sessions_revoked_at = ?, updated_at = ? where role = ? and two_factor_enabled = false`,
+			now, now, role)
+		if err != nil {
+			return err
+		}
+		n,err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		revoked = int(n)
+
+		_,err = tx.DB.ExecContext(ctx, `
+			delete t from tokens t join users u on (t.user_id = u.id)
+			where u.role = ? and u.two_factor_enabled = false`, role)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
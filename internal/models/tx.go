@@ -0,0 +1,48 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+//DBTX é implementado por *sql.DB e *sql.Tx, todo metodo do DbModel funciona nos dois
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+//WithTx executa fn dentro de uma transacao. Os metodos chamados no DbModel recebido por fn
+//gravam na transacao, que tem commit se fn retornar nil e rollback se retornar erro ou panic.
+//Chamado dentro de outro WithTx reutiliza a transacao aberta
+func (m *DbModel) WithTx(ctx context.Context, fn func(tx *DbModel) error) (err error) {
+	if _, ok := m.DB.(*sql.Tx); ok {
+		return fn(m)
+	}
+
+	db, ok := m.DB.(*sql.DB)
+	if !ok {
+		return errors.New("models: WithTx needs a *sql.DB")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(&DbModel{DB: tx})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
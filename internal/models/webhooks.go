@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+//evento recebido do webhook do stripe
+type StripeEvent struct {
+	ID int `json:"id"`
+	EventID string `json:"event_id"`
+	Type string `json:"type"`
+	Payload string `json:"-"`
+	ProcessedAt sql.NullTime `json:"processed_at"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+//o evento ja foi processado ou esta sendo processado por outra entrega
+var (
+	ErrStripeEventProcessed = errors.New("the stripe event was already processed")
+	ErrStripeEventClaimed = errors.New("the stripe event is being processed")
+)
+
+//ClaimStripeEvent salva o evento recebido e reserva o processamento dele ate lease. So uma entrega
+//consegue a reserva, as outras recebem ErrStripeEventProcessed ou ErrStripeEventClaimed
+func (m *DbModel) ClaimStripeEvent(e StripeEvent, lease time.Duration) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	//o stripe pode reenviar o mesmo evento, event_id é unico
+	stmt := `
+		insert into stripe_events (event_id, event_type, payload, created_at, updated_at)
+		values(?,?,?,?,?)
+		on duplicate key update updated_at = values(updated_at)
+	`
+	_,err := m.DB.ExecContext(ctx, stmt, e.EventID, e.Type, e.Payload, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	//o update com a condicao é atomico, duas entregas ao mesmo tempo nao pegam o evento
+	result,err := m.DB.ExecContext(ctx, `
+		update stripe_events set claimed_until = ?, updated_at = ?
+		where event_id = ? and processed_at is null and (claimed_until is null or claimed_until < ?)`,
+		time.Now().Add(lease), time.Now(), e.EventID, time.Now())
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		return nil
+	}
+
+	var processedAt sql.NullTime
+	row := m.DB.QueryRowContext(ctx, `select processed_at from stripe_events where event_id = ?`, e.EventID)
+	err = row.Scan(&processedAt)
+	if err != nil {
+		return err
+	}
+	if processedAt.Valid {
+		return ErrStripeEventProcessed
+	}
+	return ErrStripeEventClaimed
+}
+
+//ReleaseStripeEvent libera a reserva quando o handler falhou, o reenvio do stripe processa de novo
+func (m *DbModel) ReleaseStripeEvent(eventID string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	_,err := m.DB.ExecContext(ctx, `update stripe_events set claimed_until = null, updated_at = ? where event_id = ?`,
+		time.Now(), eventID)
+	return err
+}
+
+func (m *DbModel) MarkStripeEventProcessed(eventID string) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `update stripe_events set processed_at = ?, claimed_until = null, updated_at = ? where event_id = ?`
+	_,err := m.DB.ExecContext(ctx, stmt, time.Now(), time.Now(), eventID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//pegar a transaction pelo payment intent ou id da subscription salvo em payment_intent
+func (m *DbModel) GetTransactionByPaymentIntent(pi string) (Transaction, error) {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	var t Transaction
+
+	query := `
+		select id, amount, currency, last_four, expiry_month, expiry_year, payment_intent,
+			payment_method, bank_return_code, transaction_status_id, created_at, updated_at
+		from transactions
+		where payment_intent = ?
+		order by id
+		limit 1
+	`
+
+	row := m.DB.QueryRowContext(ctx, query, pi)
+	err := row.Scan(
+		&t.ID,
+		&t.Amount,
+		&t.Currency,
+		&t.LastFour,
+		&t.ExpiryMonth,
+		&t.ExpiryYear,
+		&t.PaymentIntent,
+		&t.PaymentMethod,
+		&t.BankReturnCode,
+		&t.TarnsactionStatusID,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	if err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func (m *DbModel) UpdateTransactionStatus(id, statusID int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `update transactions set transaction_status_id = ?, updated_at = ? where id = ?`
+	_,err := m.DB.ExecContext(ctx, stmt, statusID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//atualiza o status de todas orders ligadas a uma transaction
+func (m *DbModel) UpdateOrderStatusByTransactionID(transactionID, statusID int) error {
+	ctx,cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	stmt := `update orders set status_id = ?, updated_at = ? where transaction_id = ?`
+	_,err := m.DB.ExecContext(ctx, stmt, statusID, time.Now(), transactionID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
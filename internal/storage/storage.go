@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrNotFound = errors.New("storage: object not found")
+
+//Storage guarda os pdfs das invoices e notas de credito pela chave, como INV-2023-000001.pdf
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	//Get retorna ErrNotFound quando a chave nao existe, quem chama fecha o reader
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+//validKey recusa chaves que sairiam do diretorio ou do bucket
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("storage: invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("storage: invalid key %q", key)
+		}
+	}
+	return nil
+}
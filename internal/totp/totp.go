@@ -0,0 +1,113 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//codigos do RFC 6238 no formato usado pelos apps autenticadores: sha1, 6 digitos, 30 segundos
+const (
+	Digits = 6
+	Period = 30
+)
+
+//Clock da a hora usada na validacao dos codigos, o login pode ser testado com FixedClock
+type Clock interface {
+	Now() time.Time
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+type FixedClock struct {
+	Time time.Time
+}
+
+func (c FixedClock) Now() time.Time {
+	return c.Time
+}
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//GenerateSecret cria o segredo compartilhado com o app autenticador, em base32
+func GenerateSecret() (string, error) {
+	secret := make([]byte, 20)
+	_,err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+//ProvisioningURI monta a uri otpauth:// que o app autenticador le pelo QR code
+func ProvisioningURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(Period))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+//Counter é o numero do intervalo de 30 segundos da hora t
+func Counter(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+//CodeAt calcula o codigo do intervalo counter
+func CodeAt(secret string, counter int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value % 1000000), nil
+}
+
+//Validate confere o codigo na hora t aceitando um intervalo antes e um depois pela diferenca
+//de relogio. Retorna o intervalo do codigo, codigos de intervalos ate lastCounter ja foram usados
+//e sao recusados para o mesmo codigo nao servir duas vezes
+func Validate(secret, code string, t time.Time, lastCounter int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	now := Counter(t)
+	for counter := now - 1; counter <= now + 1; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		expected, err := CodeAt(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,102 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//segredo "12345678901234567890" dos vetores do RFC 6238, em base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeAtRFC6238(t *testing.T) {
+	//os ultimos 6 digitos dos codigos sha1 de 8 digitos do apendice B
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := CodeAt(rfcSecret, Counter(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	//o segredo digitado pelo usuario pode vir em minusculas e com espacos
+	got, _ := CodeAt(" "+strings.ToLower(rfcSecret)+" ", Counter(time.Unix(59, 0)))
+	if got != "287082" {
+		t.Errorf("lowercase secret gave %s", got)
+	}
+	if _, err := CodeAt("not base32!", 1); err == nil {
+		t.Error("an invalid secret was accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := FixedClock{Time: time.Unix(1111111111, 0)}.Now()
+	counter := Counter(now)
+	code := func(c int64) string {
+		s, _ := CodeAt(rfcSecret, c)
+		return s
+	}
+
+	tests := []struct {
+		name string
+		code string
+		lastCounter int64
+		ok bool
+		counter int64
+	}{
+		{"current", code(counter), 0, true, counter},
+		{"with spaces", code(counter)[:3] + " " + code(counter)[3:], 0, true, counter},
+		{"previous period", code(counter - 1), 0, true, counter - 1},
+		{"next period", code(counter + 1), 0, true, counter + 1},
+		{"two periods ago", code(counter - 2), 0, false, 0},
+		{"already used", code(counter), counter, false, 0},
+		{"newer than the last used", code(counter + 1), counter, true, counter + 1},
+		{"short", "12345", 0, false, 0},
+		{"wrong", "000000", 0, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Validate(rfcSecret, tt.code, now, tt.lastCounter)
+			if ok != tt.ok || got != tt.counter {
+				t.Errorf("Validate(%q) = %d, %v, want %d, %v", tt.code, got, ok, tt.counter, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if a == b || len(a) != 32 {
+		t.Errorf("secrets %q and %q", a, b)
+	}
+	if _, err := CodeAt(a, 1); err != nil {
+		t.Errorf("a generated secret is not valid base32: %v", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	got := ProvisioningURI("Widgets", "jane doe@example.com", rfcSecret)
+	want := "otpauth://totp/Widgets:jane%20doe@example.com?algorithm=SHA1&digits=6&issuer=Widgets&period=30&secret=" + rfcSecret
+	if got != want {
+		t.Errorf("ProvisioningURI() =\n%s\nwant\n%s", got, want)
+	}
+}
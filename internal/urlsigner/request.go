@@ -0,0 +1,56 @@
+package urlsigner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//headers das requisicoes assinadas entre a api e o microservico de invoice
+const (
+	HeaderTimestamp = "X-Request-Timestamp"
+	HeaderSignature = "X-Request-Signature"
+)
+
+//requestMessage junta o metodo, o path, a hora e o corpo, a assinatura nao vale para outra rota
+//nem para outro corpo
+func requestMessage(method, path, timestamp string, body []byte) []byte {
+	msg := []byte(method + "\n" + path + "\n" + timestamp + "\n")
+	return append(msg, body...)
+}
+
+func requestSignature(secret, msg []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//SignRequest assina a requisicao com o segredo compartilhado, body é o corpo ja enviado na requisicao
+func SignRequest(req *http.Request, body []byte, secret []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, requestSignature(secret, requestMessage(req.Method, req.URL.EscapedPath(), timestamp, body)))
+}
+
+//VerifyRequest confere a assinatura de SignRequest. Requisicoes assinadas ha mais de maxAge,
+//ou no futuro alem de maxAge, retornam ErrExpired
+func VerifyRequest(r *http.Request, body []byte, secret []byte, now time.Time, maxAge time.Duration) error {
+	timestamp := r.Header.Get(HeaderTimestamp)
+	expected := requestSignature(secret, requestMessage(r.Method, r.URL.EscapedPath(), timestamp, body))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(HeaderSignature))) {
+		return ErrTampered
+	}
+
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrTampered
+	}
+	age := now.Sub(time.Unix(signedAt, 0))
+	if age > maxAge || age < -maxAge {
+		return ErrExpired
+	}
+	return nil
+}
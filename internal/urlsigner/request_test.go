@@ -0,0 +1,66 @@
+package urlsigner
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	secret := []byte("shared-secret")
+	body := []byte(`{"id":42}`)
+	now := time.Date(2023, 9, 21, 12, 0, 0, 0, time.UTC)
+
+	signed := func() *http.Request {
+		req, _ := http.NewRequest("POST", "http://localhost:5001/invoice/create-and-send", nil)
+		SignRequest(req, body, secret, now)
+		return req
+	}
+
+	if err := VerifyRequest(signed(), body, secret, now.Add(time.Minute), 5*time.Minute); err != nil {
+		t.Fatalf("a signed request was rejected: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		change func(r *http.Request) ([]byte, []byte, time.Time)
+		want error
+	}{
+		{"other body", func(r *http.Request) ([]byte, []byte, time.Time) {
+			return []byte(`{"id":43}`), secret, now
+		}, ErrTampered},
+		{"other route", func(r *http.Request) ([]byte, []byte, time.Time) {
+			r.URL.Path = "/credit-note/create-and-send"
+			return body, secret, now
+		}, ErrTampered},
+		{"other secret", func(r *http.Request) ([]byte, []byte, time.Time) {
+			return body, []byte("guess"), now
+		}, ErrTampered},
+		{"changed timestamp", func(r *http.Request) ([]byte, []byte, time.Time) {
+			r.Header.Set(HeaderTimestamp, "1695297660")
+			return body, secret, now
+		}, ErrTampered},
+		{"unsigned", func(r *http.Request) ([]byte, []byte, time.Time) {
+			r.Header.Del(HeaderSignature)
+			r.Header.Del(HeaderTimestamp)
+			return body, secret, now
+		}, ErrTampered},
+		{"old", func(r *http.Request) ([]byte, []byte, time.Time) {
+			return body, secret, now.Add(6 * time.Minute)
+		}, ErrExpired},
+		{"future", func(r *http.Request) ([]byte, []byte, time.Time) {
+			return body, secret, now.Add(-6 * time.Minute)
+		}, ErrExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signed()
+			body, secret, at := tt.change(r)
+			if err := VerifyRequest(r, body, secret, at, 5*time.Minute); !errors.Is(err, tt.want) {
+				t.Errorf("VerifyRequest() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,45 +1,201 @@
 package urlsigner
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
+)
+
+//finalidades dos links assinados, um link de uma finalidade nao vale para outra
+const (
+	PurposePasswordReset = "password-reset"
+	PurposeEmailVerification = "email-verification"
+	PurposeInvoiceDownload = "invoice-download"
+	PurposeUnlockAccount = "unlock-account"
+	PurposeCustomerLogin = "customer-login"
+)
 
-	goalone "github.com/bwmarrin/go-alone"
+//parametros da url usados pela assinatura
+const (
+	paramPurpose = "purpose"
+	paramExpires = "expires"
+	paramKeyID = "kid"
+	paramSignature = "signature"
 )
 
-type Signer struct {
+var (
+	ErrTampered = errors.New("urlsigner: invalid signature")
+	ErrExpired = errors.New("urlsigner: link expired")
+	ErrWrongPurpose = errors.New("urlsigner: link signed for another purpose")
+)
+
+//Key é um segredo de assinatura identificado pelo kid gravado na url
+type Key struct {
+	ID string
 	Secret []byte
 }
 
-func (s *Signer) GenerateTokenFromString(data string) string {
-	var urlToSign string
+//DevelopmentKey assina os links em desenvolvimento quando URL_SIGNING_KEYS nao foi definida,
+//fora de desenvolvimento as chaves sao obrigatorias
+var DevelopmentKey = Key{ID: "dev", Secret: []byte("go-stripe development url signing key")}
+
+//URLSigner assina com a primeira chave e verifica com qualquer uma, para a troca de segredo
+//as chaves antigas ficam na lista ate os links assinados com elas vencerem
+type URLSigner struct {
+	keys []Key
+}
+
+func New(keys ...Key) (*URLSigner, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("urlsigner: no keys")
+	}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if k.ID == "" || len(k.Secret) == 0 {
+			return nil, errors.New("urlsigner: keys need an id and a secret")
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("urlsigner: duplicated key id %q", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return &URLSigner{keys: keys}, nil
+}
 
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	//verificar se a url tem parametros
-	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
-	} else {
-		urlToSign = fmt.Sprintf("%s?hash=",data)
+//ParseKeys le as chaves no formato id:base64,id2:base64, a primeira assina os links novos
+func ParseKeys(spec string) ([]Key, error) {
+	var keys []Key
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("urlsigner: key %q must be id:base64", entry)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("urlsigner: key %s: %w", id, err)
+		}
+		keys = append(keys, Key{ID: id, Secret: secret})
 	}
+	return keys, nil
+}
+
+//Claims sao os dados do link verificado. Values tem os outros parametros da url, todos assinados
+type Claims struct {
+	Purpose string
+	ExpiresAt time.Time
+	Values map[string]string
+}
+
+func (c *Claims) Get(name string) string {
+	return c.Values[name]
+}
+
+func (s *URLSigner) key(id string) (Key, bool) {
+	for _, k := range s.keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+//mensagem assinada: path e query ordenada sem a assinatura, o host fica fora porque
+//o link é verificado atras de proxies com hosts diferentes
+func message(u *url.URL) string {
+	query := u.Query()
+	query.Del(paramSignature)
+	return u.EscapedPath() + "?" + query.Encode()
+}
 
-	tokenBytes := crypt.Sign([]byte(urlToSign))
-	token := string(tokenBytes)
-	return token
+func sign(secret []byte, msg string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
-func (s *Signer) VerifyToken(token string) bool {
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	_,err := crypt.Unsign([]byte(token))
+//Sign assina a url para a finalidade, valida por ttl. Os claims entram na query da url e
+//ficam presos na assinatura, como o id do usuario
+func (s *URLSigner) Sign(rawURL, purpose string, ttl time.Duration, claims map[string]string) (string, error) {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		fmt.Println(err)
-		return false
+		return "", err
 	}
-	return true
+
+	query := u.Query()
+	for _, reserved := range []string{paramPurpose, paramExpires, paramKeyID, paramSignature} {
+		if query.Has(reserved) {
+			return "", fmt.Errorf("urlsigner: the url already has the %s parameter", reserved)
+		}
+		if _, ok := claims[reserved]; ok {
+			return "", fmt.Errorf("urlsigner: %s is not a valid claim name", reserved)
+		}
+	}
+	for name, value := range claims {
+		query.Set(name, value)
+	}
+
+	key := s.keys[0]
+	query.Set(paramPurpose, purpose)
+	query.Set(paramExpires, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	query.Set(paramKeyID, key.ID)
+	u.RawQuery = query.Encode()
+
+	query.Set(paramSignature, sign(key.Secret, message(u)))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
 }
 
-func(s *Signer) Expire(token string, minutesUntilExpire int) bool {
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	ts := crypt.Parse([]byte(token))
-	return time.Since(ts.Timestamp) > time.Duration(minutesUntilExpire) * time.Minute
-}
\ No newline at end of file
+//Verify confere a assinatura, a finalidade e a validade do link e retorna os claims.
+//Os erros sao ErrTampered, ErrWrongPurpose e ErrExpired
+func (s *URLSigner) Verify(rawURL, purpose string) (*Claims, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, ErrTampered
+	}
+
+	query := u.Query()
+	key, ok := s.key(query.Get(paramKeyID))
+	if !ok {
+		return nil, ErrTampered
+	}
+	expected := sign(key.Secret, message(u))
+	if !hmac.Equal([]byte(expected), []byte(query.Get(paramSignature))) {
+		return nil, ErrTampered
+	}
+
+	if query.Get(paramPurpose) != purpose {
+		return nil, ErrWrongPurpose
+	}
+
+	expires, err := strconv.ParseInt(query.Get(paramExpires), 10, 64)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	claims := &Claims{
+		Purpose: purpose,
+		ExpiresAt: time.Unix(expires, 0),
+		Values: make(map[string]string),
+	}
+	if !time.Now().Before(claims.ExpiresAt) {
+		return nil, ErrExpired
+	}
+
+	for name := range query {
+		switch name {
+		case paramPurpose, paramExpires, paramKeyID, paramSignature:
+		default:
+			claims.Values[name] = query.Get(name)
+		}
+	}
+	return claims, nil
+}
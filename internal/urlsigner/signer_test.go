@@ -0,0 +1,143 @@
+package urlsigner
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	keyOld = Key{ID: "2023-08", Secret: []byte("old-secret")}
+	keyNew = Key{ID: "2023-09", Secret: []byte("new-secret")}
+)
+
+func newSigner(t *testing.T, keys ...Key) *URLSigner {
+	t.Helper()
+	s, err := New(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+//muda um parametro da query do link assinado
+func setParam(t *testing.T, link, name, value string) string {
+	t.Helper()
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set(name, value)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func TestSignVerify(t *testing.T) {
+	s := newSigner(t, keyNew, keyOld)
+	link, err := s.Sign("http://localhost:4000/reset-password", PurposePasswordReset, time.Hour, map[string]string{"user": "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(link, "kid="+keyNew.ID) {
+		t.Errorf("link %s was not signed with the primary key", link)
+	}
+
+	claims, err := s.Verify(link, PurposePasswordReset)
+	if err != nil {
+		t.Fatalf("a signed link was rejected: %v", err)
+	}
+	if claims.Get("user") != "42" {
+		t.Errorf("user = %q, want 42", claims.Get("user"))
+	}
+	if claims.Purpose != PurposePasswordReset {
+		t.Errorf("purpose = %q, want %q", claims.Purpose, PurposePasswordReset)
+	}
+	if d := time.Until(claims.ExpiresAt); d <= 0 || d > time.Hour {
+		t.Errorf("expires in %s, want up to one hour", d)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	signed := func(t *testing.T, s *URLSigner, ttl time.Duration) string {
+		link, err := s.Sign("http://localhost:4000/reset-password?email=a%40b.com", PurposePasswordReset, ttl, map[string]string{"user": "42"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+
+	tests := []struct {
+		name string
+		signer *URLSigner //assina o link
+		verifier *URLSigner //verifica o link
+		ttl time.Duration
+		change func(t *testing.T, link string) string
+		purpose string
+		want error
+	}{
+		{"valid", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, nil, PurposePasswordReset, nil},
+		{"expired", newSigner(t, keyNew), newSigner(t, keyNew), -time.Minute, nil, PurposePasswordReset, ErrExpired},
+		{"other path", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, func(t *testing.T, link string) string {
+			return strings.Replace(link, "/reset-password", "/verify-email", 1)
+		}, PurposePasswordReset, ErrTampered},
+		{"other query value", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, func(t *testing.T, link string) string {
+			return setParam(t, link, "email", "c@d.com")
+		}, PurposePasswordReset, ErrTampered},
+		{"added query parameter", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, func(t *testing.T, link string) string {
+			return setParam(t, link, "admin", "1")
+		}, PurposePasswordReset, ErrTampered},
+		{"other claim", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, func(t *testing.T, link string) string {
+			return setParam(t, link, "user", "43")
+		}, PurposePasswordReset, ErrTampered},
+		{"extended expiry", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, func(t *testing.T, link string) string {
+			return setParam(t, link, paramExpires, "4102444800")
+		}, PurposePasswordReset, ErrTampered},
+		{"changed purpose", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, func(t *testing.T, link string) string {
+			return setParam(t, link, paramPurpose, PurposeCustomerLogin)
+		}, PurposeCustomerLogin, ErrTampered},
+		{"other signature", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, func(t *testing.T, link string) string {
+			return setParam(t, link, paramSignature, sign([]byte("guess"), "/reset-password"))
+		}, PurposePasswordReset, ErrTampered},
+		{"without signature", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, func(t *testing.T, link string) string {
+			return setParam(t, link, paramSignature, "")
+		}, PurposePasswordReset, ErrTampered},
+		{"other kid", newSigner(t, keyOld), newSigner(t, keyNew, keyOld), time.Hour, func(t *testing.T, link string) string {
+			return setParam(t, link, paramKeyID, keyNew.ID)
+		}, PurposePasswordReset, ErrTampered},
+		{"wrong purpose", newSigner(t, keyNew), newSigner(t, keyNew), time.Hour, nil, PurposeEmailVerification, ErrWrongPurpose},
+		//link assinado antes da rotacao, a chave antiga continua no key ring
+		{"rotated kid", newSigner(t, keyOld), newSigner(t, keyNew, keyOld), time.Hour, nil, PurposePasswordReset, nil},
+		//a chave antiga saiu do key ring, os links dela deixam de valer
+		{"removed kid", newSigner(t, keyOld), newSigner(t, keyNew), time.Hour, nil, PurposePasswordReset, ErrTampered},
+		{"unknown secret", newSigner(t, Key{ID: keyNew.ID, Secret: []byte("guess")}), newSigner(t, keyNew), time.Hour, nil, PurposePasswordReset, ErrTampered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link := signed(t, tt.signer, tt.ttl)
+			if tt.change != nil {
+				link = tt.change(t, link)
+			}
+			claims, err := tt.verifier.Verify(link, tt.purpose)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.want)
+			}
+			if err == nil && claims.Get("user") != "42" {
+				t.Errorf("user = %q, want 42", claims.Get("user"))
+			}
+		})
+	}
+}
+
+func TestSignReservedClaims(t *testing.T) {
+	s := newSigner(t, keyNew)
+	if _, err := s.Sign("http://localhost:4000/reset-password", PurposePasswordReset, time.Hour, map[string]string{paramExpires: "4102444800"}); err == nil {
+		t.Error("a claim named expires was accepted")
+	}
+	if _, err := s.Sign("http://localhost:4000/reset-password?kid=x", PurposePasswordReset, time.Hour, nil); err == nil {
+		t.Error("a url with a kid parameter was accepted")
+	}
+}
@@ -0,0 +1,272 @@
+package validator
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//Struct valida os campos de s pela tag validate, os erros usam o nome da tag json do campo.
+//Regras separadas por virgula:
+//
+//	required          o campo precisa ter valor
+//	min=N, max=N      tamanho do texto ou da lista, ou o valor do numero
+//	email             endereco de email
+//	currency          codigo de moeda ISO 4217, como usd ou BRL
+//	positive          numero, ou texto com numero, maior que zero
+//	expiry=campo      o campo é o mes do cartao e o campo indicado é o ano, o cartao nao pode estar vencido
+//	oneof=a b c       um dos valores separados por espaco
+//	regex=expr        casa com a expressao, deve ser a ultima regra porque pode ter virgulas
+//
+//Textos e listas vazios so sao validados pela regra required. Os numeros nao tem valor vazio,
+//positive, min e max tambem recusam o zero sem precisar de required. Os nomes em required tornam obrigatorios
+//os campos com essas tags json nesta validacao, para o mesmo payload servir a handlers diferentes
+func (v *Validator) Struct(s interface{}, required ...string) {
+	val := reflect.Indirect(reflect.ValueOf(s))
+	if val.Kind() != reflect.Struct {
+		panic("validator: Struct needs a struct")
+	}
+	typ := val.Type()
+
+	requiredNow := make(map[string]bool)
+	for _, name := range required {
+		requiredNow[name] = true
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := jsonName(field)
+		if key == "-" {
+			continue
+		}
+		value := val.Field(i)
+
+		rules := parseRules(field.Tag.Get("validate"))
+		if requiredNow[key] {
+			rules = append([]rule{{name: "required"}}, rules...)
+		}
+
+		for _, r := range rules {
+			if r.name != "required" && value.IsZero() && !(isNumber(value) && numericRules[r.name]) {
+				continue
+			}
+			if msg := r.check(val, value); msg != "" {
+				v.AddError(key, msg)
+				break
+			}
+		}
+	}
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+type rule struct {
+	name string
+	param string
+}
+
+func parseRules(tag string) []rule {
+	var rules []rule
+	for tag != "" {
+		var part string
+		//a regex vai ate o fim da tag
+		if strings.HasPrefix(tag, "regex=") {
+			part, tag = tag, ""
+		} else {
+			part, tag, _ = strings.Cut(tag, ",")
+		}
+		name, param, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			rules = append(rules, rule{name: name, param: param})
+		}
+	}
+	return rules
+}
+
+//check retorna a mensagem de erro, vazia quando o valor passa na regra
+func (r rule) check(parent, value reflect.Value) string {
+	switch r.name {
+	case "required":
+		if value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "" || value.IsZero() {
+			return "must be provided"
+		}
+	case "min", "max":
+		limit, err := strconv.Atoi(r.param)
+		if err != nil {
+			panic(fmt.Sprintf("validator: invalid %s=%s", r.name, r.param))
+		}
+		return checkLength(r.name, limit, value)
+	case "email":
+		if !IsEmail(value.String()) {
+			return "must be a valid email address"
+		}
+	case "currency":
+		if !IsCurrency(value.String()) {
+			return "must be a valid currency code"
+		}
+	case "positive":
+		n, ok := number(value)
+		if !ok || n <= 0 {
+			return "must be greater than zero"
+		}
+	case "expiry":
+		year := fieldByJSONName(parent, r.param)
+		if !year.IsValid() {
+			panic(fmt.Sprintf("validator: expiry=%s field not found", r.param))
+		}
+		month, _ := number(value)
+		y, _ := number(year)
+		if month < 1 || month > 12 {
+			return "must be a month between 1 and 12"
+		}
+		if !CardNotExpired(int(month), int(y), time.Now()) {
+			return "the card has expired"
+		}
+	case "oneof":
+		options := strings.Fields(r.param)
+		s := fmt.Sprint(value.Interface())
+		for _, o := range options {
+			if s == o {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(options, ", ")
+	case "regex":
+		if !compile(r.param).MatchString(value.String()) {
+			return "has an invalid format"
+		}
+	default:
+		panic("validator: unknown rule " + r.name)
+	}
+	return ""
+}
+
+func checkLength(name string, limit int, value reflect.Value) string {
+	var n int64
+	unit := " characters"
+	switch value.Kind() {
+	case reflect.String:
+		n = int64(utf8.RuneCountInString(strings.TrimSpace(value.String())))
+	case reflect.Slice, reflect.Map, reflect.Array:
+		n = int64(value.Len())
+		unit = " items"
+	default:
+		number, ok := number(value)
+		if !ok {
+			panic("validator: min and max need a string, a list or a number")
+		}
+		n = number
+		unit = ""
+	}
+
+	if name == "min" && n < int64(limit) {
+		return fmt.Sprintf("must be at least %d%s", limit, unit)
+	}
+	if name == "max" && n > int64(limit) {
+		return fmt.Sprintf("must be at most %d%s", limit, unit)
+	}
+	return ""
+}
+
+//regras que comparam o valor do numero, valem tambem para o zero
+var numericRules = map[string]bool{"positive": true, "min": true, "max": true}
+
+func isNumber(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+//number le inteiros e textos com inteiros, como o amount que o front envia como texto
+func number(value reflect.Value) (int64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint()), true
+	case reflect.String:
+		n, err := strconv.ParseInt(strings.TrimSpace(value.String()), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func fieldByJSONName(parent reflect.Value, name string) reflect.Value {
+	typ := parent.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		if jsonName(typ.Field(i)) == name {
+			return parent.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+var regexCache sync.Map
+
+func compile(expr string) *regexp.Regexp {
+	if rx, ok := regexCache.Load(expr); ok {
+		return rx.(*regexp.Regexp)
+	}
+	rx := regexp.MustCompile(expr)
+	regexCache.Store(expr, rx)
+	return rx
+}
+
+//IsEmail aceita apenas o endereco, sem nome, como a@b.com
+func IsEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s && strings.Contains(addr.Address[strings.LastIndex(addr.Address, "@"):], ".")
+}
+
+//codigos ISO 4217 em uso
+var currencies = strings.Fields(`
+	aed afn all amd ang aoa ars aud awg azn bam bbd bdt bgn bhd bif bmd bnd bob brl bsd btn bwp byn bzd
+	cad cdf chf clp cny cop crc cup cve czk djf dkk dop dzd egp ern etb eur fjd fkp gbp gel ghs gip gmd
+	gnf gtq gyd hkd hnl htg huf idr ils inr iqd irr isk jmd jod jpy kes kgs khr kmf kpw krw kwd kyd kzt
+	lak lbp lkr lrd lsl lyd mad mdl mga mkd mmk mnt mop mru mur mvr mwk mxn myr mzn nad ngn nio nok npr
+	nzd omr pab pen pgk php pkr pln pyg qar ron rsd rub rwf sar sbd scr sdg sek sgd shp sle sos srd ssp
+	stn svc syp szl thb tjs tmt tnd top try ttd twd tzs uah ugx usd uyu uzs ves vnd vuv wst xaf xcd xof
+	xpf yer zar zmw zwl
+`)
+
+var currencySet = func() map[string]bool {
+	set := make(map[string]bool, len(currencies))
+	for _, c := range currencies {
+		set[c] = true
+	}
+	return set
+}()
+
+func IsCurrency(s string) bool {
+	return currencySet[strings.ToLower(s)]
+}
+
+//CardNotExpired informa se o cartao vale em now, o cartao vale ate o fim do mes de vencimento
+func CardNotExpired(month, year int, now time.Time) bool {
+	if month < 1 || month > 12 {
+		return false
+	}
+	if year < 100 {
+		year += 2000
+	}
+	expires := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
+	return now.Before(expires)
+}
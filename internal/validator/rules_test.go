@@ -0,0 +1,148 @@
+package validator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type payment struct {
+	Amount int `json:"amount" validate:"positive"`
+	Text string `json:"text_amount" validate:"positive"`
+	Page int `json:"page" validate:"min=1,max=100"`
+	Currency string `json:"currency" validate:"currency"`
+	Email string `json:"email" validate:"email,max=20"`
+	Name string `json:"name" validate:"min=2"`
+	Tags []string `json:"tags" validate:"max=2"`
+	Status string `json:"status" validate:"oneof=open paid"`
+	LastFour string `json:"last_four" validate:"regex=^[0-9]{4}$"`
+	Month int `json:"exp_month" validate:"expiry=exp_year"`
+	Year int `json:"exp_year"`
+	Note string `json:"-" validate:"required"`
+}
+
+func TestStruct(t *testing.T) {
+	valid := func() payment {
+		return payment{Amount: 100, Page: 1, Text: "5"}
+	}
+
+	tests := []struct {
+		name string
+		change func(p *payment)
+		required []string
+		want map[string]string
+	}{
+		{"valid", func(p *payment) {}, nil, map[string]string{}},
+		{"zero amount", func(p *payment) { p.Amount = 0 }, nil,
+			map[string]string{"amount": "must be greater than zero"}},
+		{"negative amount", func(p *payment) { p.Amount = -1 }, nil,
+			map[string]string{"amount": "must be greater than zero"}},
+		{"zero page", func(p *payment) { p.Page = 0 }, nil,
+			map[string]string{"page": "must be at least 1"}},
+		{"large page", func(p *payment) { p.Page = 101 }, nil,
+			map[string]string{"page": "must be at most 100"}},
+		{"zero required amount", func(p *payment) { p.Amount = 0 }, []string{"amount"},
+			map[string]string{"amount": "must be provided"}},
+		{"empty text amount is optional", func(p *payment) { p.Text = "" }, nil, map[string]string{}},
+		{"empty text amount required", func(p *payment) { p.Text = " " }, []string{"text_amount"},
+			map[string]string{"text_amount": "must be provided"}},
+		{"zero text amount", func(p *payment) { p.Text = "0" }, nil,
+			map[string]string{"text_amount": "must be greater than zero"}},
+		{"text amount not a number", func(p *payment) { p.Text = "ten" }, nil,
+			map[string]string{"text_amount": "must be greater than zero"}},
+		{"currency", func(p *payment) { p.Currency = "BRL" }, nil, map[string]string{}},
+		{"unknown currency", func(p *payment) { p.Currency = "abc" }, nil,
+			map[string]string{"currency": "must be a valid currency code"}},
+		{"email with name", func(p *payment) { p.Email = "Ann <ann@example.com>" }, nil,
+			map[string]string{"email": "must be a valid email address"}},
+		{"long email", func(p *payment) { p.Email = "someone@example-domain.com" }, nil,
+			map[string]string{"email": "must be at most 20 characters"}},
+		{"short name", func(p *payment) { p.Name = "é" }, nil,
+			map[string]string{"name": "must be at least 2 characters"}},
+		{"accented name", func(p *payment) { p.Name = "Zoë" }, nil, map[string]string{}},
+		{"too many tags", func(p *payment) { p.Tags = []string{"a", "b", "c"} }, nil,
+			map[string]string{"tags": "must be at most 2 items"}},
+		{"other status", func(p *payment) { p.Status = "void" }, nil,
+			map[string]string{"status": "must be one of open, paid"}},
+		{"last four", func(p *payment) { p.LastFour = "12a4" }, nil,
+			map[string]string{"last_four": "has an invalid format"}},
+		{"no card is optional", func(p *payment) { p.Month, p.Year = 0, 0 }, nil, map[string]string{}},
+		{"card required", func(p *payment) { p.Month = 0 }, []string{"exp_month"},
+			map[string]string{"exp_month": "must be provided"}},
+		{"bad month", func(p *payment) { p.Month, p.Year = 13, 2099 }, nil,
+			map[string]string{"exp_month": "must be a month between 1 and 12"}},
+		{"expired card", func(p *payment) { p.Month, p.Year = 1, 2001 }, nil,
+			map[string]string{"exp_month": "the card has expired"}},
+		{"json dash is skipped", func(p *payment) { p.Note = "" }, nil, map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid()
+			tt.change(&p)
+			v := New()
+			v.Struct(&p, tt.required...)
+			if !reflect.DeepEqual(v.Errors, tt.want) {
+				t.Errorf("errors %v, want %v", v.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructRegexWithComma(t *testing.T) {
+	var s struct {
+		Code string `json:"code" validate:"max=10,regex=^[a-z]{2,3}$"`
+	}
+
+	s.Code = "abcd"
+	v := New()
+	v.Struct(&s)
+	if v.Errors["code"] != "has an invalid format" {
+		t.Errorf("errors %v, the regex should keep its comma", v.Errors)
+	}
+
+	s.Code = "abc"
+	v = New()
+	v.Struct(&s)
+	if !v.Valid() {
+		t.Errorf("errors %v for a valid code", v.Errors)
+	}
+}
+
+func TestCardNotExpired(t *testing.T) {
+	now := time.Date(2023, 9, 30, 23, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		month, year int
+		want bool
+	}{
+		{9, 2023, true},
+		{9, 23, true},
+		{8, 2023, false},
+		{12, 2022, false},
+		{1, 2024, true},
+		{0, 2024, false},
+		{13, 2024, false},
+	}
+	for _, tt := range tests {
+		if got := CardNotExpired(tt.month, tt.year, now); got != tt.want {
+			t.Errorf("CardNotExpired(%d, %d) = %v, want %v", tt.month, tt.year, got, tt.want)
+		}
+	}
+	if CardNotExpired(9, 2023, time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("the card should expire when its month ends")
+	}
+}
+
+func TestUnknownRulePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("an unknown rule should panic")
+		}
+	}()
+	var s struct {
+		Name string `json:"name" validate:"uppercase"`
+	}
+	s.Name = "ann"
+	New().Struct(&s)
+}